@@ -1,18 +1,41 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/igormartire/gorfiv/models"
 	"github.com/igormartire/gorfiv/server"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	database map[string]string
-	api      map[string]string
-	server   map[string]string
+	database  map[string]string
+	api       map[string]string
+	server    map[string]string
+	cache     map[string]string
+	jwt       map[string]string
+	rbac      rbacConfig
+	rateLimit map[string]string
+	fxRates   map[string]string
+	taxes     map[string]string
+}
+
+type rbacConfig struct {
+	roles     map[string][]string
+	routes    map[string]string
+	subjects  map[string][]string
+	operators []string
 }
 
 func main() {
@@ -21,20 +44,223 @@ func main() {
 		panic(err)
 	}
 
-	db, err := connectDb(config.database)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(config, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var repo models.Repo
+	if config.database["driver"] == "memory" {
+		repo = models.NewMemoryRepo()
+	} else {
+		db, dialect, err := openDb(config.database)
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		repo = models.NewSQLRepo(db, dialect)
+	}
+
+	var err error
+	if path := config.fxRates["csv"]; path != "" {
+		if err = loadFXRates(repo, path); err != nil {
+			panic(err)
+		}
+	}
+	if path := config.taxes["rules"]; path != "" {
+		if err = loadTaxRules(repo, path); err != nil {
+			panic(err)
+		}
+	}
+
+	var idempotencyTTL time.Duration
+	if ttl := config.api["idempotency_ttl"]; ttl != "" {
+		if idempotencyTTL, err = time.ParseDuration(ttl); err != nil {
+			panic(err)
+		}
+	}
+
+	jwtConfig, err := loadJWTConfig(config.jwt)
 	if err != nil {
 		panic(err)
 	}
-	defer db.Close()
 
-	mysqlRepo := models.NewSQLRepo(db)
+	policy, err := server.NewPolicy(config.rbac.roles, config.rbac.routes, config.rbac.subjects, config.jwt["roles_claim"], config.rbac.operators)
+	if err != nil {
+		panic(err)
+	}
 
-	err = server.
-		New(server.NewEnv(mysqlRepo), config.api["token"]).
-		Run(config.server["address"])
+	rateLimit, err := loadRateLimitConfig(config.rateLimit)
 	if err != nil {
 		panic(err)
 	}
+
+	router := server.New(server.NewEnv(repo), server.Config{
+		JWT:              jwtConfig,
+		Policy:           policy,
+		LegacyTokenAuth:  config.api["legacy_token"] == "true",
+		APIToken:         config.api["token"],
+		RequireIfMatch:   config.api["require_if_match"] == "true",
+		ItemCacheControl: config.cache["item"],
+		ListCacheControl: config.cache["list"],
+		IdempotencyTTL:   idempotencyTTL,
+		RateLimit:        rateLimit,
+	})
+	// only these proxies may set X-Forwarded-For, which rate limits by IP
+	// rely on
+	var proxies []string
+	for _, proxy := range strings.Split(config.server["trusted_proxies"], ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err = router.SetTrustedProxies(proxies); err != nil {
+		panic(err)
+	}
+	if err = router.Run(config.server["address"]); err != nil {
+		panic(err)
+	}
+}
+
+func loadFXRates(repo models.Repo, path string) error {
+	store, ok := repo.(models.FXRateStore)
+	if !ok {
+		return errors.New("the repo can't store exchange rates")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rates, err := models.ReadFXRatesCSV(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return store.UpsertFXRates(rates)
+}
+
+func loadTaxRules(repo models.Repo, path string) error {
+	store, ok := repo.(models.TaxStore)
+	if !ok {
+		return errors.New("the repo can't compute taxes")
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	// models.ReadTaxRules reads JSON, which a TOML file is turned into
+	document, err := json.Marshal(v.AllSettings())
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	rules, err := models.ReadTaxRules(bytes.NewReader(document))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	store.SetTaxEngine(rules)
+	return nil
+}
+
+func loadRateLimitConfig(params map[string]string) (config server.RateLimitConfig, err error) {
+	config.Groups = map[string]server.RateLimit{}
+	for key, value := range params {
+		limit, err := server.ParseRateLimit(value)
+		if err != nil {
+			return config, err
+		}
+		switch key {
+		case "ip":
+			config.IP = limit
+		case server.RouteGroupInvoices, server.RouteGroupAdmin:
+			config.Groups[key] = limit
+		default:
+			return config, fmt.Errorf("unknown rate limit %q", key)
+		}
+	}
+	return
+}
+
+func loadJWTConfig(params map[string]string) (config server.JWTConfig, err error) {
+	config.Audience = params["audience"]
+	config.Issuer = params["issuer"]
+	config.TenantClaim = params["tenant_claim"]
+	config.DefaultTenant = params["default_tenant"]
+	if params["secret"] != "" {
+		config.Secret = []byte(params["secret"])
+	}
+	if params["public_key"] != "" {
+		if config.PublicKey, err = server.LoadPublicKey(params["public_key"]); err != nil {
+			return
+		}
+	}
+	if params["jwks_file"] != "" {
+		config.KeySet, err = server.LoadJWKS(params["jwks_file"])
+	}
+	return
+}
+
+func migrate(config Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: gorfiv migrate up|down|status")
+	}
+	if config.database["driver"] == "memory" {
+		return errors.New("the memory driver has no schema to migrate")
+	}
+
+	db, dialect, err := openDb(config.database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator := models.NewMigrator(db, dialect)
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := migrator.Down()
+		if err == nil {
+			fmt.Printf("reverted %d_%s\n", reverted.Version, reverted.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Printf("%d_%s\tapplied at %v\n", s.Version, s.Name, s.AppliedAt.Time)
+			} else {
+				fmt.Printf("%d_%s\tpending\n", s.Version, s.Name)
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+func openDb(params map[string]string) (db *sql.DB, dialect models.Dialect, err error) {
+	switch params["driver"] {
+	case "", "mysql":
+		db, err = connectDb(params)
+		return db, models.MySQL, err
+	case "postgres":
+		db, err = connectPostgres(params)
+		return db, models.Postgres, err
+	case "sqlite":
+		db, err = connectSQLite(params)
+		return db, models.SQLite, err
+	}
+	return nil, nil, fmt.Errorf("unknown database driver %q", params["driver"])
 }
 
 func (c *Config) load() (err error) {
@@ -48,6 +274,15 @@ func (c *Config) load() (err error) {
 		c.database = viper.GetStringMapString("database")
 		c.api = viper.GetStringMapString("api")
 		c.server = viper.GetStringMapString("server")
+		c.cache = viper.GetStringMapString("cache")
+		c.jwt = viper.GetStringMapString("jwt")
+		c.rbac.roles = viper.GetStringMapStringSlice("rbac.roles")
+		c.rbac.routes = viper.GetStringMapString("rbac.routes")
+		c.rbac.subjects = viper.GetStringMapStringSlice("rbac.subjects")
+		c.rbac.operators = viper.GetStringSlice("rbac.operators")
+		c.rateLimit = viper.GetStringMapString("rate_limit")
+		c.fxRates = viper.GetStringMapString("fx_rates")
+		c.taxes = viper.GetStringMapString("taxes")
 	}
 
 	return nil
@@ -60,6 +295,8 @@ func connectDb(params map[string]string) (db *sql.DB, err error) {
 		DBName:    params["name"],
 		Collation: "utf8_general_ci",
 		ParseTime: true,
+		// report matched instead of changed rows, like the other databases
+		ClientFoundRows: true,
 	}).FormatDSN())
 
 	if err != nil {
@@ -73,3 +310,38 @@ func connectDb(params map[string]string) (db *sql.DB, err error) {
 
 	return db, nil
 }
+
+func connectSQLite(params map[string]string) (db *sql.DB, err error) {
+	db, err = sql.Open("sqlite3", "file:"+params["path"]+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func connectPostgres(params map[string]string) (db *sql.DB, err error) {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(params["user"], params["password"]),
+		Host:     params["host"],
+		Path:     params["name"],
+		RawQuery: url.Values{"sslmode": {params["sslmode"]}}.Encode(),
+	}
+	db, err = sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/igormartire/gorfiv/models"
+	"github.com/igormartire/gorfiv/server"
+)
+
+func TestConfigPolicyCoversRoutes(t *testing.T) {
+	var config Config
+	if err := config.load(); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := server.NewPolicy(config.rbac.roles, config.rbac.routes, config.rbac.subjects, config.jwt["roles_claim"], config.rbac.operators)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := server.New(server.NewEnv(models.NewMemoryRepo()), server.Config{Policy: policy})
+	for _, route := range router.Routes() {
+		if _, ok := policy.Routes[route.Method+" "+route.Path]; !ok {
+			t.Errorf("%s %s should have had an access policy in config/app.toml.", route.Method, route.Path)
+		}
+	}
+}
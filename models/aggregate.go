@@ -0,0 +1,405 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	UnknownMetric    = errors.New("unknown metric")
+	UngroupableField = errors.New("field can't be grouped by")
+	InvalidAggregate = errors.New("an aggregate needs metrics, and takes no cursor nor fields")
+	MixedCurrencies  = errors.New("amounts in different currencies can't be aggregated together")
+)
+
+type MetricFunc string
+
+const (
+	MetricCount MetricFunc = "count"
+	MetricSum   MetricFunc = "sum"
+	MetricAvg   MetricFunc = "avg"
+	MetricMin   MetricFunc = "min"
+	MetricMax   MetricFunc = "max"
+)
+
+// metricSQL holds the SQL expression of each function, with %s standing for
+// the column. SUM of no rows is NULL, but the sum of no amounts is 0.
+var metricSQL = map[MetricFunc]string{
+	MetricCount: "COUNT(*)",
+	MetricSum:   "COALESCE(SUM(%s), 0)",
+	MetricAvg:   "AVG(%s)",
+	MetricMin:   "MIN(%s)",
+	MetricMax:   "MAX(%s)",
+}
+
+var GroupableFields = []string{"referenceYear", "referenceMonth", "document", "currency"}
+
+type Metric struct {
+	Func  MetricFunc
+	Field string
+}
+
+func ParseMetric(s string) (Metric, error) {
+	m := Metric{Func: MetricFunc(s)}
+	if i := strings.IndexByte(s, '('); i > 0 && strings.HasSuffix(s, ")") {
+		m = Metric{Func: MetricFunc(s[:i]), Field: s[i+1 : len(s)-1]}
+	}
+	if err := m.check(); err != nil {
+		return Metric{}, err
+	}
+	return m, nil
+}
+
+func Metrics() (metrics []string) {
+	metrics = append(metrics, string(MetricCount))
+	for _, f := range []MetricFunc{MetricSum, MetricAvg, MetricMin, MetricMax} {
+		for _, field := range invoiceJSONFields {
+			if fieldKinds[field.name] == KindMoney {
+				metrics = append(metrics, Metric{f, field.name}.String())
+			}
+		}
+	}
+	return
+}
+
+func (m Metric) String() string {
+	if m.Field == "" {
+		return string(m.Func)
+	}
+	return string(m.Func) + "(" + m.Field + ")"
+}
+
+func (m Metric) check() error {
+	if _, ok := metricSQL[m.Func]; !ok || (m.Func == MetricCount) != (m.Field == "") {
+		return fmt.Errorf("%w: %q", UnknownMetric, m.String())
+	}
+	if m.Field != "" && fieldKinds[m.Field] != KindMoney {
+		return fmt.Errorf("%w: %q", UnknownMetric, m.String())
+	}
+	return nil
+}
+
+func (m Metric) sql() string {
+	if m.Field == "" {
+		return metricSQL[m.Func]
+	}
+	return fmt.Sprintf(metricSQL[m.Func], invoiceColumns[m.Field])
+}
+
+// selectSQL returns the columns m is read from. An average is read as the
+// sum and the count it divides, which every database computes exactly, and
+// divided in Go.
+func (m Metric) selectSQL() string {
+	if m.Func == MetricAvg {
+		column := invoiceColumns[m.Field]
+		return "SUM(" + column + "), COUNT(" + column + ")"
+	}
+	return m.sql()
+}
+
+var sumFormat = fixedPoint{decimals: 2, integerDigits: 16, min: -maxSum, max: maxSum, kind: InvalidMoney}
+
+const maxSum = 999999999999999999
+
+type AggregateOptions struct {
+	QueryOptions
+	GroupBy []string
+	Metrics []Metric
+}
+
+// Group is the result of aggregating some invoices: Keys holds the values
+// of the fields grouped by and Values those of the metrics, in order. Counts
+// are ints and averages float64s; sums, minimums and maximums are exact
+// Money. A value is nil when undefined, as the average of no invoices.
+type Group struct {
+	Keys   []interface{}
+	Values []interface{}
+}
+
+func (opts *AggregateOptions) check() error {
+	if len(opts.Metrics) == 0 || opts.Cursor != nil || opts.Fields != nil {
+		return InvalidAggregate
+	}
+	seen := map[string]bool{}
+	for _, field := range opts.GroupBy {
+		if seen[field] || !isGroupable(field) {
+			return fmt.Errorf("%w: %q", UngroupableField, field)
+		}
+		seen[field] = true
+	}
+	for _, m := range opts.Metrics {
+		if err := m.check(); err != nil {
+			return err
+		}
+	}
+	for _, s := range opts.Sorts {
+		if opts.keyIndex(s.Field) < 0 {
+			return fmt.Errorf("%w: %q is neither grouped by nor a metric", UnknownField, s.Field)
+		}
+	}
+	return nil
+}
+
+func isGroupable(field string) bool {
+	for _, f := range GroupableFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts *AggregateOptions) keyIndex(name string) int {
+	for k, field := range opts.GroupBy {
+		if field == name {
+			return k
+		}
+	}
+	for k, m := range opts.Metrics {
+		if m.String() == name {
+			return len(opts.GroupBy) + k
+		}
+	}
+	return -1
+}
+
+func (opts *AggregateOptions) mixesCurrencies() bool {
+	for _, field := range opts.GroupBy {
+		if field == "currency" {
+			return false
+		}
+	}
+	for _, m := range opts.Metrics {
+		if fieldKinds[m.Field] == KindMoney {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts *AggregateOptions) orderKeys() []Sort {
+	keys := append([]Sort{}, opts.Sorts...)
+	for _, field := range opts.GroupBy {
+		sorted := false
+		for _, s := range opts.Sorts {
+			sorted = sorted || s.Field == field
+		}
+		if !sorted {
+			keys = append(keys, Sort{Field: field})
+		}
+	}
+	return keys
+}
+
+func (opts *AggregateOptions) column(name string) string {
+	if k := opts.keyIndex(name); k >= len(opts.GroupBy) {
+		return opts.Metrics[k-len(opts.GroupBy)].sql()
+	}
+	return invoiceColumns[name]
+}
+
+func (b *queryBuilder) WriteAggregate(opts *AggregateOptions) {
+	columns := make([]string, 0, len(opts.GroupBy)+len(opts.Metrics))
+	for _, field := range opts.GroupBy {
+		columns = append(columns, invoiceColumns[field])
+	}
+	for _, m := range opts.Metrics {
+		columns = append(columns, m.selectSQL())
+	}
+	b.Write(strings.Join(columns, ", "))
+}
+
+func (b *queryBuilder) WriteGroupBy(opts *AggregateOptions) {
+	if len(opts.GroupBy) == 0 {
+		return
+	}
+	columns := make([]string, len(opts.GroupBy))
+	for k, field := range opts.GroupBy {
+		columns[k] = invoiceColumns[field]
+	}
+	b.Write(" GROUP BY " + strings.Join(columns, ", "))
+}
+
+func (b *queryBuilder) WriteGroupPage(opts *AggregateOptions) {
+	keys := opts.orderKeys()
+	if len(keys) > 0 {
+		columns := make([]string, len(keys))
+		for k, s := range keys {
+			columns[k] = opts.column(s.Field)
+			if s.Desc {
+				columns[k] += " DESC"
+			} else {
+				columns[k] += " ASC"
+			}
+		}
+		b.Write(" ORDER BY " + strings.Join(columns, ", "))
+	}
+	b.WriteLimit(opts.Pagination)
+}
+
+func scanGroup(row scanner, opts *AggregateOptions) (*Group, error) {
+	g := &Group{Keys: make([]interface{}, len(opts.GroupBy)), Values: make([]interface{}, len(opts.Metrics))}
+	dest := make([]interface{}, 0, len(g.Keys)+len(g.Values))
+	for _, field := range opts.GroupBy {
+		if fieldKinds[field] == KindInteger {
+			dest = append(dest, new(int))
+		} else {
+			dest = append(dest, new(string))
+		}
+	}
+	amounts := make([]interface{}, len(opts.Metrics))
+	counts := make([]int, len(opts.Metrics))
+	for k, m := range opts.Metrics {
+		switch m.Func {
+		case MetricCount:
+			dest = append(dest, &counts[k])
+		case MetricAvg:
+			dest = append(dest, &amounts[k], &counts[k])
+		default:
+			dest = append(dest, &amounts[k])
+		}
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	for k := range g.Keys {
+		switch v := dest[k].(type) {
+		case *int:
+			g.Keys[k] = *v
+		case *string:
+			g.Keys[k] = *v
+		}
+	}
+	for k, m := range opts.Metrics {
+		if m.Func == MetricCount {
+			g.Values[k] = counts[k]
+			continue
+		}
+		if amounts[k] == nil {
+			continue
+		}
+		sum, err := sumFormat.scan(amounts[k])
+		if err != nil {
+			return nil, err
+		}
+		if m.Func == MetricAvg {
+			g.Values[k] = Money(sum).Float64() / float64(counts[k])
+		} else {
+			g.Values[k] = Money(sum)
+		}
+	}
+	return g, nil
+}
+
+func aggregateInvoices(invoices []*Invoice, opts *AggregateOptions) ([]*Group, error) {
+	var groups []*Group
+	members := map[string][]*Invoice{}
+	for _, i := range invoices {
+		keys := make([]interface{}, len(opts.GroupBy))
+		for k, field := range opts.GroupBy {
+			keys[k] = invoiceFieldValue(i, field)
+		}
+		id := fmt.Sprintf("%#v", keys)
+		if _, ok := members[id]; !ok {
+			groups = append(groups, &Group{Keys: keys})
+		}
+		members[id] = append(members[id], i)
+	}
+	// like SQL, no grouping makes one group even of no invoices
+	if len(opts.GroupBy) == 0 && len(groups) == 0 {
+		groups = append(groups, &Group{Keys: []interface{}{}})
+	}
+
+	for _, g := range groups {
+		group := members[fmt.Sprintf("%#v", g.Keys)]
+		if opts.mixesCurrencies() {
+			for _, i := range group {
+				if i.Currency != group[0].Currency {
+					return nil, MixedCurrencies
+				}
+			}
+		}
+		g.Values = make([]interface{}, len(opts.Metrics))
+		for k, m := range opts.Metrics {
+			value, err := computeMetric(m, group)
+			if err != nil {
+				return nil, err
+			}
+			g.Values[k] = value
+		}
+	}
+
+	keys := opts.orderKeys()
+	sort.SliceStable(groups, func(a, b int) bool {
+		for _, s := range keys {
+			k := opts.keyIndex(s.Field)
+			var cmp int
+			if k < len(opts.GroupBy) {
+				cmp = compareValues(groups[a].Keys[k], groups[b].Keys[k])
+			} else {
+				cmp = compareMetricValues(groups[a].Values[k-len(opts.GroupBy)], groups[b].Values[k-len(opts.GroupBy)])
+			}
+			if cmp != 0 {
+				return (cmp < 0) != s.Desc
+			}
+		}
+		return false
+	})
+	return groups, nil
+}
+
+func computeMetric(m Metric, invoices []*Invoice) (interface{}, error) {
+	if m.Func == MetricCount {
+		return len(invoices), nil
+	}
+	if len(invoices) == 0 {
+		if m.Func == MetricSum {
+			return Money(0), nil
+		}
+		return nil, nil
+	}
+
+	total := invoiceFieldValue(invoices[0], m.Field).(Money)
+	if m.Func == MetricSum || m.Func == MetricAvg {
+		total = 0
+	}
+	for _, i := range invoices {
+		v := invoiceFieldValue(i, m.Field).(Money)
+		switch {
+		case m.Func == MetricSum || m.Func == MetricAvg:
+			if total += v; total > maxSum || total < -maxSum {
+				return nil, MoneyOutOfRange
+			}
+		case m.Func == MetricMin && v < total, m.Func == MetricMax && v > total:
+			total = v
+		}
+	}
+	if m.Func == MetricAvg {
+		return total.Float64() / float64(len(invoices)), nil
+	}
+	return total, nil
+}
+
+func compareMetricValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if a, ok := a.(float64); ok {
+		switch b := b.(float64); {
+		case a > b:
+			return 1
+		case a < b:
+			return -1
+		}
+		return 0
+	}
+	return compareValues(a, b)
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix       = "gk_"
+	apiKeyPrefixLength = len(apiKeyPrefix) + 8
+)
+
+const (
+	ScopeInvoicesRead   = "invoices:read"
+	ScopeInvoicesWrite  = "invoices:write"
+	ScopeInvoicesDelete = "invoices:delete"
+	ScopeAPIKeysManage  = "apikeys:manage"
+)
+
+var Scopes = []string{ScopeInvoicesRead, ScopeInvoicesWrite, ScopeInvoicesDelete, ScopeAPIKeysManage}
+
+// ScopeFXRatesManage changes the exchange rates that all tenants share, so
+// no API key can be granted it.
+const ScopeFXRatesManage = "fxrates:manage"
+
+var (
+	APIKeyNotFound = errors.New("api key not found")
+	UnknownScope   = errors.New("unknown scope")
+)
+
+// APIKey identifies one client of the API. Only the SHA-256 hash of its
+// secret is stored; Prefix, the beginning of the secret, lets people tell
+// keys apart. A key only gives access to the invoices of its tenant.
+type APIKey struct {
+	Id         int       `json:"id"`
+	TenantId   string    `json:"-"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Hash       string    `json:"-"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  NullTime  `json:"expiresAt"`
+	LastUsedAt NullTime  `json:"lastUsedAt"`
+	RevokedAt  NullTime  `json:"revokedAt"`
+}
+
+func (k *APIKey) Usable(now time.Time) bool {
+	return !k.RevokedAt.Valid && !(k.ExpiresAt.Valid && !now.Before(k.ExpiresAt.Time))
+}
+
+type APIKeyStore interface {
+	InsertAPIKey(k APIKey) (id int64, err error)
+	GetAPIKeys(tenant string) ([]*APIKey, error)
+	GetAPIKeyById(tenant string, id int) (*APIKey, error)
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	RotateAPIKey(tenant string, id int, prefix string, hash string) error
+	RevokeAPIKey(tenant string, id int, at time.Time) error
+	TouchAPIKey(id int, at time.Time) error
+}
+
+func NewAPIKeySecret() (secret string, prefix string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	secret = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return secret, secret[:apiKeyPrefixLength], HashAPIKeySecret(secret), nil
+}
+
+// HashAPIKeySecret returns the hash under which the key of secret is
+// stored. Secrets are random, so a plain SHA-256 is enough.
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func CheckScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return UnknownScope
+		}
+	}
+	return nil
+}
+
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func splitScopes(s string) []string {
+	scopes := strings.Fields(s)
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return scopes
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"errors"
+	"sort"
+)
+
+// DefaultCurrency is the currency of invoices created without one, as
+// every invoice was before invoices had currencies.
+const DefaultCurrency = "BRL"
+
+var (
+	UnknownCurrency  = errors.New("unknown currency")
+	AmountTooPrecise = errors.New("amount has more decimals than its currency")
+)
+
+// currencyMinorUnits maps the ISO 4217 codes of the currencies invoices may
+// be in to the number of decimals of their amounts, which Money limits to
+// two.
+var currencyMinorUnits = map[string]int{
+	"BRL": 2,
+	"EUR": 2,
+	"JPY": 0,
+	"USD": 2,
+}
+
+func Currencies() []string {
+	codes := make([]string, 0, len(currencyMinorUnits))
+	for code := range currencyMinorUnits {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func CheckCurrency(code string) error {
+	if _, ok := currencyMinorUnits[code]; !ok {
+		return UnknownCurrency
+	}
+	return nil
+}
+
+func MinorUnits(currency string) int {
+	return currencyMinorUnits[currency]
+}
+
+func minorUnit(currency string) Money {
+	unit := Money(1)
+	for k := MinorUnits(currency); k < 2; k++ {
+		unit *= 10
+	}
+	return unit
+}
+
+func CheckAmount(currency string, amount Money) error {
+	if err := CheckCurrency(currency); err != nil {
+		return err
+	}
+	if amount%minorUnit(currency) != 0 {
+		return AmountTooPrecise
+	}
+	return amount.Check()
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var InvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a listing for keyset pagination: the sort key of
+// the row the page starts after, or ends before when Before is set. The zero
+// Cursor is the start of the listing.
+type Cursor struct {
+	Values []string
+	Id     int
+	Before bool
+}
+
+type encodedCursor struct {
+	Sorts  string   `json:"s"`
+	Values []string `json:"v"`
+	Id     int      `json:"id"`
+	Before bool     `json:"b,omitempty"`
+}
+
+func NewCursor(i *Invoice, sorts []Sort, before bool) *Cursor {
+	c := &Cursor{Id: i.Id, Before: before, Values: make([]string, len(sorts))}
+	for k, s := range sorts {
+		c.Values[k] = formatInvoiceField(i, s.Field)
+	}
+	return c
+}
+
+// Encode makes c opaque to clients. The sorts are kept along, so that a
+// cursor can't be used with another order.
+func (c *Cursor) Encode(sorts []Sort) string {
+	b, _ := json.Marshal(encodedCursor{Sorts: sortsString(sorts), Values: c.Values, Id: c.Id, Before: c.Before})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string, sorts []Sort) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, InvalidCursor
+	}
+	var e encodedCursor
+	if err = json.Unmarshal(b, &e); err != nil || e.Sorts != sortsString(sorts) || len(e.Values) != len(sorts) || e.Id < 1 {
+		return nil, InvalidCursor
+	}
+	c := &Cursor{Values: e.Values, Id: e.Id, Before: e.Before}
+	if _, err = c.invoice(sorts); err != nil {
+		return nil, InvalidCursor
+	}
+	return c, nil
+}
+
+func (c *Cursor) IsStart() bool {
+	return c.Id == 0
+}
+
+func (c *Cursor) invoice(sorts []Sort) (*Invoice, error) {
+	i := &Invoice{Id: c.Id}
+	for k, s := range sorts {
+		if err := setInvoiceField(i, s.Field, c.Values[k]); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+func orderKeys(sorts []Sort) []Sort {
+	for _, s := range sorts {
+		if s.Field == "id" {
+			return sorts
+		}
+	}
+	return append(append([]Sort{}, sorts...), Sort{Field: "id"})
+}
+
+func sortsString(sorts []Sort) string {
+	fields := make([]string, len(sorts))
+	for k, s := range sorts {
+		if s.Desc {
+			fields[k] = "-"
+		}
+		fields[k] += s.Field
+	}
+	return strings.Join(fields, ",")
+}
+
+func formatInvoiceField(i *Invoice, field string) string {
+	switch v := invoiceFieldValue(i, field).(type) {
+	case int:
+		return strconv.Itoa(v)
+	case Money:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func invoiceFieldValue(i *Invoice, field string) interface{} {
+	switch field {
+	case "id", "referenceMonth", "referenceYear":
+		return invoiceIntField(i, field)
+	case "amount":
+		return i.Amount
+	case "createdAt":
+		return i.CreatedAt
+	case "document":
+		return i.Document
+	case "description":
+		return i.Description
+	case "currency":
+		return i.Currency
+	case "status":
+		return string(i.Status)
+	}
+	return nil
+}
+
+func setInvoiceField(i *Invoice, field string, value string) (err error) {
+	switch field {
+	case "id":
+		i.Id, err = strconv.Atoi(value)
+	case "referenceMonth":
+		i.ReferenceMonth, err = strconv.Atoi(value)
+	case "referenceYear":
+		i.ReferenceYear, err = strconv.Atoi(value)
+	case "amount":
+		i.Amount, err = ParseMoney(value)
+	case "createdAt":
+		i.CreatedAt, err = time.Parse(time.RFC3339Nano, value)
+	case "document":
+		i.Document = value
+	case "description":
+		i.Description = value
+	case "currency":
+		i.Currency = value
+	case "status":
+		i.Status = InvoiceStatus(value)
+	default:
+		_, err = invoiceColumn(field)
+	}
+	return
+}
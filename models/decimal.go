@@ -0,0 +1,115 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fixedPoint describes an exact decimal type kept as a count of its
+// smallest unit, as Money, Rate and TaxRate are, so that they all parse,
+// write and scan alike: as decimal text, both in SQL and in JSON, and never
+// through a float.
+type fixedPoint struct {
+	decimals      int
+	integerDigits int
+	min, max      int64
+	trimZeros     bool
+	kind          error
+	rule          string
+}
+
+func (f fixedPoint) parse(s string) (int64, error) {
+	return f.check(parseDecimal(s, f.decimals, f.integerDigits))
+}
+
+func (f fixedPoint) check(units int64, err error) (int64, error) {
+	if err == nil && (units < f.min || units > f.max) {
+		err = MoneyOutOfRange
+	}
+	if err != nil && f.rule != "" {
+		return 0, fmt.Errorf("%w: %s", f.kind, f.rule)
+	}
+	return units, err
+}
+
+func (f fixedPoint) format(units int64) string {
+	sign := ""
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	scale := int64(1)
+	for k := 0; k < f.decimals; k++ {
+		scale *= 10
+	}
+	s := fmt.Sprintf("%s%d.%0*d", sign, units/scale, f.decimals, units%scale)
+	if f.trimZeros {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+func (f fixedPoint) unmarshalJSON(b []byte) (int64, error) {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	return f.parse(s)
+}
+
+// scan reads a DECIMAL column, which drivers return as text, or, for
+// SQLite, as the count of the smallest unit that SQLite.Bind wrote.
+func (f fixedPoint) scan(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case []byte:
+		return f.parse(string(v))
+	case string:
+		return f.parse(v)
+	case int64:
+		return f.check(v, nil)
+	}
+	return 0, fmt.Errorf("%w: can't scan %T", f.kind, value)
+}
+
+func parseDecimal(s string, decimals int, integerDigits int) (int64, error) {
+	digits := strings.TrimPrefix(s, "-")
+	negative := len(digits) < len(s)
+	integer, fraction := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		integer, fraction = digits[:i], digits[i+1:]
+		if fraction == "" {
+			return 0, InvalidMoney
+		}
+	}
+	if integer == "" || !isDecimalDigits(integer) || !isDecimalDigits(fraction) {
+		return 0, InvalidMoney
+	}
+
+	// zeros past the smallest unit don't change the number
+	if trimmed := strings.TrimRight(fraction, "0"); len(trimmed) > decimals {
+		return 0, MoneyTooPrecise
+	} else if len(fraction) > decimals {
+		fraction = trimmed
+	}
+	if integer = strings.TrimLeft(integer, "0"); len(integer) > integerDigits {
+		return 0, MoneyOutOfRange
+	}
+
+	units, err := strconv.ParseInt(integer+(fraction + strings.Repeat("0", decimals))[:decimals], 10, 64)
+	if err != nil {
+		return 0, InvalidMoney
+	}
+	if negative {
+		units = -units
+	}
+	return units, nil
+}
+
+func isDecimalDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+)
+
+type Dialect interface {
+	Name() string
+	Rebind(query string) string
+	Insert(q Querier, query string, args ...interface{}) (id int64, err error)
+	ForUpdate() string
+	BeginRead() string
+	OnConflictUpdate(key []string, columns []string) string
+	Bind(args []interface{}) []interface{}
+}
+
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var (
+	MySQL    Dialect = lastInsertIdDialect{name: "mysql", forUpdate: " FOR UPDATE", beginRead: "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY", onDuplicateKey: true}
+	SQLite   Dialect = lastInsertIdDialect{name: "sqlite", beginRead: "BEGIN DEFERRED", integerDecimals: true}
+	Postgres Dialect = postgresDialect{}
+)
+
+type boundDB struct {
+	*sql.DB
+	dialect Dialect
+}
+
+func (db boundDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(query, db.dialect.Bind(args)...)
+}
+
+func (db boundDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(query, db.dialect.Bind(args)...)
+}
+
+func (db boundDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(query, db.dialect.Bind(args)...)
+}
+
+func (db boundDB) Begin() (boundTx, error) {
+	tx, err := db.DB.Begin()
+	return boundTx{tx, db.dialect}, err
+}
+
+// BeginRead starts a read-only transaction. It is begun by hand, on a
+// connection of its own, because the SQLite driver begins every
+// transaction as configured, _txlock=immediate, which locks the database.
+func (db boundDB) BeginRead() (boundReadTx, error) {
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return boundReadTx{}, err
+	}
+	if _, err = conn.ExecContext(ctx, db.dialect.BeginRead()); err != nil {
+		conn.Close()
+		return boundReadTx{}, err
+	}
+	return boundReadTx{conn, db.dialect}, nil
+}
+
+type boundTx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (tx boundTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(query, tx.dialect.Bind(args)...)
+}
+
+func (tx boundTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(query, tx.dialect.Bind(args)...)
+}
+
+func (tx boundTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(query, tx.dialect.Bind(args)...)
+}
+
+type boundReadTx struct {
+	conn    *sql.Conn
+	dialect Dialect
+}
+
+func (tx boundReadTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.conn.ExecContext(context.Background(), query, tx.dialect.Bind(args)...)
+}
+
+func (tx boundReadTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.conn.QueryContext(context.Background(), query, tx.dialect.Bind(args)...)
+}
+
+func (tx boundReadTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.conn.QueryRowContext(context.Background(), query, tx.dialect.Bind(args)...)
+}
+
+func (tx boundReadTx) Rollback() error {
+	_, err := tx.conn.ExecContext(context.Background(), "ROLLBACK")
+	if err != nil {
+		tx.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	tx.conn.Close()
+	return err
+}
+
+func bindUnits(args []interface{}) []interface{} {
+	bound := make([]interface{}, len(args))
+	for k, arg := range args {
+		switch v := arg.(type) {
+		case Money:
+			bound[k] = int64(v)
+		case Rate:
+			bound[k] = int64(v)
+		case TaxRate:
+			bound[k] = int64(v)
+		default:
+			bound[k] = arg
+		}
+	}
+	return bound
+}
+
+// lastInsertIdDialect covers the databases that understand ? placeholders
+// and report generated ids through sql.Result.LastInsertId. SQLite has no
+// row locks: its transactions must be started with _txlock=immediate so
+// that they lock the whole database instead. Its DECIMAL columns are
+// floats, which lose digits past the fifteenth, so it stores fixed-point
+// values as the integer counts of their smallest unit instead, as in 1050
+// for 10.50. MySQL has its own upserts.
+type lastInsertIdDialect struct {
+	name            string
+	forUpdate       string
+	beginRead       string
+	onDuplicateKey  bool
+	integerDecimals bool
+}
+
+func (d lastInsertIdDialect) Name() string {
+	return d.name
+}
+
+func (d lastInsertIdDialect) ForUpdate() string {
+	return d.forUpdate
+}
+
+func (d lastInsertIdDialect) BeginRead() string {
+	return d.beginRead
+}
+
+func (d lastInsertIdDialect) OnConflictUpdate(key []string, columns []string) string {
+	if !d.onDuplicateKey {
+		return onConflictUpdate(key, columns)
+	}
+	assignments := make([]string, len(columns))
+	for k, column := range columns {
+		assignments[k] = column + "=VALUES(" + column + ")"
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
+func (lastInsertIdDialect) Rebind(query string) string {
+	return query
+}
+
+func (d lastInsertIdDialect) Bind(args []interface{}) []interface{} {
+	if !d.integerDecimals {
+		return args
+	}
+	return bindUnits(args)
+}
+
+func (lastInsertIdDialect) Insert(q Querier, query string, args ...interface{}) (id int64, err error) {
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return
+	}
+	return res.LastInsertId()
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (postgresDialect) BeginRead() string {
+	return "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY"
+}
+
+func (postgresDialect) OnConflictUpdate(key []string, columns []string) string {
+	return onConflictUpdate(key, columns)
+}
+
+func (postgresDialect) Bind(args []interface{}) []interface{} {
+	return args
+}
+
+func (postgresDialect) Rebind(query string) string {
+	var buf bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// Insert relies on RETURNING because lib/pq does not implement
+// LastInsertId.
+func (d postgresDialect) Insert(q Querier, query string, args ...interface{}) (id int64, err error) {
+	err = q.QueryRow(d.Rebind(query)+" RETURNING Id", args...).Scan(&id)
+	return
+}
+
+func onConflictUpdate(key []string, columns []string) string {
+	assignments := make([]string, len(columns))
+	for k, column := range columns {
+		assignments[k] = column + "=excluded." + column
+	}
+	return " ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + strings.Join(assignments, ", ")
+}
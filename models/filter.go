@@ -0,0 +1,342 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	UnsupportedOperator = errors.New("unsupported operator")
+	InvalidFilterValue  = errors.New("invalid filter value")
+)
+
+type Operator string
+
+const (
+	OpEq       Operator = "eq"
+	OpGt       Operator = "gt"
+	OpGte      Operator = "gte"
+	OpLt       Operator = "lt"
+	OpLte      Operator = "lte"
+	OpIn       Operator = "in"
+	OpContains Operator = "contains"
+)
+
+type FieldKind string
+
+const (
+	KindInteger FieldKind = "integer"
+	KindMoney   FieldKind = "money"
+	KindDate    FieldKind = "date"
+	KindText    FieldKind = "text"
+)
+
+var fieldKinds = map[string]FieldKind{
+	"id":             KindInteger,
+	"referenceMonth": KindInteger,
+	"referenceYear":  KindInteger,
+	"amount":         KindMoney,
+	"createdAt":      KindDate,
+	"document":       KindText,
+	"description":    KindText,
+	"currency":       KindText,
+	"status":         KindText,
+}
+
+var operatorKinds = map[Operator][]FieldKind{
+	OpEq:       {KindInteger, KindMoney, KindDate, KindText},
+	OpIn:       {KindInteger, KindMoney, KindDate, KindText},
+	OpGt:       {KindInteger, KindMoney, KindDate},
+	OpGte:      {KindInteger, KindMoney, KindDate},
+	OpLt:       {KindInteger, KindMoney, KindDate},
+	OpLte:      {KindInteger, KindMoney, KindDate},
+	OpContains: {KindText},
+}
+
+var sqlOperators = map[Operator]string{
+	OpEq:  "=",
+	OpGt:  ">",
+	OpGte: ">=",
+	OpLt:  "<",
+	OpLte: "<=",
+}
+
+// Filter is a node of a filter expression over invoices. The same tree is
+// matched in memory and turned into parameterized SQL.
+type Filter interface {
+	check() error
+	match(i *Invoice) bool
+	writeSQL(b *queryBuilder)
+}
+
+type And []Filter
+
+type Or []Filter
+
+type Not struct {
+	Filter Filter
+}
+
+type Condition struct {
+	Field  string
+	Op     Operator
+	Values []interface{}
+}
+
+func NewCondition(field string, op Operator, values ...string) (*Condition, error) {
+	kind, ok := fieldKinds[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", UnknownField, field)
+	}
+	if !operatorApplies(op, kind) {
+		return nil, fmt.Errorf("%w: %s can't be applied to %s", UnsupportedOperator, op, field)
+	}
+	if len(values) == 0 || (op != OpIn && len(values) > 1) {
+		return nil, fmt.Errorf("%w: %s takes %s", InvalidFilterValue, op, valuesDescription(op))
+	}
+
+	c := &Condition{Field: field, Op: op, Values: make([]interface{}, len(values))}
+	for k, value := range values {
+		v, err := parseFieldValue(kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be %s", InvalidFilterValue, field, kind.Describe())
+		}
+		c.Values[k] = v
+	}
+	return c, nil
+}
+
+func FieldKindOf(field string) (FieldKind, bool) {
+	kind, ok := fieldKinds[field]
+	return kind, ok
+}
+
+func operatorApplies(op Operator, kind FieldKind) bool {
+	for _, k := range operatorKinds[op] {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func valuesDescription(op Operator) string {
+	if op == OpIn {
+		return "one or more values"
+	}
+	return "one value"
+}
+
+func (kind FieldKind) Describe() string {
+	switch kind {
+	case KindInteger:
+		return "an integer"
+	case KindMoney:
+		return "a number with up to two decimals"
+	case KindDate:
+		return "a date (2006-01-02 or RFC 3339)"
+	}
+	return "text"
+}
+
+func parseFieldValue(kind FieldKind, value string) (interface{}, error) {
+	switch kind {
+	case KindInteger:
+		return strconv.Atoi(value)
+	case KindMoney:
+		return ParseMoney(value)
+	case KindDate:
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return t, nil
+		}
+		return time.Parse(time.RFC3339Nano, value)
+	}
+	return value, nil
+}
+
+func (f And) check() error {
+	for _, filter := range f {
+		if err := filter.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f And) match(i *Invoice) bool {
+	for _, filter := range f {
+		if !filter.match(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f And) writeSQL(b *queryBuilder) {
+	if len(f) == 0 {
+		b.Write("1=1")
+		return
+	}
+	b.Write("(")
+	for k, filter := range f {
+		if k > 0 {
+			b.Write(" AND ")
+		}
+		filter.writeSQL(b)
+	}
+	b.Write(")")
+}
+
+func (f Or) check() error {
+	return And(f).check()
+}
+
+func (f Or) match(i *Invoice) bool {
+	for _, filter := range f {
+		if filter.match(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Or) writeSQL(b *queryBuilder) {
+	if len(f) == 0 {
+		b.Write("1=0")
+		return
+	}
+	b.Write("(")
+	for k, filter := range f {
+		if k > 0 {
+			b.Write(" OR ")
+		}
+		filter.writeSQL(b)
+	}
+	b.Write(")")
+}
+
+func (f Not) check() error {
+	if f.Filter == nil {
+		return InvalidFilterValue
+	}
+	return f.Filter.check()
+}
+
+func (f Not) match(i *Invoice) bool {
+	return !f.Filter.match(i)
+}
+
+func (f Not) writeSQL(b *queryBuilder) {
+	b.Write("NOT (")
+	f.Filter.writeSQL(b)
+	b.Write(")")
+}
+
+// check guards against conditions built by hand: only known columns,
+// operators and value types may reach the SQL text.
+func (c *Condition) check() error {
+	kind, ok := fieldKinds[c.Field]
+	if !ok {
+		return fmt.Errorf("%w: %q", UnknownField, c.Field)
+	}
+	if !operatorApplies(c.Op, kind) {
+		return fmt.Errorf("%w: %s", UnsupportedOperator, c.Op)
+	}
+	if len(c.Values) == 0 || (c.Op != OpIn && len(c.Values) > 1) {
+		return InvalidFilterValue
+	}
+	for _, v := range c.Values {
+		if !valueOfKind(v, kind) {
+			return InvalidFilterValue
+		}
+	}
+	return nil
+}
+
+func valueOfKind(v interface{}, kind FieldKind) bool {
+	switch v.(type) {
+	case int:
+		return kind == KindInteger
+	case Money:
+		return kind == KindMoney
+	case time.Time:
+		return kind == KindDate
+	case string:
+		return kind == KindText
+	}
+	return false
+}
+
+func (c *Condition) match(i *Invoice) bool {
+	value := invoiceFieldValue(i, c.Field)
+	switch c.Op {
+	case OpIn:
+		for _, v := range c.Values {
+			if compareValues(value, v) == 0 {
+				return true
+			}
+		}
+		return false
+	case OpContains:
+		return strings.Contains(strings.ToLower(value.(string)), strings.ToLower(c.Values[0].(string)))
+	}
+
+	cmp := compareValues(value, c.Values[0])
+	switch c.Op {
+	case OpGt:
+		return cmp > 0
+	case OpGte:
+		return cmp >= 0
+	case OpLt:
+		return cmp < 0
+	case OpLte:
+		return cmp <= 0
+	}
+	return cmp == 0
+}
+
+func (c *Condition) writeSQL(b *queryBuilder) {
+	column := invoiceColumns[c.Field]
+	switch c.Op {
+	case OpIn:
+		b.Write(column + " IN (")
+		for k, v := range c.Values {
+			if k > 0 {
+				b.Write(", ")
+			}
+			b.Bind(v)
+		}
+		b.Write(")")
+	case OpContains:
+		// LIKE is case-insensitive on some databases only
+		b.Write("LOWER(" + column + ") LIKE ")
+		b.Bind("%" + escapeLike(strings.ToLower(c.Values[0].(string))) + "%")
+		b.Write(" ESCAPE '!'")
+	default:
+		b.Write(column + sqlOperators[c.Op])
+		b.Bind(c.Values[0])
+	}
+}
+
+// escapeLike makes the wildcards of s match literally, with the escape
+// character '!', which unlike '\' means the same to every database.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		return compareInts(a, b.(int))
+	case Money:
+		return compareInts(int(a), int(b.(Money)))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
@@ -0,0 +1,334 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilterDepth bounds the nesting of parentheses and nots, so that an
+// expression can't exhaust the stack of the parser.
+const maxFilterDepth = 32
+
+type FilterSyntaxError struct {
+	Column int
+	Msg    string
+}
+
+func (e *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("%s at column %d", e.Msg, e.Column)
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenNumber
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// filterParser parses the grammar
+//
+//	expr       = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" expr ")" | condition
+//	condition  = field operator literal | field "in" "(" literal { "," literal } ")"
+//	operator   = "eq" | "ne" | "gt" | "gte" | "lt" | "lte" | "contains"
+//	literal    = number | 'string'
+//
+// where dates are strings, as in createdAt gte '2016-01-31', and a quote in a
+// string is written twice. Keywords and operators ignore case, fields don't.
+type filterParser struct {
+	expr   string
+	tokens []token
+	next   int
+	depth  int
+}
+
+func ParseFilter(expr string) (Filter, error) {
+	p := &filterParser{expr: expr}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokenEnd {
+		return nil, p.errorAt(p.peek(), "empty expression")
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.errorAt(t, "expected and, or or the end of the expression, found "+describeToken(t))
+	}
+	return f, nil
+}
+
+func (p *filterParser) errorAt(t token, msg string) error {
+	return &FilterSyntaxError{Column: utf8.RuneCountInString(p.expr[:t.pos]) + 1, Msg: msg}
+}
+
+func (p *filterParser) lex() error {
+	s := p.expr
+	for pos := 0; pos < len(s); {
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		start := pos
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+			continue
+		case r == '(':
+			p.tokens = append(p.tokens, token{tokenLeftParen, "(", start})
+			pos++
+		case r == ')':
+			p.tokens = append(p.tokens, token{tokenRightParen, ")", start})
+			pos++
+		case r == ',':
+			p.tokens = append(p.tokens, token{tokenComma, ",", start})
+			pos++
+		case r == '\'':
+			var text strings.Builder
+			for pos++; ; pos++ {
+				if pos >= len(s) {
+					return p.errorAt(token{pos: start}, "unterminated string")
+				}
+				if s[pos] == '\'' {
+					if pos+1 < len(s) && s[pos+1] == '\'' {
+						pos++
+					} else {
+						break
+					}
+				}
+				text.WriteByte(s[pos])
+			}
+			pos++
+			p.tokens = append(p.tokens, token{tokenString, text.String(), start})
+		case r == '-' || isDigit(r):
+			pos++
+			for pos < len(s) && (isDigit(rune(s[pos])) || s[pos] == '.') {
+				pos++
+			}
+			if s[start:pos] == "-" {
+				return p.errorAt(token{pos: start}, "expected a digit after -")
+			}
+			p.tokens = append(p.tokens, token{tokenNumber, s[start:pos], start})
+		case unicode.IsLetter(r):
+			for pos < len(s) {
+				r, size := utf8.DecodeRuneInString(s[pos:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+					break
+				}
+				pos += size
+			}
+			p.tokens = append(p.tokens, token{tokenWord, s[start:pos], start})
+		default:
+			return p.errorAt(token{pos: start}, fmt.Sprintf("unexpected character %q", r))
+		}
+	}
+	p.tokens = append(p.tokens, token{tokenEnd, "", len(s)})
+	return nil
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) advance() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next++
+	}
+	return t
+}
+
+func (p *filterParser) keyword(keyword string) bool {
+	if t := p.peek(); t.kind == tokenWord && strings.EqualFold(t.text, keyword) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(kind tokenKind, what string) error {
+	if t := p.advance(); t.kind != kind {
+		return p.errorAt(t, "expected "+what+", found "+describeToken(t))
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := Or{f}
+	for p.keyword("or") {
+		if f, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		or = append(or, f)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	f, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := And{f}
+	for p.keyword("and") {
+		if f, err = p.parseUnary(); err != nil {
+			return nil, err
+		}
+		and = append(and, f)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *filterParser) parseUnary() (Filter, error) {
+	t := p.peek()
+	if t.kind != tokenLeftParen && !(t.kind == tokenWord && strings.EqualFold(t.text, "not")) {
+		return p.parseCondition()
+	}
+
+	if p.depth++; p.depth > maxFilterDepth {
+		return nil, p.errorAt(t, "expression nested too deeply")
+	}
+	defer func() { p.depth-- }()
+
+	p.advance()
+	if t.kind != tokenLeftParen {
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{f}, nil
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(tokenRightParen, ")"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *filterParser) parseCondition() (Filter, error) {
+	t := p.advance()
+	if t.kind != tokenWord {
+		return nil, p.errorAt(t, "expected a field, found "+describeToken(t))
+	}
+	field := t.text
+	kind, ok := fieldKinds[field]
+	if !ok {
+		return nil, p.errorAt(t, fmt.Sprintf("unknown field %q", field))
+	}
+
+	t = p.advance()
+	if t.kind != tokenWord {
+		return nil, p.errorAt(t, "expected an operator after "+field+", found "+describeToken(t))
+	}
+	op, negate := Operator(strings.ToLower(t.text)), false
+	if op == "ne" {
+		op, negate = OpEq, true
+	}
+	if _, ok := operatorKinds[op]; !ok {
+		return nil, p.errorAt(t, fmt.Sprintf("unknown operator %q", t.text))
+	}
+	if !operatorApplies(op, kind) {
+		return nil, p.errorAt(t, fmt.Sprintf("operator %s can't be applied to %s", op, field))
+	}
+
+	c := &Condition{Field: field, Op: op}
+	if op == OpIn {
+		if err := p.expect(tokenLeftParen, "( after in"); err != nil {
+			return nil, err
+		}
+		for {
+			v, err := p.parseLiteral(field, kind)
+			if err != nil {
+				return nil, err
+			}
+			c.Values = append(c.Values, v)
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.advance()
+		}
+		if err := p.expect(tokenRightParen, ", or )"); err != nil {
+			return nil, err
+		}
+	} else {
+		v, err := p.parseLiteral(field, kind)
+		if err != nil {
+			return nil, err
+		}
+		c.Values = []interface{}{v}
+	}
+
+	if negate {
+		return Not{c}, nil
+	}
+	return c, nil
+}
+
+func (p *filterParser) parseLiteral(field string, kind FieldKind) (interface{}, error) {
+	t := p.advance()
+	wanted := tokenString
+	if kind == KindInteger || kind == KindMoney {
+		wanted = tokenNumber
+	}
+	if t.kind == wanted {
+		if v, err := parseFieldValue(kind, t.text); err == nil {
+			return v, nil
+		}
+	}
+	return nil, p.errorAt(t, fmt.Sprintf("%s must be compared with %s, found %s", field, literalDescription(kind), describeToken(t)))
+}
+
+func literalDescription(kind FieldKind) string {
+	switch kind {
+	case KindDate:
+		return "a quoted date, as in '2016-01-31'"
+	case KindText:
+		return "a quoted string"
+	}
+	return kind.Describe()
+}
+
+func describeToken(t token) string {
+	switch t.kind {
+	case tokenEnd:
+		return "the end of the expression"
+	case tokenString:
+		return "'" + strings.ReplaceAll(t.text, "'", "''") + "'"
+	case tokenNumber:
+		if _, err := strconv.ParseFloat(t.text, 64); err != nil {
+			return "malformed number " + t.text
+		}
+	}
+	return t.text
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	FXRateDateFormat  = "2006-01-02"
+	rateDecimals      = 8
+	rateIntegerDigits = 10
+	rateScale         = 100000000
+)
+
+var (
+	InvalidFXRate  = errors.New("invalid exchange rate")
+	FXRateNotFound = errors.New("exchange rate not found")
+)
+
+var fxRatesCSVHeader = []string{"date", "from", "to", "rate"}
+
+type Rate int64
+
+var rateFormat = fixedPoint{decimals: rateDecimals, integerDigits: rateIntegerDigits, min: 1, max: math.MaxInt64, trimZeros: true,
+	kind: InvalidFXRate, rule: "rate must be a positive number with up to eight decimals"}
+
+func ParseRate(s string) (Rate, error) {
+	units, err := rateFormat.parse(s)
+	return Rate(units), err
+}
+
+func (r Rate) String() string {
+	return rateFormat.format(int64(r))
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	units, err := rateFormat.unmarshalJSON(b)
+	*r = Rate(units)
+	return err
+}
+
+func (r *Rate) Scan(value interface{}) error {
+	units, err := rateFormat.scan(value)
+	*r = Rate(units)
+	return err
+}
+
+func (r Rate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+type FXRate struct {
+	Date string `json:"date"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate Rate   `json:"rate"`
+}
+
+func (r *FXRate) Check() error {
+	if _, err := time.Parse(FXRateDateFormat, r.Date); err != nil {
+		return fmt.Errorf("%w: date must look like %s", InvalidFXRate, FXRateDateFormat)
+	}
+	for _, code := range []string{r.From, r.To} {
+		if CheckCurrency(code) != nil {
+			return fmt.Errorf("%w: %w %q", InvalidFXRate, UnknownCurrency, code)
+		}
+	}
+	if r.From == r.To {
+		return fmt.Errorf("%w: from and to must be different currencies", InvalidFXRate)
+	}
+	if r.Rate <= 0 {
+		return fmt.Errorf("%w: rate must be positive", InvalidFXRate)
+	}
+	return nil
+}
+
+// FXRateStore keeps exchange rates, which are shared by every tenant.
+type FXRateStore interface {
+	UpsertFXRates(rates []FXRate) error
+	FindFXRate(from string, to string, date string) (*FXRate, error)
+}
+
+func ReadFXRatesCSV(r io.Reader) (rates []FXRate, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(fxRatesCSVHeader)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil || strings.Join(header, ",") != strings.Join(fxRatesCSVHeader, ",") {
+		return nil, fmt.Errorf("%w: the first line must be %s", InvalidFXRate, strings.Join(fxRatesCSVHeader, ","))
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rates, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rate := FXRate{Date: record[0], From: record[1], To: record[2]}
+		if rate.Rate, err = ParseRate(record[3]); err == nil {
+			err = rate.Check()
+		}
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rates = append(rates, rate)
+	}
+}
+
+// Converter converts amounts into one currency at the rates of a store, as
+// of the dates of the amounts. It remembers the rates it looks up, so it is
+// meant to serve a single request.
+type Converter struct {
+	store FXRateStore
+	to    string
+	rates map[string]conversion
+}
+
+type conversion struct {
+	num, den int64
+}
+
+type MissingFXRateError struct {
+	From, To, Date string
+}
+
+func (e *MissingFXRateError) Error() string {
+	return fmt.Sprintf("%v: no rate from %s to %s on or before %s", FXRateNotFound, e.From, e.To, e.Date)
+}
+
+func NewConverter(store FXRateStore, currency string) *Converter {
+	return &Converter{store: store, to: currency, rates: map[string]conversion{}}
+}
+
+func (c *Converter) Convert(amount Money, from string, at time.Time) (Money, error) {
+	if from == c.to {
+		return amount, nil
+	}
+	date := at.UTC().Format(FXRateDateFormat)
+	rate, ok := c.rates[from+" "+date]
+	if !ok {
+		var err error
+		if rate, err = c.findConversion(from, date); err != nil {
+			return 0, err
+		}
+		c.rates[from+" "+date] = rate
+	}
+	return convertMoney(amount, rate, c.to)
+}
+
+func (c *Converter) findConversion(from string, date string) (conversion, error) {
+	direct, err := c.store.FindFXRate(from, c.to, date)
+	if err != nil && err != FXRateNotFound {
+		return conversion{}, err
+	}
+	inverse, err := c.store.FindFXRate(c.to, from, date)
+	if err != nil && err != FXRateNotFound {
+		return conversion{}, err
+	}
+	switch {
+	case direct != nil && (inverse == nil || direct.Date >= inverse.Date):
+		return conversion{int64(direct.Rate), rateScale}, nil
+	case inverse != nil:
+		return conversion{rateScale, int64(inverse.Rate)}, nil
+	}
+	return conversion{}, &MissingFXRateError{From: from, To: c.to, Date: date}
+}
+
+func convertMoney(amount Money, rate conversion, currency string) (Money, error) {
+	n := new(big.Int).Mul(big.NewInt(int64(amount)), big.NewInt(rate.num))
+	return divideMoney(n, big.NewInt(rate.den), currency, RoundHalfUp)
+}
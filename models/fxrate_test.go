@@ -0,0 +1,118 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	var cases = []struct {
+		value    string
+		expected Rate
+		valid    bool
+	}{
+		{"1", 100000000, true},
+		{"4.0042", 400420000, true},
+		{"0.00000001", 1, true},
+		{"9999999999.99999999", 999999999999999999, true},
+		{"0.000000001", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"10000000000", 0, false},
+		{"1e3", 0, false},
+	}
+	for _, c := range cases {
+		r, err := ParseRate(c.value)
+		if r != c.expected || (err == nil) != c.valid {
+			t.Errorf("%q: rate should have been %v (valid: %v), but was %v (%v) instead.", c.value, c.expected, c.valid, r, err)
+		}
+		if c.valid && r.String() != c.value {
+			t.Errorf("%q: string should have been %q, but was %q instead.", c.value, c.value, r.String())
+		}
+	}
+}
+
+func TestReadFXRatesCSV(t *testing.T) {
+	rates, err := ReadFXRatesCSV(strings.NewReader("date,from,to,rate\n2016-01-31,USD,BRL,4.0042\n2016-01-31, EUR, BRL, 4.35\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 2 || rates[0] != (FXRate{"2016-01-31", "USD", "BRL", 400420000}) || rates[1] != (FXRate{"2016-01-31", "EUR", "BRL", 435000000}) {
+		t.Errorf("rates should have been read, but were %+v instead.", rates)
+	}
+
+	var errors = []struct {
+		csv string
+		err string
+	}{
+		{"", "invalid exchange rate: the first line must be date,from,to,rate"},
+		{"from,to,date,rate\n", "invalid exchange rate: the first line must be date,from,to,rate"},
+		{"date,from,to,rate\n2016-01-31,USD,BRL,4\n2016-31-01,USD,BRL,4\n", "line 3: invalid exchange rate: date must look like 2006-01-02"},
+		{"date,from,to,rate\n2016-01-31,USD,XYZ,4\n", `line 2: invalid exchange rate: unknown currency "XYZ"`},
+		{"date,from,to,rate\n2016-01-31,USD,USD,4\n", "line 2: invalid exchange rate: from and to must be different currencies"},
+		{"date,from,to,rate\n2016-01-31,USD,BRL,four\n", "line 2: invalid exchange rate: rate must be a positive number with up to eight decimals"},
+		{"date,from,to,rate\n2016-01-31,USD,BRL\n", "record on line 2: wrong number of fields"},
+	}
+	for _, c := range errors {
+		if _, err := ReadFXRatesCSV(strings.NewReader(c.csv)); err == nil || err.Error() != c.err {
+			t.Errorf("%q: error should have been %q, but was %v instead.", c.csv, c.err, err)
+		}
+	}
+}
+
+func TestConverter(t *testing.T) {
+	repo := NewMemoryRepo()
+	err := repo.UpsertFXRates([]FXRate{
+		{Date: "2016-01-01", From: "USD", To: "BRL", Rate: 400000000},
+		{Date: "2016-02-01", From: "BRL", To: "USD", Rate: 20000000},
+		{Date: "2016-01-01", From: "JPY", To: "BRL", Rate: 3333333},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jan := time.Date(2016, 1, 15, 12, 0, 0, 0, time.UTC)
+	feb := time.Date(2016, 2, 15, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		to       string
+		amount   Money
+		from     string
+		at       time.Time
+		expected string
+	}{
+		{"BRL", 1050, "BRL", jan, "10.50"},
+		{"BRL", 1050, "USD", jan, "42.00"},
+		{"BRL", -1050, "USD", jan, "-42.00"},
+		// the inverse of the later BRL rate wins over the USD one
+		{"BRL", 1050, "USD", feb, "52.50"},
+		{"USD", 4200, "BRL", jan, "10.50"},
+		{"USD", 1000, "BRL", feb, "2.00"},
+		{"BRL", 100, "JPY", jan, "0.03"},
+		{"BRL", 1500, "JPY", jan, "0.50"},
+		// rounded half away from zero to whole yen
+		{"JPY", 150, "BRL", jan, "45.00"},
+		{"JPY", 5, "BRL", jan, "2.00"},
+		{"JPY", -5, "BRL", jan, "-2.00"},
+		// a day starts at midnight UTC
+		{"BRL", 100, "USD", time.Date(2016, 1, 1, 0, 30, 0, 0, time.FixedZone("BRT", -3*3600)), "4.00"},
+		{"BRL", 100, "USD", time.Date(2015, 12, 31, 20, 0, 0, 0, time.FixedZone("BRT", -3*3600)), "no rate"},
+		{"EUR", 100, "BRL", jan, "no rate"},
+	}
+	for _, c := range cases {
+		converted, err := NewConverter(repo, c.to).Convert(c.amount, c.from, c.at)
+		actual := converted.String()
+		if _, missing := err.(*MissingFXRateError); missing {
+			actual = "no rate"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if actual != c.expected {
+			t.Errorf("%v %v to %v: amount should have been %v, but was %v instead.", c.amount, c.from, c.to, c.expected, actual)
+		}
+	}
+
+	if _, err = NewConverter(repo, "BRL").Convert(MaxMoney, "USD", jan); err != MoneyOutOfRange {
+		t.Errorf("error should have been %v, but was %v instead.", MoneyOutOfRange, err)
+	}
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims key for a request with the given
+	// fingerprint. It returns nil when the key was free (or only held by a
+	// record created before expiredBefore) and is now reserved; otherwise
+	// it returns the record holding the key, which is still pending when
+	// its StatusCode is 0.
+	ReserveIdempotencyKey(key string, fingerprint string, expiredBefore time.Time) (*IdempotentResponse, error)
+	CompleteIdempotencyKey(response IdempotentResponse) error
+	// ReleaseIdempotencyKey forgets a reserved key that was not completed,
+	// so that a request that failed may be retried with it.
+	ReleaseIdempotencyKey(key string) error
+}
+
+var (
+	IdempotencyKeyNotReserved = errors.New("idempotency key is not reserved")
+)
+
+type IdempotentResponse struct {
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Location    string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+func (r *IdempotentResponse) Pending() bool {
+	return r.StatusCode == 0
+}
@@ -1,36 +1,185 @@
 package models
 
 import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
 	"time"
-
-	"github.com/go-sql-driver/mysql"
 )
 
 const (
 	DOCUMENT_MAX_LENGTH = 14
+	TENANT_MAX_LENGTH   = 64
+	// ids stay below 2^53 so that they are exact as JSON numbers
+	maxInvoiceId = 1 << 53
 )
 
 type Invoice struct {
-	Id             int            `json:"id"`
-	CreatedAt      time.Time      `json:"createdAt"`
-	ReferenceMonth int            `json:"referenceMonth"`
-	ReferenceYear  int            `json:"referenceYear"`
-	Document       string         `json:"document"`
-	Description    string         `json:"description"`
-	Amount         float64        `json:"amount"`
-	IsActive       bool           `json:"isActive"`
-	DeactiveAt     mysql.NullTime `json:"deactiveAt"`
+	Id             int           `json:"id"`
+	TenantId       string        `json:"-"`
+	CreatedAt      time.Time     `json:"createdAt"`
+	ReferenceMonth int           `json:"referenceMonth"`
+	ReferenceYear  int           `json:"referenceYear"`
+	Document       string        `json:"document"`
+	Description    string        `json:"description"`
+	Amount         Money         `json:"amount"`
+	AmountPaid     Money         `json:"amountPaid"`
+	Currency       string        `json:"currency"`
+	Status         InvoiceStatus `json:"status"`
+	IsActive       bool          `json:"isActive"`
+	DeactiveAt     NullTime      `json:"deactiveAt"`
+	Version        int           `json:"version"`
+	UpdatedAt      time.Time     `json:"updatedAt"`
 }
 
 func (i1 *Invoice) Equals(i2 *Invoice) bool {
 	return i1.Id == i2.Id &&
+		i1.TenantId == i2.TenantId &&
 		i1.CreatedAt == i2.CreatedAt &&
 		i1.ReferenceMonth == i2.ReferenceMonth &&
 		i1.ReferenceYear == i2.ReferenceYear &&
 		i1.Document == i2.Document &&
 		i1.Description == i2.Description &&
 		i1.Amount == i2.Amount &&
+		i1.AmountPaid == i2.AmountPaid &&
+		i1.Currency == i2.Currency &&
+		i1.Status == i2.Status &&
 		i1.IsActive == i2.IsActive &&
 		i1.DeactiveAt.Valid == i2.DeactiveAt.Valid &&
-		!(i1.DeactiveAt.Valid && (i1.DeactiveAt.Time != i2.DeactiveAt.Time))
+		!(i1.DeactiveAt.Valid && (i1.DeactiveAt.Time != i2.DeactiveAt.Time)) &&
+		i1.Version == i2.Version &&
+		i1.UpdatedAt.Equal(i2.UpdatedAt)
+}
+
+// NewInvoiceId draws a random invoice id, so that ids tell nothing about the
+// invoices of other tenants and can't be guessed from one another.
+func NewInvoiceId() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxInvoiceId-1))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + 1, nil
+}
+
+// drawInvoiceId is NewInvoiceId, except in tests that make ids collide.
+var drawInvoiceId = NewInvoiceId
+
+type InvoiceFields map[string]interface{}
+
+var MutableInvoiceFields = []string{"document", "description", "amount", "currency"}
+
+func (f InvoiceFields) Check() error {
+	for field, value := range f {
+		var ok bool
+		switch field {
+		case "document", "description":
+			_, ok = value.(string)
+		case "amount":
+			var amount Money
+			if amount, ok = value.(Money); ok && amount.Check() != nil {
+				return amount.Check()
+			}
+		case "currency":
+			var currency string
+			if currency, ok = value.(string); ok && CheckCurrency(currency) != nil {
+				return fmt.Errorf("%w: %q", UnknownCurrency, currency)
+			}
+		default:
+			return fmt.Errorf("%w: %q is not mutable", UnknownField, field)
+		}
+		if !ok {
+			return fmt.Errorf("invalid value %v for field %q", value, field)
+		}
+	}
+	if currency, ok := f["currency"]; ok {
+		return f.checkAmountIn(currency.(string))
+	}
+	return nil
+}
+
+func (f InvoiceFields) CheckFor(i *Invoice) error {
+	if err := i.checkDraft(); err != nil {
+		return err
+	}
+	if _, ok := f["currency"]; ok {
+		return nil
+	}
+	return f.checkAmountIn(i.Currency)
+}
+
+func (f InvoiceFields) checkAmountIn(currency string) error {
+	if amount, ok := f["amount"]; ok {
+		return CheckAmount(currency, amount.(Money))
+	}
+	return nil
+}
+
+func (i *Invoice) Set(fields InvoiceFields) {
+	for field, value := range fields {
+		switch field {
+		case "document":
+			i.Document = value.(string)
+		case "description":
+			i.Description = value.(string)
+		case "amount":
+			i.Amount = value.(Money)
+		case "currency":
+			i.Currency = value.(string)
+		}
+	}
+}
+
+type invoiceJSONField struct {
+	name   string
+	column string
+	index  int
+}
+
+var invoiceJSONFields = func() (fields []invoiceJSONField) {
+	t := reflect.TypeOf(Invoice{})
+	for k := 0; k < t.NumField(); k++ {
+		name := strings.Split(t.Field(k).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields = append(fields, invoiceJSONField{name: name, column: t.Field(k).Name, index: k})
+		}
+	}
+	return
+}()
+
+func findInvoiceJSONField(name string) (invoiceJSONField, bool) {
+	for _, f := range invoiceJSONFields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return invoiceJSONField{}, false
+}
+
+func InvoiceJSONFields() []string {
+	names := make([]string, len(invoiceJSONFields))
+	for k, f := range invoiceJSONFields {
+		names[k] = f.name
+	}
+	return names
+}
+
+func CheckProjection(fields []string) error {
+	for _, field := range fields {
+		if _, ok := findInvoiceJSONField(field); !ok {
+			return fmt.Errorf("%w: %q", UnknownField, field)
+		}
+	}
+	return nil
+}
+
+func (i *Invoice) Project(fields []string) map[string]interface{} {
+	v := reflect.ValueOf(i).Elem()
+	projection := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		f, _ := findInvoiceJSONField(field)
+		projection[field] = v.Field(f.index).Interface()
+	}
+	return projection
 }
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	DESCRIPTION_MAX_LENGTH = 256
+	MAX_QUANTITY           = 1000000
+)
+
+var (
+	InvalidLineItem  = errors.New("invalid line item")
+	AmountIsComputed = errors.New("amount is the total of several line items")
+)
+
+type LineItem struct {
+	Id          int    `json:"id"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   Money  `json:"unitPrice"`
+	Discount    Money  `json:"discount"`
+	Total       Money  `json:"total"`
+}
+
+func (l *LineItem) gross() (Money, error) {
+	if l.UnitPrice != 0 && MaxMoney/abs(l.UnitPrice) < Money(l.Quantity) {
+		return 0, MoneyOutOfRange
+	}
+	return Money(l.Quantity) * l.UnitPrice, nil
+}
+
+func abs(m Money) Money {
+	if m < 0 {
+		return -m
+	}
+	return m
+}
+
+func (l *LineItem) Check(currency string) error {
+	if utf8.RuneCountInString(l.Description) > DESCRIPTION_MAX_LENGTH {
+		return fmt.Errorf("%w: description cannot have more than %d characters", InvalidLineItem, DESCRIPTION_MAX_LENGTH)
+	}
+	if l.Quantity < 1 || l.Quantity > MAX_QUANTITY {
+		return fmt.Errorf("%w: quantity must be between 1 and %d", InvalidLineItem, MAX_QUANTITY)
+	}
+	for _, price := range []struct {
+		name  string
+		value Money
+	}{{"unitPrice", l.UnitPrice}, {"discount", l.Discount}} {
+		switch CheckAmount(currency, price.value) {
+		case nil:
+		case AmountTooPrecise:
+			return fmt.Errorf("%w: %s cannot have more than %d decimals in %s", InvalidLineItem, price.name, MinorUnits(currency), currency)
+		default:
+			return fmt.Errorf("%w: %s must be between -%v and %v", InvalidLineItem, price.name, MaxMoney, MaxMoney)
+		}
+	}
+	gross, err := l.gross()
+	if err != nil {
+		return fmt.Errorf("%w: quantity times unitPrice must be between -%v and %v", InvalidLineItem, MaxMoney, MaxMoney)
+	}
+	if l.Discount < 0 || (l.Discount > gross && l.Discount != 0) {
+		return fmt.Errorf("%w: discount must be between 0 and quantity times unitPrice", InvalidLineItem)
+	}
+	l.Total = gross - l.Discount
+	return nil
+}
+
+type LineItemsError struct {
+	Index int
+	Err   error
+}
+
+func (e *LineItemsError) Error() string {
+	if e.Index < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func checkLineItems(currency string, items []LineItem) (total Money, err error) {
+	for k := range items {
+		if err = items[k].Check(currency); err != nil {
+			return 0, &LineItemsError{Index: k, Err: err}
+		}
+		total += items[k].Total
+		if total.Check() != nil {
+			return 0, &LineItemsError{Index: -1, Err: fmt.Errorf("%w: the items must add up to between -%v and %v", InvalidLineItem, MaxMoney, MaxMoney)}
+		}
+	}
+	return total, nil
+}
+
+func numberLineItems(items []LineItem) {
+	last := 0
+	for _, item := range items {
+		if item.Id > last {
+			last = item.Id
+		}
+	}
+	for k := range items {
+		if items[k].Id == 0 {
+			last++
+			items[k].Id = last
+		}
+	}
+}
+
+func FindLineItem(items []LineItem, id int) int {
+	for k, item := range items {
+		if item.Id == id {
+			return k
+		}
+	}
+	return -1
+}
+
+func singleLineItem(i *Invoice) LineItem {
+	return LineItem{Id: 1, Description: i.Description, Quantity: 1, UnitPrice: i.Amount, Total: i.Amount}
+}
+
+// lineItemsFor returns the items of i once fields, which must have passed
+// Check and CheckFor, are set in it, and whether they changed. Setting an
+// amount other than the total is only allowed while i has at most one item,
+// which is replaced by an item of that amount, so that invoices that are
+// only an amount keep working as before. Changing the currency requires
+// every item to fit the new one.
+func (f InvoiceFields) lineItemsFor(i *Invoice, items []LineItem) (updated []LineItem, changed bool, err error) {
+	if amount, ok := f["amount"]; ok && amount.(Money) != i.Amount {
+		if len(items) > 1 {
+			return nil, false, AmountIsComputed
+		}
+		replaced := *i
+		replaced.Set(f)
+		item := singleLineItem(&replaced)
+		if len(items) == 1 {
+			item.Id, item.Description = items[0].Id, items[0].Description
+		}
+		items, changed = []LineItem{item}, true
+	}
+	currency := i.Currency
+	if value, ok := f["currency"]; ok {
+		currency = value.(string)
+	}
+	if _, err = checkLineItems(currency, items); err != nil {
+		return nil, false, err
+	}
+	return items, changed, nil
+}
+
+// LineItemStore keeps the line items of invoices. The amount of an invoice
+// is always the total of its items: stores update it along with them.
+type LineItemStore interface {
+	GetLineItems(tenant string, invoiceId int) (*Invoice, []LineItem, error)
+	ModifyLineItems(tenant string, invoiceId int, version int, modify func(*Invoice, []LineItem) ([]LineItem, error)) ([]LineItem, error)
+}
@@ -0,0 +1,637 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MemoryRepo struct {
+	mu          sync.RWMutex
+	invoices    []*Invoice
+	idempotency map[string]*IdempotentResponse
+	apiKeys     []*APIKey
+	fxRates     map[string]FXRate
+	lineItems   map[int][]LineItem
+	taxEngine   TaxEngine
+	taxes       map[int][]Tax
+}
+
+func NewMemoryRepo() *MemoryRepo {
+	return &MemoryRepo{idempotency: map[string]*IdempotentResponse{}, fxRates: map[string]FXRate{}, lineItems: map[int][]LineItem{}, taxes: map[int][]Tax{}}
+}
+
+func (r *MemoryRepo) GetInvoiceById(tenant string, id int) (*Invoice, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	invoice := r.findActive(tenant, id)
+	if invoice == nil {
+		return nil, InvoiceNotFound
+	}
+	clone := *invoice
+	return &clone, nil
+}
+
+func (r *MemoryRepo) UpdateInvoice(tenant string, id int, version int, fields InvoiceFields) (nRows int64, err error) {
+	if len(fields) == 0 {
+		return 0, NoFieldsToUpdate
+	}
+	if err = fields.Check(); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice := r.findActive(tenant, id)
+	if invoice == nil {
+		return 0, nil
+	}
+	if version != 0 && invoice.Version != version {
+		return 0, VersionConflict
+	}
+	if err = fields.CheckFor(invoice); err != nil {
+		return 0, err
+	}
+	if err = r.setLineItems(invoice, fields); err != nil {
+		return 0, err
+	}
+	invoice.Set(fields)
+	touch(invoice)
+	return 1, nil
+}
+
+func (r *MemoryRepo) ModifyInvoice(tenant string, id int, version int, modify func(*Invoice) (InvoiceFields, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice := r.findActive(tenant, id)
+	if invoice == nil {
+		return InvoiceNotFound
+	}
+	if version != 0 && invoice.Version != version {
+		return VersionConflict
+	}
+	clone := *invoice
+	fields, err := modify(&clone)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	if err = fields.Check(); err != nil {
+		return err
+	}
+	if err = fields.CheckFor(invoice); err != nil {
+		return err
+	}
+	if err = r.setLineItems(invoice, fields); err != nil {
+		return err
+	}
+	invoice.Set(fields)
+	touch(invoice)
+	return nil
+}
+
+func (r *MemoryRepo) DeleteInvoice(tenant string, id int, version int) (nRows int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice := r.findActive(tenant, id)
+	if invoice == nil {
+		return 0, nil
+	}
+	if version != 0 && invoice.Version != version {
+		return 0, VersionConflict
+	}
+	if err = invoice.checkDraft(); err != nil {
+		return 0, err
+	}
+	touch(invoice)
+	invoice.IsActive = false
+	invoice.DeactiveAt.Time = invoice.UpdatedAt
+	invoice.DeactiveAt.Valid = true
+	return 1, nil
+}
+
+func (r *MemoryRepo) setLineItems(invoice *Invoice, fields InvoiceFields) error {
+	items, changed, err := fields.lineItemsFor(invoice, r.lineItems[invoice.Id])
+	if _, currency := fields["currency"]; err != nil || !changed && !currency {
+		return err
+	}
+	updated := *invoice
+	updated.Set(fields)
+	taxes, err := computeTaxes(r.taxEngine, &updated, items)
+	if err != nil {
+		return err
+	}
+	r.lineItems[invoice.Id], r.taxes[invoice.Id] = items, taxes
+	return nil
+}
+
+func (r *MemoryRepo) GetLineItems(tenant string, invoiceId int) (*Invoice, []LineItem, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	invoice := r.findActive(tenant, invoiceId)
+	if invoice == nil {
+		return nil, nil, InvoiceNotFound
+	}
+	clone := *invoice
+	return &clone, append([]LineItem{}, r.lineItems[invoiceId]...), nil
+}
+
+func (r *MemoryRepo) ModifyLineItems(tenant string, invoiceId int, version int, modify func(*Invoice, []LineItem) ([]LineItem, error)) ([]LineItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice := r.findActive(tenant, invoiceId)
+	if invoice == nil {
+		return nil, InvoiceNotFound
+	}
+	if version != 0 && invoice.Version != version {
+		return nil, VersionConflict
+	}
+	if err := invoice.checkDraft(); err != nil {
+		return nil, err
+	}
+	clone := *invoice
+	items, err := modify(&clone, append([]LineItem{}, r.lineItems[invoiceId]...))
+	if err != nil {
+		return nil, err
+	}
+	numberLineItems(items)
+	updated := *invoice
+	if updated.Amount, err = checkLineItems(invoice.Currency, items); err != nil {
+		return nil, err
+	}
+	taxes, err := computeTaxes(r.taxEngine, &updated, items)
+	if err != nil {
+		return nil, err
+	}
+	r.lineItems[invoiceId], r.taxes[invoiceId] = items, taxes
+	invoice.Amount = updated.Amount
+	touch(invoice)
+	return append([]LineItem{}, items...), nil
+}
+
+func (r *MemoryRepo) SetTaxEngine(engine TaxEngine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.taxEngine = engine
+}
+
+func (r *MemoryRepo) GetInvoiceTaxes(tenant string, id int) (*Invoice, []Tax, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	invoice := r.findActive(tenant, id)
+	if invoice == nil {
+		return nil, nil, InvoiceNotFound
+	}
+	clone := *invoice
+	return &clone, append([]Tax{}, r.taxes[id]...), nil
+}
+
+func (r *MemoryRepo) TransitionInvoice(tenant string, id int, version int, event InvoiceEvent, payment Money) (*Invoice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice := r.findActive(tenant, id)
+	if invoice == nil {
+		return nil, InvoiceNotFound
+	}
+	if version != 0 && invoice.Version != version {
+		return nil, VersionConflict
+	}
+	clone := *invoice
+	if err := clone.Apply(event, payment); err != nil {
+		return nil, err
+	}
+	invoice.Status, invoice.AmountPaid = clone.Status, clone.AmountPaid
+	touch(invoice)
+	clone = *invoice
+	return &clone, nil
+}
+
+func touch(invoice *Invoice) {
+	invoice.Version++
+	invoice.UpdatedAt = time.Now()
+}
+
+func (r *MemoryRepo) InsertInvoice(i Invoice) (id int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i.Id != 0 && r.find(i.Id) != nil {
+		return 0, InvoiceIdTaken
+	}
+	for i.Id == 0 || r.find(i.Id) != nil {
+		if i.Id, err = drawInvoiceId(); err != nil {
+			return
+		}
+	}
+	if i.Currency == "" {
+		i.Currency = DefaultCurrency
+	}
+	if i.Status == "" {
+		i.Status = StatusDraft
+	}
+	i.DeactiveAt.Valid = false
+	i.Version = 1
+	i.UpdatedAt = i.CreatedAt
+	items := []LineItem{singleLineItem(&i)}
+	taxes, err := computeTaxes(r.taxEngine, &i, items)
+	if err != nil {
+		return 0, err
+	}
+	r.lineItems[i.Id], r.taxes[i.Id] = items, taxes
+
+	// keep invoices in id order, like the primary key of the SQL table
+	k := sort.Search(len(r.invoices), func(k int) bool { return r.invoices[k].Id > i.Id })
+	r.invoices = append(r.invoices, nil)
+	copy(r.invoices[k+1:], r.invoices[k:])
+	r.invoices[k] = &i
+	return int64(i.Id), nil
+}
+
+func (r *MemoryRepo) CountInvoices(tenant string, opts *QueryOptions) (count int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	matches, err := r.filter(tenant, opts)
+	return len(matches), err
+}
+
+func (r *MemoryRepo) GetInvoices(tenant string, opts *QueryOptions) (invoices []*Invoice, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if err = CheckProjection(opts.Fields); err != nil {
+		return nil, err
+	}
+	matches, err := r.filter(tenant, opts)
+	if err != nil {
+		return nil, err
+	}
+	keys := orderKeys(opts.Sorts)
+	if err = sortInvoices(matches, keys); err != nil {
+		return nil, err
+	}
+	if opts.Cursor != nil {
+		return keysetPage(matches, keys, opts)
+	}
+
+	start := (opts.Pagination.Page - 1) * opts.Pagination.PerPage
+	end := start + opts.Pagination.PerPage
+	if end > len(matches) {
+		end = len(matches)
+	}
+	if start < 0 || start > end {
+		start = end
+	}
+	for _, invoice := range matches[start:end] {
+		clone := *invoice
+		invoices = append(invoices, &clone)
+	}
+	return invoices, nil
+}
+
+func (r *MemoryRepo) AggregateInvoices(tenant string, opts *AggregateOptions) (groups []*Group, count int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if err = opts.check(); err != nil {
+		return nil, 0, err
+	}
+	matches, err := r.filter(tenant, &opts.QueryOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	if groups, err = aggregateInvoices(matches, opts); err != nil {
+		return nil, 0, err
+	}
+
+	start := (opts.Pagination.Page - 1) * opts.Pagination.PerPage
+	end := start + opts.Pagination.PerPage
+	if end > len(groups) {
+		end = len(groups)
+	}
+	if start < 0 || start > end {
+		start = end
+	}
+	return groups[start:end], len(groups), nil
+}
+
+func (r *MemoryRepo) ReserveIdempotencyKey(key string, fingerprint string, expiredBefore time.Time) (*IdempotentResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, response := range r.idempotency {
+		if response.CreatedAt.Before(expiredBefore) {
+			delete(r.idempotency, k)
+		}
+	}
+	if response, ok := r.idempotency[key]; ok {
+		clone := *response
+		return &clone, nil
+	}
+	r.idempotency[key] = &IdempotentResponse{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now()}
+	return nil, nil
+}
+
+func (r *MemoryRepo) CompleteIdempotencyKey(response IdempotentResponse) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reserved, ok := r.idempotency[response.Key]
+	if !ok {
+		return IdempotencyKeyNotReserved
+	}
+	reserved.StatusCode, reserved.Location = response.StatusCode, response.Location
+	reserved.Body = append([]byte(nil), response.Body...)
+	return nil
+}
+
+func (r *MemoryRepo) ReleaseIdempotencyKey(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if response, ok := r.idempotency[key]; ok && response.Pending() {
+		delete(r.idempotency, key)
+	}
+	return nil
+}
+
+func cloneAPIKey(k *APIKey) *APIKey {
+	clone := *k
+	clone.Scopes = append([]string{}, k.Scopes...)
+	return &clone
+}
+
+func (r *MemoryRepo) InsertAPIKey(k APIKey) (id int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k.Id = len(r.apiKeys) + 1
+	r.apiKeys = append(r.apiKeys, cloneAPIKey(&k))
+	return int64(k.Id), nil
+}
+
+func (r *MemoryRepo) GetAPIKeys(tenant string) ([]*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := []*APIKey{}
+	for _, k := range r.apiKeys {
+		if k.TenantId == tenant {
+			keys = append(keys, cloneAPIKey(k))
+		}
+	}
+	return keys, nil
+}
+
+func (r *MemoryRepo) GetAPIKeyById(tenant string, id int) (*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k := r.findAPIKey(id)
+	if k == nil || k.TenantId != tenant {
+		return nil, APIKeyNotFound
+	}
+	return cloneAPIKey(k), nil
+}
+
+func (r *MemoryRepo) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, k := range r.apiKeys {
+		if k.Hash == hash {
+			return cloneAPIKey(k), nil
+		}
+	}
+	return nil, APIKeyNotFound
+}
+
+func (r *MemoryRepo) RotateAPIKey(tenant string, id int, prefix string, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := r.findAPIKey(id)
+	if k == nil || k.TenantId != tenant || k.RevokedAt.Valid {
+		return APIKeyNotFound
+	}
+	k.Prefix, k.Hash = prefix, hash
+	return nil
+}
+
+func (r *MemoryRepo) RevokeAPIKey(tenant string, id int, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := r.findAPIKey(id)
+	if k == nil || k.TenantId != tenant {
+		return APIKeyNotFound
+	}
+	if !k.RevokedAt.Valid {
+		k.RevokedAt = NullTime{Time: at, Valid: true}
+	}
+	return nil
+}
+
+func (r *MemoryRepo) TouchAPIKey(id int, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := r.findAPIKey(id)
+	if k == nil {
+		return APIKeyNotFound
+	}
+	k.LastUsedAt = NullTime{Time: at, Valid: true}
+	return nil
+}
+
+func (r *MemoryRepo) UpsertFXRates(rates []FXRate) error {
+	for k := range rates {
+		if err := rates[k].Check(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rate := range rates {
+		r.fxRates[rate.From+" "+rate.To+" "+rate.Date] = rate
+	}
+	return nil
+}
+
+func (r *MemoryRepo) FindFXRate(from string, to string, date string) (*FXRate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var found *FXRate
+	for _, rate := range r.fxRates {
+		if rate.From == from && rate.To == to && rate.Date <= date && (found == nil || rate.Date > found.Date) {
+			rate := rate
+			found = &rate
+		}
+	}
+	if found == nil {
+		return nil, FXRateNotFound
+	}
+	return found, nil
+}
+
+func (r *MemoryRepo) findAPIKey(id int) *APIKey {
+	if id < 1 || id > len(r.apiKeys) {
+		return nil
+	}
+	return r.apiKeys[id-1]
+}
+
+func (r *MemoryRepo) find(id int) *Invoice {
+	k := sort.Search(len(r.invoices), func(k int) bool { return r.invoices[k].Id >= id })
+	if k < len(r.invoices) && r.invoices[k].Id == id {
+		return r.invoices[k]
+	}
+	return nil
+}
+
+func (r *MemoryRepo) findActive(tenant string, id int) *Invoice {
+	if invoice := r.find(id); invoice != nil && invoice.TenantId == tenant && invoice.IsActive {
+		return invoice
+	}
+	return nil
+}
+
+func (r *MemoryRepo) filter(tenant string, opts *QueryOptions) (matches []*Invoice, err error) {
+	if opts.Filters != nil {
+		if err = opts.Filters.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, invoice := range r.invoices {
+		if invoice.TenantId != tenant || !(invoice.IsActive || opts.IncludeInactive) {
+			continue
+		}
+		if opts.Filters == nil || opts.Filters.match(invoice) {
+			matches = append(matches, invoice)
+		}
+	}
+	return matches, nil
+}
+
+func sortInvoices(invoices []*Invoice, sorts []Sort) error {
+	for _, s := range sorts {
+		if _, err := invoiceColumn(s.Field); err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(invoices, func(i, j int) bool {
+		return compareInvoices(invoices[i], invoices[j], sorts) < 0
+	})
+	return nil
+}
+
+func compareInvoices(a, b *Invoice, sorts []Sort) int {
+	for _, s := range sorts {
+		c := compareInvoiceField(a, b, s.Field)
+		if c == 0 {
+			continue
+		}
+		if s.Desc {
+			return -c
+		}
+		return c
+	}
+	return 0
+}
+
+func keysetPage(sorted []*Invoice, keys []Sort, opts *QueryOptions) (invoices []*Invoice, err error) {
+	var pivot *Invoice
+	if !opts.Cursor.IsStart() {
+		if pivot, err = opts.Cursor.invoice(opts.Sorts); err != nil {
+			return nil, InvalidCursor
+		}
+	}
+
+	var page []*Invoice
+	for _, invoice := range sorted {
+		switch {
+		case pivot == nil, !opts.Cursor.Before && compareInvoices(invoice, pivot, keys) > 0:
+			page = append(page, invoice)
+		case opts.Cursor.Before && compareInvoices(invoice, pivot, keys) < 0:
+			page = append(page, invoice)
+		}
+	}
+	if n := opts.Pagination.PerPage; len(page) > n {
+		if opts.Cursor.Before {
+			page = page[len(page)-n:]
+		} else {
+			page = page[:n]
+		}
+	}
+
+	for _, invoice := range page {
+		clone := *invoice
+		invoices = append(invoices, &clone)
+	}
+	return invoices, nil
+}
+
+func reverseInvoices(invoices []*Invoice) {
+	for i, j := 0, len(invoices)-1; i < j; i, j = i+1, j-1 {
+		invoices[i], invoices[j] = invoices[j], invoices[i]
+	}
+}
+
+func invoiceIntField(i *Invoice, field string) int {
+	switch field {
+	case "id":
+		return i.Id
+	case "referenceMonth":
+		return i.ReferenceMonth
+	case "referenceYear":
+		return i.ReferenceYear
+	}
+	panic(fmt.Sprint("not an integer field: ", field))
+}
+
+func compareInvoiceField(a, b *Invoice, field string) int {
+	switch field {
+	case "id", "referenceMonth", "referenceYear":
+		return compareInts(invoiceIntField(a, field), invoiceIntField(b, field))
+	case "amount":
+		return compareInts(int(a.Amount), int(b.Amount))
+	case "createdAt":
+		return a.CreatedAt.Compare(b.CreatedAt)
+	case "document":
+		return strings.Compare(a.Document, b.Document)
+	case "description":
+		return strings.Compare(a.Description, b.Description)
+	case "currency":
+		return strings.Compare(a.Currency, b.Currency)
+	case "status":
+		return strings.Compare(string(a.Status), string(b.Status))
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
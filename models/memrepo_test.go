@@ -0,0 +1,25 @@
+package models
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemoryRepoConcurrentInserts(t *testing.T) {
+	repo := NewMemoryRepo()
+	var wg sync.WaitGroup
+	for k := 0; k < 50; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repo.InsertInvoice(Invoice{IsActive: true})
+			repo.CountInvoices("", &QueryOptions{})
+		}()
+	}
+	wg.Wait()
+
+	count, _ := repo.CountInvoices("", &QueryOptions{})
+	if count != 50 {
+		t.Errorf("count should have been 50, but was %v instead.", count)
+	}
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	MigrationLocked     = errors.New("another migration is running (remove the row from schema_migrations_lock if it crashed)")
+	NoMigrationToRevert = errors.New("there is no applied migration to revert")
+)
+
+// Statements holds the SQL of one migration step for each dialect, keyed by
+// Dialect.Name. The "" key is used by every dialect without its own entry.
+type Statements map[string][]string
+
+func (s Statements) For(d Dialect) []string {
+	if stmts, ok := s[d.Name()]; ok {
+		return stmts
+	}
+	return s[""]
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      Statements
+	Down    Statements
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt NullTime
+}
+
+type Migrator struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func NewMigrator(db *sql.DB, dialect Dialect) *Migrator {
+	return &Migrator{db: db, dialect: dialect}
+}
+
+func (m *Migrator) Up() (applied []Migration, err error) {
+	err = m.withLock(func() error {
+		appliedAt, err := m.appliedVersions()
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			if _, ok := appliedAt[migration.Version]; ok {
+				continue
+			}
+			err = m.run(migration.Up.For(m.dialect),
+				"INSERT INTO schema_migrations (Version, Name, AppliedAt) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now())
+			if err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return
+}
+
+func (m *Migrator) Down() (reverted *Migration, err error) {
+	err = m.withLock(func() error {
+		appliedAt, err := m.appliedVersions()
+		if err != nil {
+			return err
+		}
+		for k := len(migrations) - 1; k >= 0; k-- {
+			if _, ok := appliedAt[migrations[k].Version]; !ok {
+				continue
+			}
+			err = m.run(migrations[k].Down.For(m.dialect),
+				"DELETE FROM schema_migrations WHERE Version=?", migrations[k].Version)
+			if err != nil {
+				return err
+			}
+			reverted = &migrations[k]
+			return nil
+		}
+		return NoMigrationToRevert
+	})
+	return
+}
+
+func (m *Migrator) Status() (statuses []MigrationStatus, err error) {
+	if err = m.createBookkeeping(); err != nil {
+		return
+	}
+	appliedAt, err := m.appliedVersions()
+	if err != nil {
+		return
+	}
+	for _, migration := range migrations {
+		at, ok := appliedAt[migration.Version]
+		statuses = append(statuses, MigrationStatus{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return
+}
+
+// run executes stmts followed by the schema_migrations bookkeeping statement
+// in a single transaction. Databases without transactional DDL (MySQL) commit
+// each DDL statement on their own.
+func (m *Migrator) run(stmts []string, bookkeeping string, args ...interface{}) (err error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return
+		}
+	}
+	if _, err = tx.Exec(m.dialect.Rebind(bookkeeping), args...); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) appliedVersions() (appliedAt map[int]NullTime, err error) {
+	rows, err := m.db.Query("SELECT Version, AppliedAt FROM schema_migrations")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	appliedAt = map[int]NullTime{}
+	for rows.Next() {
+		var version int
+		var at NullTime
+		if err = rows.Scan(&version, &at); err != nil {
+			return
+		}
+		appliedAt[version] = at
+	}
+	err = rows.Err()
+	return
+}
+
+func (m *Migrator) createBookkeeping() error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+		   Version INTEGER NOT NULL PRIMARY KEY,
+		   Name VARCHAR(255) NOT NULL,
+		   AppliedAt TIMESTAMP NOT NULL
+		 )`,
+		`CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+		   Id INTEGER NOT NULL PRIMARY KEY,
+		   LockedAt TIMESTAMP NOT NULL
+		 )`,
+	} {
+		if _, err := m.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withLock runs f while holding the single row of schema_migrations_lock, so
+// that two runners never apply migrations at the same time.
+func (m *Migrator) withLock(f func() error) (err error) {
+	if err = m.createBookkeeping(); err != nil {
+		return
+	}
+
+	_, err = m.db.Exec(m.dialect.Rebind("INSERT INTO schema_migrations_lock (Id, LockedAt) VALUES (1, ?)"), time.Now())
+	if err != nil {
+		var locked int
+		if m.db.QueryRow("SELECT COUNT(*) FROM schema_migrations_lock").Scan(&locked) == nil && locked > 0 {
+			return MigrationLocked
+		}
+		return
+	}
+	defer func() {
+		if _, unlockErr := m.db.Exec("DELETE FROM schema_migrations_lock WHERE Id=1"); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	return f()
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func newSQLiteDb(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestMigratorUpDownStatus(t *testing.T) {
+	db := newSQLiteDb(t)
+	migrator := NewMigrator(db, SQLite)
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("%v migrations should have been applied, but %v were.", len(migrations), len(applied))
+	}
+	if applied, err = migrator.Up(); err != nil || len(applied) != 0 {
+		t.Errorf("running up twice should apply nothing, but applied %v (%v).", applied, err)
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.Applied || !s.AppliedAt.Valid {
+			t.Errorf("migration %v should have been applied.", s.Version)
+		}
+	}
+
+	reverted, err := migrator.Down()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := migrations[len(migrations)-1]
+	if reverted.Version != last.Version {
+		t.Errorf("reverted migration should have been %v, but was %v instead.", last.Version, reverted.Version)
+	}
+	statuses, err = migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[len(statuses)-1].Applied {
+		t.Errorf("migration %v should be pending after down.", last.Version)
+	}
+
+	for k := len(migrations) - 1; k > 0; k-- {
+		if _, err = migrator.Down(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = migrator.Down(); err != NoMigrationToRevert {
+		t.Errorf("error should have been %v, but was %v instead.", NoMigrationToRevert, err)
+	}
+	if _, err = db.Exec("SELECT * FROM Invoice"); err == nil {
+		t.Error("Invoice table should have been dropped.")
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	db := newSQLiteDb(t)
+	migrator := NewMigrator(db, SQLite)
+	if _, err := migrator.Status(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("INSERT INTO schema_migrations_lock (Id, LockedAt) VALUES (1, CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != MigrationLocked {
+		t.Errorf("error should have been %v, but was %v instead.", MigrationLocked, err)
+	}
+
+	if _, err := db.Exec("DELETE FROM schema_migrations_lock"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	var locked int
+	db.QueryRow("SELECT COUNT(*) FROM schema_migrations_lock").Scan(&locked)
+	if locked != 0 {
+		t.Error("lock should have been released after up.")
+	}
+}
+
+func TestMigratorMovesAmountsToLineItems(t *testing.T) {
+	db := newSQLiteDb(t)
+	migrator := NewMigrator(db, SQLite)
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// revert every migration down to create_line_item
+	for {
+		reverted, err := migrator.Down()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reverted == nil || reverted.Name == "create_line_item" {
+			break
+		}
+	}
+	_, err := db.Exec(`INSERT INTO Invoice (Id, CreatedAt, ReferenceMonth, ReferenceYear, Document, Description, Amount, IsActive, UpdatedAt)
+	                   VALUES (7, CURRENT_TIMESTAMP, 1, 2016, 'doc', 'fee', 10.5, 1, CURRENT_TIMESTAMP)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, items, err := NewSQLRepo(db, SQLite).GetLineItems("", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0] != (LineItem{Id: 1, Description: "fee", Quantity: 1, UnitPrice: 1050, Total: 1050}) {
+		t.Errorf("the amount should have become a single item, but the items were %+v instead.", items)
+	}
+}
+
+func TestMigratorStoresSQLiteDecimalsAsUnits(t *testing.T) {
+	db := newSQLiteDb(t)
+	migrator := NewMigrator(db, SQLite)
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if reverted, err := migrator.Down(); err != nil || reverted.Name != "store_sqlite_decimals_as_units" {
+		t.Fatalf("the last migration should have been reverted, but was %v (%v) instead.", reverted, err)
+	}
+	_, err := db.Exec(`INSERT INTO Invoice (Id, CreatedAt, ReferenceMonth, ReferenceYear, Document, Description, Amount, IsActive, UpdatedAt, AmountPaid)
+	                   VALUES (7, CURRENT_TIMESTAMP, 1, 2016, 'doc', 'fee', 10.5, 1, CURRENT_TIMESTAMP, 0.25)`)
+	if err == nil {
+		_, err = db.Exec("INSERT INTO FXRate (FromCurrency, ToCurrency, RateDate, Rate) VALUES ('USD', 'BRL', '2016-01-01', 3.25)")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewSQLRepo(db, SQLite)
+	invoice, err := repo.GetInvoiceById("", 7)
+	if err != nil || invoice.Amount != 1050 || invoice.AmountPaid != 25 {
+		t.Errorf("the amounts should have been 10.50 and 0.25, but the invoice was %+v (%v) instead.", invoice, err)
+	}
+	if rate, err := repo.FindFXRate("USD", "BRL", "2016-01-01"); err != nil || rate.Rate != 325000000 {
+		t.Errorf("the rate should have been 3.25, but was %+v (%v) instead.", rate, err)
+	}
+
+	if _, err = migrator.Down(); err != nil {
+		t.Fatal(err)
+	}
+	var amount float64
+	if err = db.QueryRow("SELECT Amount FROM Invoice WHERE Id=7").Scan(&amount); err != nil || amount != 10.5 {
+		t.Errorf("the amount should have gone back to 10.5, but was %v (%v) instead.", amount, err)
+	}
+}
@@ -0,0 +1,357 @@
+package models
+
+// migrations lists every schema change in the order it must be applied.
+// Never edit a migration that was already released; append a new one.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_invoice",
+		Up: Statements{
+			"mysql": {
+				`CREATE TABLE IF NOT EXISTS Invoice (
+				   Id INTEGER NOT NULL AUTO_INCREMENT,
+				   CreatedAt DATETIME NOT NULL,
+				   ReferenceMonth INTEGER NOT NULL,
+				   ReferenceYear INTEGER NOT NULL,
+				   Document VARCHAR(14) NOT NULL,
+				   Description VARCHAR(256) NOT NULL DEFAULT "",
+				   Amount DECIMAL(16, 2) NOT NULL,
+				   IsActive TINYINT NOT NULL DEFAULT 0,
+				   DeactiveAt DATETIME DEFAULT NULL,
+
+				   PRIMARY KEY (Id),
+				   INDEX Document_Index (Document),
+				   INDEX ReferenceMonth_Index (ReferenceMonth),
+				   INDEX ReferenceYear_Index (ReferenceYear),
+				   INDEX IsActive_Index (IsActive)
+				 )`,
+			},
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS Invoice (
+				   Id SERIAL PRIMARY KEY,
+				   CreatedAt TIMESTAMP NOT NULL,
+				   ReferenceMonth INTEGER NOT NULL,
+				   ReferenceYear INTEGER NOT NULL,
+				   Document VARCHAR(14) NOT NULL,
+				   Description VARCHAR(256) NOT NULL DEFAULT '',
+				   Amount DECIMAL(16, 2) NOT NULL,
+				   IsActive SMALLINT NOT NULL DEFAULT 0,
+				   DeactiveAt TIMESTAMP DEFAULT NULL
+				 )`,
+				"CREATE INDEX IF NOT EXISTS Document_Index ON Invoice (Document)",
+				"CREATE INDEX IF NOT EXISTS ReferenceMonth_Index ON Invoice (ReferenceMonth)",
+				"CREATE INDEX IF NOT EXISTS ReferenceYear_Index ON Invoice (ReferenceYear)",
+				"CREATE INDEX IF NOT EXISTS IsActive_Index ON Invoice (IsActive)",
+			},
+			"sqlite": {
+				`CREATE TABLE IF NOT EXISTS Invoice (
+				   Id INTEGER PRIMARY KEY AUTOINCREMENT,
+				   CreatedAt DATETIME NOT NULL,
+				   ReferenceMonth INTEGER NOT NULL,
+				   ReferenceYear INTEGER NOT NULL,
+				   Document VARCHAR(14) NOT NULL,
+				   Description VARCHAR(256) NOT NULL DEFAULT '',
+				   Amount DECIMAL(16, 2) NOT NULL,
+				   IsActive TINYINT NOT NULL DEFAULT 0,
+				   DeactiveAt DATETIME DEFAULT NULL
+				 )`,
+				"CREATE INDEX IF NOT EXISTS Document_Index ON Invoice (Document)",
+				"CREATE INDEX IF NOT EXISTS ReferenceMonth_Index ON Invoice (ReferenceMonth)",
+				"CREATE INDEX IF NOT EXISTS ReferenceYear_Index ON Invoice (ReferenceYear)",
+				"CREATE INDEX IF NOT EXISTS IsActive_Index ON Invoice (IsActive)",
+			},
+		},
+		Down: Statements{
+			"": {"DROP TABLE Invoice"},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add_invoice_version",
+		Up: Statements{
+			"": {"ALTER TABLE Invoice ADD COLUMN Version INTEGER NOT NULL DEFAULT 1"},
+		},
+		Down: Statements{
+			"": {"ALTER TABLE Invoice DROP COLUMN Version"},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add_invoice_updated_at",
+		Up: Statements{
+			"mysql": {
+				"ALTER TABLE Invoice ADD COLUMN UpdatedAt DATETIME NULL",
+				"UPDATE Invoice SET UpdatedAt=COALESCE(DeactiveAt, CreatedAt)",
+				"ALTER TABLE Invoice MODIFY UpdatedAt DATETIME NOT NULL",
+			},
+			"postgres": {
+				"ALTER TABLE Invoice ADD COLUMN UpdatedAt TIMESTAMP NULL",
+				"UPDATE Invoice SET UpdatedAt=COALESCE(DeactiveAt, CreatedAt)",
+				"ALTER TABLE Invoice ALTER COLUMN UpdatedAt SET NOT NULL",
+			},
+			// SQLite can't add a NOT NULL column without a default
+			"sqlite": {
+				"ALTER TABLE Invoice ADD COLUMN UpdatedAt DATETIME NULL",
+				"UPDATE Invoice SET UpdatedAt=COALESCE(DeactiveAt, CreatedAt)",
+			},
+		},
+		Down: Statements{
+			"": {"ALTER TABLE Invoice DROP COLUMN UpdatedAt"},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create_idempotency_key",
+		Up: Statements{
+			"mysql": {
+				`CREATE TABLE IF NOT EXISTS IdempotencyKey (
+				   RequestKey VARCHAR(255) NOT NULL,
+				   Fingerprint VARCHAR(64) NOT NULL,
+				   StatusCode INTEGER NOT NULL DEFAULT 0,
+				   Location VARCHAR(255) NOT NULL DEFAULT "",
+				   Body MEDIUMBLOB DEFAULT NULL,
+				   CreatedAt DATETIME NOT NULL,
+
+				   PRIMARY KEY (RequestKey),
+				   INDEX CreatedAt_Index (CreatedAt)
+				 )`,
+			},
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS IdempotencyKey (
+				   RequestKey VARCHAR(255) PRIMARY KEY,
+				   Fingerprint VARCHAR(64) NOT NULL,
+				   StatusCode INTEGER NOT NULL DEFAULT 0,
+				   Location VARCHAR(255) NOT NULL DEFAULT '',
+				   Body BYTEA DEFAULT NULL,
+				   CreatedAt TIMESTAMP NOT NULL
+				 )`,
+				"CREATE INDEX IF NOT EXISTS IdempotencyKey_CreatedAt_Index ON IdempotencyKey (CreatedAt)",
+			},
+			"sqlite": {
+				`CREATE TABLE IF NOT EXISTS IdempotencyKey (
+				   RequestKey VARCHAR(255) PRIMARY KEY,
+				   Fingerprint VARCHAR(64) NOT NULL,
+				   StatusCode INTEGER NOT NULL DEFAULT 0,
+				   Location VARCHAR(255) NOT NULL DEFAULT '',
+				   Body BLOB DEFAULT NULL,
+				   CreatedAt DATETIME NOT NULL
+				 )`,
+				"CREATE INDEX IF NOT EXISTS IdempotencyKey_CreatedAt_Index ON IdempotencyKey (CreatedAt)",
+			},
+		},
+		Down: Statements{
+			"": {"DROP TABLE IdempotencyKey"},
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create_api_key",
+		Up: Statements{
+			"mysql": {
+				`CREATE TABLE IF NOT EXISTS APIKey (
+				   Id INTEGER NOT NULL AUTO_INCREMENT,
+				   Name VARCHAR(255) NOT NULL,
+				   Prefix VARCHAR(16) NOT NULL,
+				   Hash CHAR(64) NOT NULL,
+				   Scopes VARCHAR(255) NOT NULL DEFAULT "",
+				   CreatedAt DATETIME NOT NULL,
+				   ExpiresAt DATETIME DEFAULT NULL,
+				   LastUsedAt DATETIME DEFAULT NULL,
+				   RevokedAt DATETIME DEFAULT NULL,
+
+				   PRIMARY KEY (Id),
+				   UNIQUE INDEX Hash_Index (Hash)
+				 )`,
+			},
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS APIKey (
+				   Id SERIAL PRIMARY KEY,
+				   Name VARCHAR(255) NOT NULL,
+				   Prefix VARCHAR(16) NOT NULL,
+				   Hash CHAR(64) NOT NULL UNIQUE,
+				   Scopes VARCHAR(255) NOT NULL DEFAULT '',
+				   CreatedAt TIMESTAMP NOT NULL,
+				   ExpiresAt TIMESTAMP DEFAULT NULL,
+				   LastUsedAt TIMESTAMP DEFAULT NULL,
+				   RevokedAt TIMESTAMP DEFAULT NULL
+				 )`,
+			},
+			"sqlite": {
+				`CREATE TABLE IF NOT EXISTS APIKey (
+				   Id INTEGER PRIMARY KEY AUTOINCREMENT,
+				   Name VARCHAR(255) NOT NULL,
+				   Prefix VARCHAR(16) NOT NULL,
+				   Hash CHAR(64) NOT NULL UNIQUE,
+				   Scopes VARCHAR(255) NOT NULL DEFAULT '',
+				   CreatedAt DATETIME NOT NULL,
+				   ExpiresAt DATETIME DEFAULT NULL,
+				   LastUsedAt DATETIME DEFAULT NULL,
+				   RevokedAt DATETIME DEFAULT NULL
+				 )`,
+			},
+		},
+		Down: Statements{
+			"": {"DROP TABLE APIKey"},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add_tenant",
+		Up: Statements{
+			// random invoice ids need 64 bits, which SQLite integers already have
+			"mysql": {
+				"ALTER TABLE Invoice MODIFY Id BIGINT NOT NULL AUTO_INCREMENT",
+				"ALTER TABLE Invoice ADD COLUMN TenantId VARCHAR(64) NOT NULL DEFAULT ''",
+				"CREATE INDEX Invoice_Tenant_Index ON Invoice (TenantId, IsActive)",
+				"ALTER TABLE APIKey ADD COLUMN TenantId VARCHAR(64) NOT NULL DEFAULT ''",
+			},
+			"postgres": {
+				"ALTER TABLE Invoice ALTER COLUMN Id TYPE BIGINT",
+				"ALTER TABLE Invoice ADD COLUMN TenantId VARCHAR(64) NOT NULL DEFAULT ''",
+				"CREATE INDEX Invoice_Tenant_Index ON Invoice (TenantId, IsActive)",
+				"ALTER TABLE APIKey ADD COLUMN TenantId VARCHAR(64) NOT NULL DEFAULT ''",
+			},
+			"sqlite": {
+				"ALTER TABLE Invoice ADD COLUMN TenantId VARCHAR(64) NOT NULL DEFAULT ''",
+				"CREATE INDEX Invoice_Tenant_Index ON Invoice (TenantId, IsActive)",
+				"ALTER TABLE APIKey ADD COLUMN TenantId VARCHAR(64) NOT NULL DEFAULT ''",
+			},
+		},
+		Down: Statements{
+			"mysql": {
+				"ALTER TABLE APIKey DROP COLUMN TenantId",
+				"DROP INDEX Invoice_Tenant_Index ON Invoice",
+				"ALTER TABLE Invoice DROP COLUMN TenantId",
+				"ALTER TABLE Invoice MODIFY Id INTEGER NOT NULL AUTO_INCREMENT",
+			},
+			"postgres": {
+				"ALTER TABLE APIKey DROP COLUMN TenantId",
+				"DROP INDEX Invoice_Tenant_Index",
+				"ALTER TABLE Invoice DROP COLUMN TenantId",
+				"ALTER TABLE Invoice ALTER COLUMN Id TYPE INTEGER",
+			},
+			"sqlite": {
+				"ALTER TABLE APIKey DROP COLUMN TenantId",
+				"DROP INDEX Invoice_Tenant_Index",
+				"ALTER TABLE Invoice DROP COLUMN TenantId",
+			},
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add_currency",
+		Up: Statements{
+			"": {
+				"ALTER TABLE Invoice ADD COLUMN Currency CHAR(3) NOT NULL DEFAULT 'BRL'",
+				// dates are text, as in 2016-01-31, which compares as dates do
+				`CREATE TABLE IF NOT EXISTS FXRate (
+				   FromCurrency CHAR(3) NOT NULL,
+				   ToCurrency CHAR(3) NOT NULL,
+				   RateDate CHAR(10) NOT NULL,
+				   Rate DECIMAL(18, 8) NOT NULL,
+
+				   PRIMARY KEY (FromCurrency, ToCurrency, RateDate)
+				 )`,
+			},
+		},
+		Down: Statements{
+			"": {
+				"DROP TABLE FXRate",
+				"ALTER TABLE Invoice DROP COLUMN Currency",
+			},
+		},
+	},
+	{
+		Version: 8,
+		Name:    "create_line_item",
+		Up: Statements{
+			"": {
+				`CREATE TABLE IF NOT EXISTS LineItem (
+				   InvoiceId BIGINT NOT NULL,
+				   Id INTEGER NOT NULL,
+				   Description VARCHAR(256) NOT NULL DEFAULT '',
+				   Quantity INTEGER NOT NULL,
+				   UnitPrice DECIMAL(16, 2) NOT NULL,
+				   Discount DECIMAL(16, 2) NOT NULL DEFAULT 0,
+
+				   PRIMARY KEY (InvoiceId, Id)
+				 )`,
+				// every invoice so far is an amount, which becomes its only item
+				`INSERT INTO LineItem (InvoiceId, Id, Description, Quantity, UnitPrice, Discount)
+				 SELECT Id, 1, Description, 1, Amount, 0 FROM Invoice`,
+			},
+		},
+		Down: Statements{
+			"": {"DROP TABLE LineItem"},
+		},
+	},
+	{
+		Version: 9,
+		Name:    "create_invoice_tax",
+		Up: Statements{
+			// invoices so far have no taxes until their items change
+			"": {
+				`CREATE TABLE IF NOT EXISTS InvoiceTax (
+				   InvoiceId BIGINT NOT NULL,
+				   Code VARCHAR(16) NOT NULL,
+				   Rate DECIMAL(7, 4) NOT NULL,
+				   Inclusive SMALLINT NOT NULL DEFAULT 0,
+				   Base DECIMAL(16, 2) NOT NULL,
+				   Amount DECIMAL(16, 2) NOT NULL,
+
+				   PRIMARY KEY (InvoiceId, Code)
+				 )`,
+			},
+		},
+		Down: Statements{
+			"": {"DROP TABLE InvoiceTax"},
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add_status",
+		Up: Statements{
+			// invoices so far stay drafts, which can still be changed
+			"": {
+				"ALTER TABLE Invoice ADD COLUMN Status VARCHAR(16) NOT NULL DEFAULT 'draft'",
+				"ALTER TABLE Invoice ADD COLUMN AmountPaid DECIMAL(16, 2) NOT NULL DEFAULT 0",
+				"CREATE INDEX Invoice_Status_Index ON Invoice (TenantId, Status)",
+			},
+		},
+		Down: Statements{
+			"mysql": {
+				"DROP INDEX Invoice_Status_Index ON Invoice",
+				"ALTER TABLE Invoice DROP COLUMN AmountPaid",
+				"ALTER TABLE Invoice DROP COLUMN Status",
+			},
+			"": {
+				"DROP INDEX Invoice_Status_Index",
+				"ALTER TABLE Invoice DROP COLUMN AmountPaid",
+				"ALTER TABLE Invoice DROP COLUMN Status",
+			},
+		},
+	},
+	{
+		Version: 11,
+		Name:    "store_sqlite_decimals_as_units",
+		// SQLite keeps the DECIMAL columns, which store integers exactly, but
+		// holds the counts of the smallest unit of their values in them, as
+		// SQLite.Bind writes them. The other databases have real decimals.
+		Up: Statements{
+			"sqlite": {
+				"UPDATE Invoice SET Amount=CAST(ROUND(Amount*100) AS INTEGER), AmountPaid=CAST(ROUND(AmountPaid*100) AS INTEGER)",
+				"UPDATE LineItem SET UnitPrice=CAST(ROUND(UnitPrice*100) AS INTEGER), Discount=CAST(ROUND(Discount*100) AS INTEGER)",
+				"UPDATE InvoiceTax SET Rate=CAST(ROUND(Rate*10000) AS INTEGER), Base=CAST(ROUND(Base*100) AS INTEGER), Amount=CAST(ROUND(Amount*100) AS INTEGER)",
+				"UPDATE FXRate SET Rate=CAST(ROUND(Rate*100000000) AS INTEGER)",
+			},
+		},
+		Down: Statements{
+			"sqlite": {
+				"UPDATE Invoice SET Amount=Amount/100.0, AmountPaid=AmountPaid/100.0",
+				"UPDATE LineItem SET UnitPrice=UnitPrice/100.0, Discount=Discount/100.0",
+				"UPDATE InvoiceTax SET Rate=Rate/10000.0, Base=Base/100.0, Amount=Amount/100.0",
+				"UPDATE FXRate SET Rate=Rate/100000000.0",
+			},
+		},
+	},
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"math/big"
+)
+
+const (
+	// MaxMoney is the largest amount the DECIMAL(16, 2) columns hold, and
+	// -MaxMoney the smallest.
+	MaxMoney           Money = 9999999999999999
+	moneyIntegerDigits       = 14
+)
+
+var (
+	InvalidMoney    = errors.New("invalid amount")
+	MoneyTooPrecise = errors.New("amount has more than two decimals")
+	MoneyOutOfRange = errors.New("amount out of range")
+)
+
+type RoundingMode string
+
+const (
+	RoundHalfUp   RoundingMode = "half_up"
+	RoundHalfEven RoundingMode = "half_even"
+	RoundDown     RoundingMode = "down"
+	RoundUp       RoundingMode = "up"
+)
+
+var RoundingModes = []RoundingMode{RoundHalfUp, RoundHalfEven, RoundDown, RoundUp}
+
+func divideMoney(n, d *big.Int, currency string, mode RoundingMode) (Money, error) {
+	unit := big.NewInt(int64(minorUnit(currency)))
+	d = new(big.Int).Mul(d, unit)
+	q, m := new(big.Int).QuoRem(n, d, new(big.Int))
+	if m.Sign() != 0 {
+		half := m.Abs(m).Lsh(m, 1).Cmp(d)
+		switch {
+		case mode == RoundUp,
+			mode == RoundHalfUp && half >= 0,
+			mode == RoundHalfEven && (half > 0 || half == 0 && q.Bit(0) == 1):
+			q.Add(q, big.NewInt(int64(n.Sign())))
+		}
+	}
+	q.Mul(q, unit)
+	if !q.IsInt64() || Money(q.Int64()).Check() != nil {
+		return 0, MoneyOutOfRange
+	}
+	return Money(q.Int64()), nil
+}
+
+// Money is an exact amount in cents. It is written as a decimal number with
+// two decimals, as in 10.50, both in SQL and in JSON.
+type Money int64
+
+var moneyFormat = fixedPoint{decimals: 2, integerDigits: moneyIntegerDigits, min: -int64(MaxMoney), max: int64(MaxMoney), kind: InvalidMoney}
+
+func ParseMoney(s string) (Money, error) {
+	cents, err := moneyFormat.parse(s)
+	return Money(cents), err
+}
+
+func (m Money) String() string {
+	return moneyFormat.format(int64(m))
+}
+
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+func (m Money) Check() error {
+	if m > MaxMoney || m < -MaxMoney {
+		return MoneyOutOfRange
+	}
+	return nil
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	cents, err := moneyFormat.unmarshalJSON(b)
+	*m = Money(cents)
+	return err
+}
+
+func (m *Money) Scan(value interface{}) error {
+	cents, err := moneyFormat.scan(value)
+	*m = Money(cents)
+	return err
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	var cases = []struct {
+		value    string
+		expected Money
+		err      error
+	}{
+		{"0", 0, nil},
+		{"10", 1000, nil},
+		{"10.5", 1050, nil},
+		{"-10.05", -1005, nil},
+		{"0.1", 10, nil},
+		{"1.500", 150, nil},
+		{"007.00", 700, nil},
+		{"99999999999999.99", MaxMoney, nil},
+		{"-99999999999999.99", -MaxMoney, nil},
+		{"100000000000000", 0, MoneyOutOfRange},
+		{"0.001", 0, MoneyTooPrecise},
+		{"10.505", 0, MoneyTooPrecise},
+		{"", 0, InvalidMoney},
+		{"-", 0, InvalidMoney},
+		{"1.", 0, InvalidMoney},
+		{".5", 0, InvalidMoney},
+		{"1e3", 0, InvalidMoney},
+		{"+1", 0, InvalidMoney},
+		{"1,50", 0, InvalidMoney},
+		{"NaN", 0, InvalidMoney},
+	}
+	for _, c := range cases {
+		m, err := ParseMoney(c.value)
+		if m != c.expected || err != c.err {
+			t.Errorf("%q: money should have been %v (%v), but was %v (%v) instead.", c.value, c.expected, c.err, m, err)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	for m, expected := range map[Money]string{0: "0.00", 5: "0.05", -5: "-0.05", 1050: "10.50", -123456: "-1234.56"} {
+		if m.String() != expected {
+			t.Errorf("%d: string should have been %q, but was %q instead.", int64(m), expected, m.String())
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var cases = []struct {
+		json     string
+		expected Money
+		valid    bool
+	}{
+		{`0.3`, 30, true},
+		{`"0.30"`, 30, true},
+		{`12`, 1200, true},
+		{`0.333`, 0, false},
+		{`"ten"`, 0, false},
+		{`3e2`, 0, false},
+		{`null`, 0, false},
+	}
+	for _, c := range cases {
+		var m Money
+		err := json.Unmarshal([]byte(c.json), &m)
+		if (err == nil) != c.valid || m != c.expected {
+			t.Errorf("%v: money should have been %v (valid: %v), but was %v (%v) instead.", c.json, c.expected, c.valid, m, err)
+		}
+	}
+
+	b, err := json.Marshal(Invoice{Amount: 10 + 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]json.RawMessage
+	json.Unmarshal(b, &doc)
+	if string(doc["amount"]) != "0.30" {
+		t.Errorf("amount should have been written as 0.30, but was %s instead.", doc["amount"])
+	}
+}
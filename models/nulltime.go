@@ -0,0 +1,57 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// NullTime is a time.Time that may be NULL in the database. It replaces
+// mysql.NullTime so that Invoice does not depend on a particular driver, and
+// keeps its JSON shape.
+type NullTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+var nullTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+}
+
+func (nt *NullTime) Scan(value interface{}) (err error) {
+	nt.Time, nt.Valid = time.Time{}, false
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		nt.Time, nt.Valid = v, true
+		return nil
+	case []byte:
+		return nt.parse(string(v))
+	case string:
+		return nt.parse(v)
+	}
+	return fmt.Errorf("can't convert %T to NullTime", value)
+}
+
+func (nt *NullTime) parse(s string) (err error) {
+	for _, layout := range nullTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			nt.Time, nt.Valid = t, true
+			return nil
+		}
+	}
+	return err
+}
+
+func (nt NullTime) Value() (driver.Value, error) {
+	if !nt.Valid {
+		return nil, nil
+	}
+	return nt.Time, nil
+}
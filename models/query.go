@@ -0,0 +1,190 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var UnknownField = errors.New("unknown field")
+
+// invoiceColumns whitelists the fields that may appear in a query and maps
+// them to their Invoice table columns. Anything else is rejected before it
+// gets anywhere near the SQL text.
+var invoiceColumns = map[string]string{
+	"id":             "Id",
+	"createdAt":      "CreatedAt",
+	"referenceMonth": "ReferenceMonth",
+	"referenceYear":  "ReferenceYear",
+	"document":       "Document",
+	"description":    "Description",
+	"amount":         "Amount",
+	"currency":       "Currency",
+	"status":         "Status",
+}
+
+func invoiceColumn(field string) (string, error) {
+	column, ok := invoiceColumns[field]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", UnknownField, field)
+	}
+	return column, nil
+}
+
+// queryBuilder accumulates SQL text and the arguments bound to its
+// placeholders. User supplied values only ever reach the database through
+// args.
+type queryBuilder struct {
+	buf  bytes.Buffer
+	args []interface{}
+}
+
+func (b *queryBuilder) Write(s string) {
+	b.buf.WriteString(s)
+}
+
+func (b *queryBuilder) Bind(value interface{}) {
+	b.buf.WriteString("?")
+	b.args = append(b.args, value)
+}
+
+func (b *queryBuilder) String() string {
+	return b.buf.String()
+}
+
+func (b *queryBuilder) Args() []interface{} {
+	return b.args
+}
+
+func (b *queryBuilder) WriteFilters(q *QueryOptions) error {
+	if !q.IncludeInactive {
+		b.Write(" AND IsActive=1")
+	}
+	if q.Filters == nil {
+		return nil
+	}
+	if err := q.Filters.check(); err != nil {
+		return err
+	}
+	b.Write(" AND ")
+	q.Filters.writeSQL(b)
+	return nil
+}
+
+func (b *queryBuilder) WriteAssignments(fields InvoiceFields) error {
+	if len(fields) == 0 {
+		return NoFieldsToUpdate
+	}
+	if err := fields.Check(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	for k, field := range names {
+		if k > 0 {
+			b.Write(", ")
+		}
+		b.Write(invoiceColumns[field] + "=")
+		b.Bind(fields[field])
+	}
+	return nil
+}
+
+// WriteSorts writes the ORDER BY clause, with a tiebreak on the id so that
+// pages neither overlap nor skip rows. reverse flips every direction.
+func (b *queryBuilder) WriteSorts(sorts []Sort, reverse bool) error {
+	keys := orderKeys(sorts)
+	var sortsStr = make([]string, len(keys))
+	for i, s := range keys {
+		column, err := invoiceColumn(s.Field)
+		if err != nil {
+			return err
+		}
+		sortsStr[i] = column
+		if s.Desc != reverse {
+			sortsStr[i] += " DESC"
+		} else {
+			sortsStr[i] += " ASC"
+		}
+	}
+	b.Write(" ORDER BY " + strings.Join(sortsStr, ", "))
+	return nil
+}
+
+// WriteKeyset keeps the rows that come after cursor in the order of sorts,
+// or before it when cursor.Before is set:
+//
+//	(k1 > v1) OR (k1 = v1 AND k2 > v2) OR ... OR (k1 = v1 AND ... AND Id > id)
+//
+// with < instead of > for descending keys.
+func (b *queryBuilder) WriteKeyset(sorts []Sort, cursor *Cursor) error {
+	pivot, err := cursor.invoice(sorts)
+	if err != nil {
+		return InvalidCursor
+	}
+	keys := orderKeys(sorts)
+	columns := make([]string, len(keys))
+	for k, s := range keys {
+		if columns[k], err = invoiceColumn(s.Field); err != nil {
+			return err
+		}
+	}
+
+	b.Write(" AND (")
+	for k, s := range keys {
+		if k > 0 {
+			b.Write(" OR ")
+		}
+		b.Write("(")
+		for j := 0; j < k; j++ {
+			b.Write(columns[j] + "=")
+			b.Bind(invoiceFieldValue(pivot, keys[j].Field))
+			b.Write(" AND ")
+		}
+		if s.Desc != cursor.Before {
+			b.Write(columns[k] + "<")
+		} else {
+			b.Write(columns[k] + ">")
+		}
+		b.Bind(invoiceFieldValue(pivot, s.Field))
+		b.Write(")")
+	}
+	b.Write(")")
+	return nil
+}
+
+func (b *queryBuilder) WriteLimit(p Pagination) {
+	b.Write(" LIMIT ")
+	b.Bind(p.PerPage)
+	b.Write(" OFFSET ")
+	b.Bind((p.Page - 1) * p.PerPage)
+}
+
+func (b *queryBuilder) WritePage(q *QueryOptions) error {
+	if q.Cursor == nil {
+		if err := b.WriteSorts(q.Sorts, false); err != nil {
+			return err
+		}
+		b.WriteLimit(q.Pagination)
+		return nil
+	}
+
+	if !q.Cursor.IsStart() {
+		if err := b.WriteKeyset(q.Sorts, q.Cursor); err != nil {
+			return err
+		}
+	}
+	if err := b.WriteSorts(q.Sorts, q.Cursor.Before); err != nil {
+		return err
+	}
+	b.Write(" LIMIT ")
+	b.Bind(q.Pagination.PerPage)
+	return nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryStringBindsFilterValues(t *testing.T) {
+	repo := &SQLRepo{}
+	opts := &QueryOptions{
+		Filters: And{
+			&Condition{Field: "document", Op: OpEq, Values: []interface{}{`x" OR "1"="1`}},
+			&Condition{Field: "referenceYear", Op: OpEq, Values: []interface{}{2016}},
+		},
+		Sorts:      []Sort{{Field: "referenceMonth", Desc: true}, {Field: "document"}},
+		Pagination: Pagination{Page: 3, PerPage: 5},
+	}
+
+	queryStr, args, err := repo.QueryString(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStr := " AND IsActive=1 AND (Document=? AND ReferenceYear=?) ORDER BY ReferenceMonth DESC, Document ASC, Id ASC LIMIT ? OFFSET ?"
+	if queryStr != expectedStr {
+		t.Errorf("query string should have been %q, but was %q instead.", expectedStr, queryStr)
+	}
+	expectedArgs := []interface{}{`x" OR "1"="1`, 2016, 5, 10}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("args should have been %v, but were %v instead.", expectedArgs, args)
+	}
+}
+
+func TestQueryStringWithoutLimitSharesFilters(t *testing.T) {
+	repo := &SQLRepo{}
+	opts := &QueryOptions{
+		Filters:    And{&Condition{Field: "document", Op: OpEq, Values: []interface{}{"abc"}}},
+		Pagination: Pagination{Page: 1, PerPage: 5},
+	}
+
+	queryStr, args, err := repo.QueryStringWithoutLimit(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queryStr != " AND IsActive=1 AND (Document=?)" {
+		t.Errorf("query string should have been %q, but was %q instead.", " AND IsActive=1 AND (Document=?)", queryStr)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"abc"}) {
+		t.Errorf("args should have been [abc], but were %v instead.", args)
+	}
+}
+
+func TestQueryStringRejectsUnknownColumns(t *testing.T) {
+	repo := &SQLRepo{}
+	var optsList = []*QueryOptions{
+		{Filters: And{&Condition{Field: "1=1 OR Id", Op: OpEq, Values: []interface{}{"1"}}}},
+		{Filters: And{&Condition{Field: "document", Op: "= 'a' OR 1", Values: []interface{}{"1"}}}},
+		{Filters: And{&Condition{Field: "document", Op: OpEq, Values: []interface{}{1}}}},
+		{Sorts: []Sort{{Field: "(SELECT 1)"}}},
+		{Sorts: []Sort{{Field: "IsActive"}}},
+	}
+
+	for _, opts := range optsList {
+		if _, _, err := repo.QueryString(opts); err == nil {
+			t.Errorf("%+v: expected an error, but received none.", opts)
+		}
+	}
+
+	filtersOnly := &QueryOptions{Filters: And{&Condition{Field: "Document=Document OR Id", Op: OpEq, Values: []interface{}{"1"}}}}
+	if _, _, err := repo.QueryStringWithoutLimit(filtersOnly); err == nil {
+		t.Errorf("%+v: expected an error, but received none.", filtersOnly)
+	}
+}
+
+func TestPostgresRebind(t *testing.T) {
+	queryStr := Postgres.Rebind("SELECT * FROM Invoice WHERE Document=? AND ReferenceYear=? LIMIT ? OFFSET ?")
+	expectedStr := "SELECT * FROM Invoice WHERE Document=$1 AND ReferenceYear=$2 LIMIT $3 OFFSET $4"
+	if queryStr != expectedStr {
+		t.Errorf("query string should have been %q, but was %q instead.", expectedStr, queryStr)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	var cases = []struct {
+		expr         string
+		expectedSQL  string
+		expectedArgs []interface{}
+	}{
+		{"amount gt 100", "Amount>?", []interface{}{Money(10000)}},
+		{
+			"amount gt 100 and (referenceYear eq 2016 or document eq 'X')",
+			"(Amount>? AND (ReferenceYear=? OR Document=?))",
+			[]interface{}{Money(10000), 2016, "X"},
+		},
+		{
+			"referenceYear eq 2016 or document eq 'X' and amount lte -1.5",
+			"(ReferenceYear=? OR (Document=? AND Amount<=?))",
+			[]interface{}{2016, "X", Money(-150)},
+		},
+		{"NOT document ne 'it''s' AND referenceMonth IN (1, 2,3)", "(NOT (NOT (Document=?)) AND ReferenceMonth IN (?, ?, ?))", []interface{}{"it's", 1, 2, 3}},
+		{"createdAt lt '2016-01-31'", "CreatedAt<?", []interface{}{time.Date(2016, 1, 31, 0, 0, 0, 0, time.UTC)}},
+		{"description contains '50%'", "LOWER(Description) LIKE ? ESCAPE '!'", []interface{}{"%50!%%"}},
+	}
+	for _, c := range cases {
+		f, err := ParseFilter(c.expr)
+		if err != nil {
+			t.Errorf("%q: should have parsed, but failed with %v instead.", c.expr, err)
+			continue
+		}
+		var b queryBuilder
+		f.writeSQL(&b)
+		if b.String() != c.expectedSQL || !reflect.DeepEqual(b.Args(), c.expectedArgs) {
+			t.Errorf("%q: SQL should have been %q %v, but was %q %v instead.", c.expr, c.expectedSQL, c.expectedArgs, b.String(), b.Args())
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	var cases = []struct {
+		expr           string
+		expectedColumn int
+	}{
+		{"", 1},
+		{"   ", 4},
+		{"amount gt", 10},
+		{"amout gt 1", 1},
+		{"amount is 1", 8},
+		{"description gt 'a'", 13},
+		{"amount gt '1'", 11},
+		{"referenceYear eq 20.5", 18},
+		{"createdAt lt 'yesterday'", 14},
+		{"document eq 'x", 13},
+		{"document eq 'é' or é", 20},
+		{"(amount gt 1", 13},
+		{"amount gt 1)", 12},
+		{"amount gt 1 amount lt 2", 13},
+		{"referenceMonth in (1,)", 22},
+		{"referenceMonth in ()", 20},
+		{"amount gt 1 & amount lt 2", 13},
+		{"amount gt -", 11},
+		{strings.Repeat("(", 40) + "amount gt 1" + strings.Repeat(")", 40), 33},
+	}
+	for _, c := range cases {
+		_, err := ParseFilter(c.expr)
+		syntaxErr, ok := err.(*FilterSyntaxError)
+		if !ok {
+			t.Errorf("%q: should have failed with a FilterSyntaxError, but returned %v instead.", c.expr, err)
+			continue
+		}
+		if syntaxErr.Column != c.expectedColumn {
+			t.Errorf("%q: column should have been %v, but was %v (%v) instead.", c.expr, c.expectedColumn, syntaxErr.Column, syntaxErr)
+		}
+	}
+}
+
+func TestSelectInvoiceFields(t *testing.T) {
+	var cases = []struct {
+		opts            QueryOptions
+		expectedColumns string
+	}{
+		{QueryOptions{}, "*"},
+		{QueryOptions{Fields: []string{"amount", "document"}}, "Id, Document, Amount"},
+		{QueryOptions{Fields: []string{"version"}, Sorts: []Sort{{Field: "referenceYear", Desc: true}}}, "Id, ReferenceYear, Version"},
+		{QueryOptions{Fields: []string{"deactiveAt", "id", "deactiveAt"}}, "Id, DeactiveAt"},
+	}
+	for _, c := range cases {
+		selection, err := selectInvoiceFields(&c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if columns := selection.columns(); columns != c.expectedColumns {
+			t.Errorf("%v: columns should have been %q, but were %q instead.", c.opts.Fields, c.expectedColumns, columns)
+		}
+	}
+
+	for _, fields := range [][]string{{"tenantId"}, {"TenantId"}, {"amount", "Amount"}, {""}} {
+		if _, err := selectInvoiceFields(&QueryOptions{Fields: fields}); err == nil {
+			t.Errorf("%v: the projection should have been rejected.", fields)
+		}
+	}
+}
@@ -5,21 +5,38 @@ import (
 	"math"
 )
 
+// Repo stores invoices. Every method works within one tenant: the invoices
+// of other tenants behave exactly as if they did not exist. The methods that
+// change an invoice take the version the caller expects it to have and fail
+// with VersionConflict when it has another one; version 0 skips the check.
+// Every change bumps the version.
 type Repo interface {
-	GetInvoices(opts *QueryOptions) (invoices []*Invoice, err error)
-	GetInvoiceById(id int) (*Invoice, error)
+	GetInvoices(tenant string, opts *QueryOptions) (invoices []*Invoice, err error)
+	GetInvoiceById(tenant string, id int) (*Invoice, error)
 	InsertInvoice(i Invoice) (id int64, err error)
-	DeleteInvoice(id int) (nRows int64, err error)
-	UpdateInvoice(id int, newDescription string) (nRows int64, err error)
-	CountInvoices(opts *QueryOptions) (count int, err error)
+	// DeleteInvoice deactivates a draft. Other invoices only end by being
+	// voided or refunded, and fail with InvoiceNotDraft.
+	DeleteInvoice(tenant string, id int, version int) (nRows int64, err error)
+	UpdateInvoice(tenant string, id int, version int, fields InvoiceFields) (nRows int64, err error)
+	ModifyInvoice(tenant string, id int, version int, modify func(*Invoice) (InvoiceFields, error)) error
+	CountInvoices(tenant string, opts *QueryOptions) (count int, err error)
+	AggregateInvoices(tenant string, opts *AggregateOptions) (groups []*Group, count int, err error)
 }
 
-var InvoiceNotFound = errors.New("id not found")
+var (
+	InvoiceNotFound  = errors.New("id not found")
+	NoFieldsToUpdate = errors.New("no fields to update")
+	VersionConflict  = errors.New("invoice version does not match")
+	InvoiceIdTaken   = errors.New("invoice id already in use")
+)
 
 type QueryOptions struct {
-	Filters    map[string]string
-	Sorts      []Sort
-	Pagination Pagination
+	Filters         Filter
+	IncludeInactive bool
+	Sorts           []Sort
+	Pagination      Pagination
+	Fields          []string
+	Cursor          *Cursor
 }
 
 type Sort struct {
@@ -0,0 +1,1322 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testRepos returns one empty instance of every Repo implementation that can
+// run inside the test process, keyed by a name used in failure messages.
+// PostgreSQL is included when GORFIV_TEST_POSTGRES points to a throwaway
+// database, e.g. "postgres://postgres@localhost/gorfiv_test?sslmode=disable".
+func testRepos(t *testing.T) map[string]Repo {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to ":memory:" opens a brand new database
+	db.SetMaxOpenConns(1)
+	if _, err = NewMigrator(db, SQLite).Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	repos := map[string]Repo{
+		"memory": NewMemoryRepo(),
+		"sqlite": NewSQLRepo(db, SQLite),
+	}
+
+	if dsn := os.Getenv("GORFIV_TEST_POSTGRES"); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewMigrator(db, Postgres).Up(); err != nil {
+			t.Fatal(err)
+		}
+		repos["postgres"] = NewSQLRepo(db, Postgres)
+	}
+
+	return repos
+}
+
+// insertInvoices inserts invoices numbered 1, 2... unless they already have
+// an id, so that tests can tell them apart.
+func insertInvoices(t *testing.T, repo Repo, invoices ...Invoice) {
+	for k, i := range invoices {
+		if i.Id == 0 {
+			i.Id = k + 1
+		}
+		if _, err := repo.InsertInvoice(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func eq(field string, value interface{}) *Condition {
+	return &Condition{Field: field, Op: OpEq, Values: []interface{}{value}}
+}
+
+func invoiceIds(invoices []*Invoice) (ids []int) {
+	for _, i := range invoices {
+		ids = append(ids, i.Id)
+	}
+	return
+}
+
+func assertIds(t *testing.T, id interface{}, ids []int, expectedIds ...int) {
+	if len(ids) != len(expectedIds) {
+		t.Errorf("%v: ids should have been %v, but were %v instead.", id, expectedIds, ids)
+		return
+	}
+	for k := range ids {
+		if ids[k] != expectedIds[k] {
+			t.Errorf("%v: ids should have been %v, but were %v instead.", id, expectedIds, ids)
+			return
+		}
+	}
+}
+
+func TestRepoInsertAssignsRandomIds(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		seen := map[int64]bool{}
+		for k := 0; k < 20; k++ {
+			id, err := repo.InsertInvoice(Invoice{Document: "c", IsActive: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id < 1 || id >= maxInvoiceId || seen[id] {
+				t.Errorf("%v: id should have been a new id between 1 and 2^53, but was %v instead.", name, id)
+			}
+			seen[id] = true
+
+			invoice, err := repo.GetInvoiceById("", int(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if invoice.Document != "c" {
+				t.Errorf("%v: document should have been \"c\", but was %q instead.", name, invoice.Document)
+			}
+		}
+
+		insertInvoices(t, repo, Invoice{Id: 7, IsActive: true})
+		if _, err := repo.InsertInvoice(Invoice{Id: 7, TenantId: "other", IsActive: true}); err != InvoiceIdTaken {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceIdTaken, err)
+		}
+
+		// a random id that is taken is drawn again
+		ids := []int{7, 8}
+		drawInvoiceId = func() (int, error) {
+			id := ids[0]
+			ids = ids[1:]
+			return id, nil
+		}
+		id, err := repo.InsertInvoice(Invoice{TenantId: "other", IsActive: true})
+		drawInvoiceId = NewInvoiceId
+		if err != nil || id != 8 {
+			t.Errorf("%v: id should have been 8, but was %v (%v) instead.", name, id, err)
+		}
+	}
+}
+
+func TestRepoSoftDelete(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo, Invoice{Document: "a", IsActive: true}, Invoice{Document: "b", IsActive: true})
+
+		nRows, err := repo.DeleteInvoice("", 1, 0)
+		if err != nil || nRows != 1 {
+			t.Fatalf("%v: DeleteInvoice(1) = %v, %v", name, nRows, err)
+		}
+		if nRows, _ = repo.DeleteInvoice("", 1, 0); nRows != 0 {
+			t.Errorf("%v: deleting twice should affect 0 rows, but affected %v.", name, nRows)
+		}
+		if _, err = repo.GetInvoiceById("", 1); err != InvoiceNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+		}
+		if nRows, _ = repo.UpdateInvoice("", 1, 0, InvoiceFields{"description": "x"}); nRows != 0 {
+			t.Errorf("%v: updating a deleted invoice should affect 0 rows, but affected %v.", name, nRows)
+		}
+
+		count, err := repo.CountInvoices("", &QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%v: count should have been 1, but was %v instead.", name, count)
+		}
+	}
+}
+
+func TestRepoUpdateInvoice(t *testing.T) {
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo, Invoice{Document: "a", Description: "d", Amount: 100, IsActive: true, CreatedAt: createdAt})
+
+		nRows, err := repo.UpdateInvoice("", 1, 0, InvoiceFields{"document": "b", "amount": Money(4242)})
+		if err != nil || nRows != 1 {
+			t.Fatalf("%v: UpdateInvoice(1) = %v, %v", name, nRows, err)
+		}
+		// matched rows are reported even when nothing changes
+		if nRows, _ = repo.UpdateInvoice("", 1, 0, InvoiceFields{"document": "b"}); nRows != 1 {
+			t.Errorf("%v: an unchanged update should affect 1 row, but affected %v.", name, nRows)
+		}
+		if nRows, _ = repo.UpdateInvoice("", 2, 0, InvoiceFields{"document": "b"}); nRows != 0 {
+			t.Errorf("%v: updating a missing invoice should affect 0 rows, but affected %v.", name, nRows)
+		}
+
+		invoice, err := repo.GetInvoiceById("", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invoice.Document != "b" || invoice.Description != "d" || invoice.Amount != 4242 {
+			t.Errorf("%v: invoice should have been updated, but was %+v.", name, invoice)
+		}
+		if !invoice.UpdatedAt.After(createdAt) {
+			t.Errorf("%v: updatedAt should have advanced past %v, but was %v instead.", name, createdAt, invoice.UpdatedAt)
+		}
+
+		for _, fields := range []InvoiceFields{{}, {"id": 2}, {"isActive": false}, {"amount": "1"}, {"amount": 1.5}, {"amount": MaxMoney + 1}} {
+			if _, err = repo.UpdateInvoice("", 1, 0, fields); err == nil {
+				t.Errorf("%v %v: expected an error, but received none.", name, fields)
+			}
+		}
+	}
+}
+
+func TestRepoModifyInvoice(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo, Invoice{Document: "a", Amount: 100, IsActive: true})
+
+		err := repo.ModifyInvoice("", 1, 0, func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"amount": i.Amount + 100}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		failure := errors.New("failure")
+		err = repo.ModifyInvoice("", 1, 0, func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"amount": Money(10000)}, failure
+		})
+		if err != failure {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, failure, err)
+		}
+
+		invoice, _ := repo.GetInvoiceById("", 1)
+		if invoice.Amount != 200 {
+			t.Errorf("%v: amount should have been 2.00, but was %v instead.", name, invoice.Amount)
+		}
+
+		err = repo.ModifyInvoice("", 2, 0, func(i *Invoice) (InvoiceFields, error) {
+			t.Errorf("%v: modify should not be called for a missing invoice.", name)
+			return nil, nil
+		})
+		if err != InvoiceNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+		}
+	}
+}
+
+func TestRepoVersionCompareAndSwap(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo, Invoice{Document: "a", IsActive: true})
+		noop := func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"description": "x"}, nil
+		}
+
+		invoice, _ := repo.GetInvoiceById("", 1)
+		if invoice.Version != 1 {
+			t.Errorf("%v: version should have been 1, but was %v instead.", name, invoice.Version)
+		}
+
+		if nRows, err := repo.UpdateInvoice("", 1, 1, InvoiceFields{"document": "b"}); err != nil || nRows != 1 {
+			t.Errorf("%v: UpdateInvoice with the right version = %v, %v", name, nRows, err)
+		}
+		if _, err := repo.UpdateInvoice("", 1, 1, InvoiceFields{"document": "c"}); err != VersionConflict {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, VersionConflict, err)
+		}
+		if err := repo.ModifyInvoice("", 1, 1, noop); err != VersionConflict {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, VersionConflict, err)
+		}
+		if err := repo.ModifyInvoice("", 1, 2, noop); err != nil {
+			t.Errorf("%v: ModifyInvoice with the right version failed: %v", name, err)
+		}
+		if _, err := repo.DeleteInvoice("", 1, 2); err != VersionConflict {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, VersionConflict, err)
+		}
+		if nRows, err := repo.UpdateInvoice("", 2, 1, InvoiceFields{"document": "c"}); err != nil || nRows != 0 {
+			t.Errorf("%v: UpdateInvoice of a missing invoice = %v, %v", name, nRows, err)
+		}
+
+		invoice, _ = repo.GetInvoiceById("", 1)
+		if invoice.Version != 3 || invoice.Document != "b" {
+			t.Errorf("%v: invoice should be at version 3 with document b, but was %+v.", name, invoice)
+		}
+		if nRows, err := repo.DeleteInvoice("", 1, 3); err != nil || nRows != 1 {
+			t.Errorf("%v: DeleteInvoice with the right version = %v, %v", name, nRows, err)
+		}
+	}
+}
+
+func TestRepoQueryOptions(t *testing.T) {
+	now := time.Now()
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo,
+			Invoice{Document: "b", ReferenceMonth: 1, ReferenceYear: 2016, CreatedAt: now, IsActive: true},
+			Invoice{Document: "a", ReferenceMonth: 2, ReferenceYear: 2016, CreatedAt: now, IsActive: true},
+			Invoice{Document: "a", ReferenceMonth: 1, ReferenceYear: 2015, CreatedAt: now, IsActive: true},
+			Invoice{Document: "c", ReferenceMonth: 3, ReferenceYear: 2016, CreatedAt: now, IsActive: true},
+			Invoice{Document: "a", ReferenceMonth: 3, ReferenceYear: 2016, CreatedAt: now, IsActive: true},
+		)
+		repo.DeleteInvoice("", 4, 0)
+
+		var cases = []struct {
+			opts        QueryOptions
+			expectedIds []int
+			count       int
+		}{
+			{QueryOptions{Pagination: Pagination{Page: 1, PerPage: 10}}, []int{1, 2, 3, 5}, 4},
+			{QueryOptions{
+				Sorts:      []Sort{{Field: "id"}},
+				Pagination: Pagination{Page: 2, PerPage: 3},
+			}, []int{5}, 4},
+			{QueryOptions{Pagination: Pagination{Page: 3, PerPage: 3}}, nil, 4},
+			{QueryOptions{
+				Filters:    And{eq("document", "a")},
+				Pagination: Pagination{Page: 1, PerPage: 10},
+			}, []int{2, 3, 5}, 3},
+			{QueryOptions{
+				Filters:    And{eq("referenceYear", 2016), eq("referenceMonth", 1)},
+				Pagination: Pagination{Page: 1, PerPage: 10},
+			}, []int{1}, 1},
+			{QueryOptions{
+				Sorts:      []Sort{{Field: "document"}, {Field: "referenceMonth", Desc: true}},
+				Pagination: Pagination{Page: 1, PerPage: 10},
+			}, []int{5, 2, 3, 1}, 4},
+			{QueryOptions{
+				Sorts:      []Sort{{Field: "referenceYear", Desc: true}, {Field: "document", Desc: true}, {Field: "id"}},
+				Pagination: Pagination{Page: 1, PerPage: 2},
+			}, []int{1, 2}, 4},
+		}
+
+		for _, c := range cases {
+			invoices, err := repo.GetInvoices("", &c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertIds(t, name, invoiceIds(invoices), c.expectedIds...)
+
+			count, err := repo.CountInvoices("", &c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != c.count {
+				t.Errorf("%v %v: count should have been %v, but was %v instead.", name, c.opts, c.count, count)
+			}
+		}
+	}
+}
+
+func TestRepoFilters(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2016, 1, d, 12, 0, 0, 0, time.UTC) }
+	cond := func(field string, op Operator, values ...string) *Condition {
+		c, err := NewCondition(field, op, values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	parse := func(expr string) Filter {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo,
+			Invoice{Document: "a", Description: "Monthly FEE", Amount: 1000, CreatedAt: day(1), IsActive: true},
+			Invoice{Document: "b", Description: "100% off", Amount: 2050, CreatedAt: day(2), IsActive: true},
+			Invoice{Document: "c", Description: "fee_2", Amount: 3000, CreatedAt: day(3), IsActive: true},
+			Invoice{Document: "a", Description: "other", Amount: 4000, CreatedAt: day(4), IsActive: true},
+		)
+		repo.DeleteInvoice("", 4, 0)
+
+		var cases = []struct {
+			filter          Filter
+			includeInactive bool
+			expectedIds     []int
+		}{
+			{cond("amount", OpGte, "20.5"), false, []int{2, 3}},
+			{cond("amount", OpGt, "20.5"), true, []int{3, 4}},
+			{And{cond("amount", OpGt, "5"), cond("amount", OpLt, "30")}, false, []int{1, 2}},
+			{cond("createdAt", OpLt, "2016-01-02"), false, []int{1}},
+			{cond("createdAt", OpGte, "2016-01-02T12:00:00Z"), false, []int{2, 3}},
+			{cond("document", OpIn, "a", "c"), false, []int{1, 3}},
+			{cond("document", OpIn, "a", "c"), true, []int{1, 3, 4}},
+			{cond("description", OpContains, "fee"), false, []int{1, 3}},
+			{cond("description", OpContains, "%"), false, []int{2}},
+			{cond("description", OpContains, "e_"), false, []int{3}},
+			{And{}, true, []int{1, 2, 3, 4}},
+			{Or{}, true, nil},
+			{parse("amount gt 15 and (document eq 'a' or description contains 'FEE')"), true, []int{3, 4}},
+			{parse("not document in ('a', 'b') or amount eq 10"), false, []int{1, 3}},
+			{parse("document ne 'a' and createdAt lte '2016-01-02T12:00:00Z'"), false, []int{2}},
+		}
+		for _, c := range cases {
+			opts := QueryOptions{
+				Filters:         c.filter,
+				IncludeInactive: c.includeInactive,
+				Sorts:           []Sort{{Field: "id"}},
+				Pagination:      Pagination{Page: 1, PerPage: 10},
+			}
+			invoices, err := repo.GetInvoices("", &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertIds(t, fmt.Sprint(name, " ", c.filter), invoiceIds(invoices), c.expectedIds...)
+
+			count, err := repo.CountInvoices("", &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(c.expectedIds) {
+				t.Errorf("%v %v: count should have been %v, but was %v instead.", name, c.filter, len(c.expectedIds), count)
+			}
+		}
+	}
+}
+
+func TestRepoFieldProjection(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo,
+			Invoice{Document: "b", Description: "x", Amount: 150, ReferenceYear: 2016, IsActive: true},
+			Invoice{Document: "a", Description: "y", Amount: 250, ReferenceYear: 2017, IsActive: true},
+		)
+
+		opts := QueryOptions{
+			Fields:     []string{"amount"},
+			Sorts:      []Sort{{Field: "document"}},
+			Pagination: Pagination{Page: 1, PerPage: 10},
+		}
+		invoices, err := repo.GetInvoices("", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, name, invoiceIds(invoices), 2, 1)
+		for k, expected := range []Invoice{{Document: "a", Amount: 250}, {Document: "b", Amount: 150}} {
+			if invoices[k].Document != expected.Document || invoices[k].Amount != expected.Amount {
+				t.Errorf("%v: invoice %v should have had document %v and amount %v, but was %+v instead.", name, k, expected.Document, expected.Amount, invoices[k])
+			}
+		}
+
+		opts.Fields = []string{"amount", "tenantId"}
+		if _, err = repo.GetInvoices("", &opts); err == nil {
+			t.Errorf("%v: the unknown field tenantId should have been rejected.", name)
+		}
+	}
+}
+
+func TestRepoAggregate(t *testing.T) {
+	metrics := []Metric{{Func: MetricSum, Field: "amount"}, {Func: MetricCount}, {Func: MetricAvg, Field: "amount"}, {Func: MetricMax, Field: "amount"}}
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo,
+			Invoice{Document: "a", Amount: 100, ReferenceMonth: 1, ReferenceYear: 2016, IsActive: true},
+			Invoice{Document: "b", Amount: 200, ReferenceMonth: 1, ReferenceYear: 2016, IsActive: true},
+			Invoice{Document: "a", Amount: 400, ReferenceMonth: 2, ReferenceYear: 2016, IsActive: true},
+			Invoice{Document: "a", Amount: 800, ReferenceMonth: 1, ReferenceYear: 2017, IsActive: true},
+			Invoice{Document: "c", Amount: 1600, ReferenceMonth: 1, ReferenceYear: 2017, IsActive: true},
+		)
+		repo.DeleteInvoice("", 5, 0)
+
+		var cases = []struct {
+			opts     AggregateOptions
+			expected string
+			count    int
+		}{
+			{
+				AggregateOptions{GroupBy: []string{"referenceYear", "referenceMonth"}, Metrics: metrics},
+				"[2016 1]: 3.00 2 1.5 2.00; [2016 2]: 4.00 1 4 4.00; [2017 1]: 8.00 1 8 8.00; ", 3,
+			},
+			{
+				AggregateOptions{QueryOptions: QueryOptions{Sorts: []Sort{{Field: "sum(amount)", Desc: true}}}, GroupBy: []string{"document"}, Metrics: metrics[:2]},
+				"[a]: 13.00 3; [b]: 2.00 1; ", 2,
+			},
+			{
+				AggregateOptions{QueryOptions: QueryOptions{IncludeInactive: true, Sorts: []Sort{{Field: "document", Desc: true}}}, GroupBy: []string{"document"}, Metrics: metrics[1:2]},
+				"[c]: 1; [b]: 1; [a]: 3; ", 3,
+			},
+			{
+				AggregateOptions{QueryOptions: QueryOptions{Pagination: Pagination{Page: 2, PerPage: 2}}, GroupBy: []string{"referenceMonth", "document"}, Metrics: metrics[1:2]},
+				"[2 a]: 1; ", 3,
+			},
+			{AggregateOptions{Metrics: metrics}, "[]: 15.00 4 3.75 8.00; ", 1},
+			{
+				AggregateOptions{QueryOptions: QueryOptions{Filters: And{eq("document", "x")}}, Metrics: metrics},
+				"[]: 0.00 0 <nil> <nil>; ", 1,
+			},
+			{
+				AggregateOptions{QueryOptions: QueryOptions{Filters: And{eq("document", "x")}}, GroupBy: []string{"document"}, Metrics: metrics},
+				"", 0,
+			},
+		}
+		for _, c := range cases {
+			if c.opts.Pagination.PerPage == 0 {
+				c.opts.Pagination = Pagination{Page: 1, PerPage: 10}
+			}
+			groups, count, err := repo.AggregateInvoices("", &c.opts)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			var actual strings.Builder
+			for _, g := range groups {
+				fmt.Fprintf(&actual, "%v:", g.Keys)
+				for _, v := range g.Values {
+					if v == nil {
+						actual.WriteString(" <nil>")
+					} else {
+						fmt.Fprintf(&actual, " %v", v)
+					}
+				}
+				actual.WriteString("; ")
+			}
+			if actual.String() != c.expected || count != c.count {
+				t.Errorf("%v %v: groups should have been %q (%v), but were %q (%v) instead.", name, c.opts.GroupBy, c.expected, c.count, actual.String(), count)
+			}
+		}
+
+		for _, opts := range []AggregateOptions{
+			{},
+			{GroupBy: []string{"amount"}, Metrics: metrics},
+			{GroupBy: []string{"document", "document"}, Metrics: metrics},
+			{Metrics: []Metric{{Func: MetricSum, Field: "document"}}},
+			{Metrics: []Metric{{Func: "median", Field: "amount"}}},
+			{QueryOptions: QueryOptions{Sorts: []Sort{{Field: "document"}}}, Metrics: metrics},
+			{QueryOptions: QueryOptions{Sorts: []Sort{{Field: "sum(amount) ; DROP TABLE Invoice"}}}, Metrics: metrics},
+		} {
+			opts.Pagination = Pagination{Page: 1, PerPage: 10}
+			if _, _, err := repo.AggregateInvoices("", &opts); err == nil {
+				t.Errorf("%v %+v: the aggregate should have been rejected.", name, opts)
+			}
+		}
+	}
+}
+
+func TestRepoMoneyIsExact(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo, Invoice{Document: "a", Amount: 10, IsActive: true})
+		err := repo.ModifyInvoice("", 1, 0, func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"amount": i.Amount + 20}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoice, err := repo.GetInvoiceById("", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invoice.Amount.String() != "0.30" {
+			t.Errorf("%v: 0.10 + 0.20 should have been 0.30, but was %v instead.", name, invoice.Amount)
+		}
+
+		if _, err = repo.UpdateInvoice("", 1, 0, InvoiceFields{"amount": Money(123456789012345)}); err != nil {
+			t.Fatal(err)
+		}
+		opts := QueryOptions{Filters: And{eq("amount", Money(123456789012345))}, Pagination: Pagination{Page: 1, PerPage: 1}}
+		invoices, err := repo.GetInvoices("", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(invoices) != 1 || invoices[0].Amount.String() != "1234567890123.45" {
+			t.Errorf("%v: the amount 1234567890123.45 should have been found, but got %v instead.", name, invoices)
+		}
+	}
+}
+
+func TestRepoCurrency(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo,
+			Invoice{Document: "a", Amount: 1050, IsActive: true},
+			Invoice{Document: "b", Amount: 1000, Currency: "JPY", IsActive: true},
+		)
+		if invoice, err := repo.GetInvoiceById("", 1); err != nil || invoice.Currency != DefaultCurrency {
+			t.Errorf("%v: currency should have defaulted to %v, but got %+v (%v).", name, DefaultCurrency, invoice, err)
+		}
+
+		var cases = []struct {
+			id     int
+			fields InvoiceFields
+			err    error
+		}{
+			{2, InvoiceFields{"amount": Money(1050)}, AmountTooPrecise},
+			{2, InvoiceFields{"amount": Money(2000)}, nil},
+			{1, InvoiceFields{"amount": Money(1050), "currency": "JPY"}, AmountTooPrecise},
+			{1, InvoiceFields{"amount": Money(1050), "currency": "USD"}, nil},
+			{1, InvoiceFields{"currency": "XYZ"}, UnknownCurrency},
+		}
+		for _, c := range cases {
+			_, err := repo.UpdateInvoice("", c.id, 0, c.fields)
+			if (err == nil) != (c.err == nil) || (err != nil && !strings.HasPrefix(err.Error(), c.err.Error())) {
+				t.Errorf("%v %v: error should have been %v, but was %v instead.", name, c.fields, c.err, err)
+			}
+		}
+		err := repo.ModifyInvoice("", 2, 0, func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"amount": i.Amount + 1}, nil
+		})
+		if err != AmountTooPrecise {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, AmountTooPrecise, err)
+		}
+
+		opts := QueryOptions{Filters: And{eq("currency", "USD")}, Pagination: Pagination{Page: 1, PerPage: 10}}
+		invoices, err := repo.GetInvoices("", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, name, invoiceIds(invoices), 1)
+		if invoices[0].Amount != 1050 {
+			t.Errorf("%v: amount should have been 10.50, but was %v instead.", name, invoices[0].Amount)
+		}
+
+		metrics := []Metric{{Func: MetricSum, Field: "amount"}}
+		aggregates := []struct {
+			opts AggregateOptions
+			err  error
+		}{
+			{AggregateOptions{Metrics: metrics}, MixedCurrencies},
+			{AggregateOptions{GroupBy: []string{"document"}, Metrics: metrics}, nil},
+			{AggregateOptions{GroupBy: []string{"currency"}, Metrics: metrics}, nil},
+			{AggregateOptions{QueryOptions: QueryOptions{Filters: And{eq("currency", "JPY")}}, Metrics: metrics}, nil},
+			{AggregateOptions{Metrics: []Metric{{Func: MetricCount}}}, nil},
+		}
+		for _, c := range aggregates {
+			c.opts.Pagination = Pagination{Page: 1, PerPage: 10}
+			if _, _, err := repo.AggregateInvoices("", &c.opts); err != c.err {
+				t.Errorf("%v %v: error should have been %v, but was %v instead.", name, c.opts, c.err, err)
+			}
+		}
+	}
+}
+
+func TestRepoFXRateStore(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		store := repo.(FXRateStore)
+		err := store.UpsertFXRates([]FXRate{
+			{Date: "2016-01-01", From: "USD", To: "BRL", Rate: 390000000},
+			{Date: "2016-02-01", From: "USD", To: "BRL", Rate: 400000000},
+			{Date: "2016-01-15", From: "EUR", To: "BRL", Rate: 430000000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// replaces the rate of the same day
+		if err = store.UpsertFXRates([]FXRate{{Date: "2016-02-01", From: "USD", To: "BRL", Rate: 410000000}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.UpsertFXRates([]FXRate{{Date: "2016-03-01", From: "USD", To: "BRL", Rate: 1}, {Date: "x", From: "USD", To: "BRL", Rate: 1}}); err == nil {
+			t.Errorf("%v: an invalid rate should have been rejected.", name)
+		}
+
+		var cases = []struct {
+			from, to, date string
+			expected       string
+		}{
+			{"USD", "BRL", "2016-01-31", "2016-01-01 3.9"},
+			{"USD", "BRL", "2016-02-01", "2016-02-01 4.1"},
+			{"USD", "BRL", "2017-01-01", "2016-02-01 4.1"},
+			{"USD", "BRL", "2015-12-31", ""},
+			{"BRL", "USD", "2016-02-01", ""},
+			{"EUR", "BRL", "2016-02-01", "2016-01-15 4.3"},
+		}
+		for _, c := range cases {
+			rate, err := store.FindFXRate(c.from, c.to, c.date)
+			actual := ""
+			if err == nil {
+				actual = rate.Date + " " + rate.Rate.String()
+			} else if err != FXRateNotFound {
+				t.Fatal(err)
+			}
+			if actual != c.expected {
+				t.Errorf("%v %v: rate should have been %q, but was %q instead.", name, c, c.expected, actual)
+			}
+		}
+	}
+}
+
+// lineItemsString writes items as "id:quantity*unitPrice-discount=total",
+// separated by spaces.
+func lineItemsString(items []LineItem) string {
+	var lines []string
+	for _, item := range items {
+		lines = append(lines, fmt.Sprintf("%d:%d*%v-%v=%v", item.Id, item.Quantity, item.UnitPrice, item.Discount, item.Total))
+	}
+	return strings.Join(lines, " ")
+}
+
+func TestRepoMoneyRoundTrip(t *testing.T) {
+	maxRate, _ := ParseRate("9999999999.99999999")
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo,
+			Invoice{Id: 1, Amount: MaxMoney, Currency: "BRL", IsActive: true},
+			Invoice{Id: 2, Amount: -MaxMoney, Currency: "BRL", IsActive: true},
+			Invoice{Id: 3, Amount: MaxMoney, Currency: "BRL", IsActive: true},
+		)
+		for _, id := range []int{1, 2} {
+			invoice, err := repo.GetInvoiceById("", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, items, err := repo.(LineItemStore).GetLineItems("", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []Money{MaxMoney, -MaxMoney}[id-1]
+			if invoice.Amount != expected || len(items) != 1 || items[0].UnitPrice != expected {
+				t.Errorf("%v %v: amount should have been %v, but was %v (items %+v) instead.", name, id, expected, invoice.Amount, items)
+			}
+		}
+
+		invoices, err := repo.GetInvoices("", &QueryOptions{Filters: And{eq("amount", MaxMoney)}, Pagination: Pagination{Page: 1, PerPage: 5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, name, invoiceIds(invoices), 1, 3)
+
+		groups, _, err := repo.AggregateInvoices("", &AggregateOptions{
+			QueryOptions: QueryOptions{Filters: And{eq("amount", MaxMoney)}, Pagination: Pagination{Page: 1, PerPage: 5}},
+			Metrics:      []Metric{{Func: MetricSum, Field: "amount"}, {Func: MetricMax, Field: "amount"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprint(groups[0].Values); actual != "[199999999999999.98 99999999999999.99]" {
+			t.Errorf("%v: metrics should have been [199999999999999.98 99999999999999.99], but were %v instead.", name, actual)
+		}
+
+		store := repo.(FXRateStore)
+		if err = store.UpsertFXRates([]FXRate{{Date: "2016-01-01", From: "USD", To: "BRL", Rate: maxRate}}); err != nil {
+			t.Fatal(err)
+		}
+		if rate, err := store.FindFXRate("USD", "BRL", "2016-01-01"); err != nil || rate.Rate != maxRate {
+			t.Errorf("%v: rate should have been %v, but was %+v (%v) instead.", name, maxRate, rate, err)
+		}
+	}
+}
+
+func TestComputeMetricSumRange(t *testing.T) {
+	invoices := make([]*Invoice, 100)
+	for k := range invoices {
+		invoices[k] = &Invoice{Amount: MaxMoney}
+	}
+	sum, err := computeMetric(Metric{Func: MetricSum, Field: "amount"}, invoices)
+	if expected := "9999999999999999.00"; err != nil || fmt.Sprint(sum) != expected {
+		t.Errorf("sum should have been %v, but was %v (%v) instead.", expected, sum, err)
+	}
+	invoices = append(invoices, &Invoice{Amount: MaxMoney})
+	if _, err = computeMetric(Metric{Func: MetricSum, Field: "amount"}, invoices); err != MoneyOutOfRange {
+		t.Errorf("error should have been %v, but was %v instead.", MoneyOutOfRange, err)
+	}
+}
+
+func TestRepoLineItems(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		store := repo.(LineItemStore)
+		insertInvoices(t, repo,
+			Invoice{Description: "fee", Amount: 1050, IsActive: true},
+			Invoice{TenantId: "other", Amount: 1050, IsActive: true},
+		)
+		assertItems := func(step string, expected string, amount Money, version int) {
+			invoice, items, err := store.GetLineItems("", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := lineItemsString(items); actual != expected || invoice.Amount != amount || invoice.Version != version {
+				t.Errorf("%v %v: items should have been %q adding up to %v at version %v, but were %q adding up to %v at version %v instead.",
+					name, step, expected, amount, version, actual, invoice.Amount, invoice.Version)
+			}
+		}
+
+		// an invoice inserted with an amount has a single item of it
+		assertItems("insert", "1:1*10.50-0.00=10.50", 1050, 1)
+		if _, items, _ := store.GetLineItems("", 1); items[0].Description != "fee" {
+			t.Errorf("%v: description should have been \"fee\", but was %q instead.", name, items[0].Description)
+		}
+
+		items, err := store.ModifyLineItems("", 1, 1, func(i *Invoice, items []LineItem) ([]LineItem, error) {
+			return append(items, LineItem{Description: "a", Quantity: 3, UnitPrice: 1000, Discount: 500}, LineItem{Quantity: 1, UnitPrice: 250}), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 3 || items[2].Id != 3 {
+			t.Errorf("%v: the new items should have been numbered 2 and 3, but got %v.", name, lineItemsString(items))
+		}
+		assertItems("append", "1:1*10.50-0.00=10.50 2:3*10.00-5.00=25.00 3:1*2.50-0.00=2.50", 3800, 2)
+
+		var invalid = []LineItem{
+			{Quantity: 0, UnitPrice: 100},
+			{Quantity: MAX_QUANTITY + 1, UnitPrice: 100},
+			{Quantity: 2, UnitPrice: 100, Discount: 201},
+			{Quantity: 1, UnitPrice: 100, Discount: -1},
+			{Quantity: 1, UnitPrice: -100, Discount: 1},
+			{Quantity: 1, UnitPrice: MaxMoney + 1},
+			{Quantity: 2, UnitPrice: MaxMoney},
+			{Quantity: 1, UnitPrice: MaxMoney},
+			{Quantity: 1, UnitPrice: 100, Description: strings.Repeat("x", DESCRIPTION_MAX_LENGTH+1)},
+		}
+		for _, item := range invalid {
+			_, err := store.ModifyLineItems("", 1, 0, func(i *Invoice, items []LineItem) ([]LineItem, error) {
+				return append(items, item), nil
+			})
+			if _, ok := err.(*LineItemsError); !ok {
+				t.Errorf("%v %+v: error should have been a *LineItemsError, but was %v instead.", name, item, err)
+			}
+		}
+		if _, err = store.ModifyLineItems("", 1, 1, func(i *Invoice, items []LineItem) ([]LineItem, error) { return nil, nil }); err != VersionConflict {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, VersionConflict, err)
+		}
+		if _, _, err = store.GetLineItems("other", 1); err != InvoiceNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+		}
+		assertItems("invalid", "1:1*10.50-0.00=10.50 2:3*10.00-5.00=25.00 3:1*2.50-0.00=2.50", 3800, 2)
+
+		// the amount of several items can only be set to their total
+		var updates = []struct {
+			fields InvoiceFields
+			err    error
+		}{
+			{InvoiceFields{"amount": Money(100)}, AmountIsComputed},
+			{InvoiceFields{"currency": "JPY"}, &LineItemsError{}},
+			{InvoiceFields{"amount": Money(3800), "document": "b"}, nil},
+		}
+		for _, c := range updates {
+			_, err := repo.UpdateInvoice("", 1, 0, c.fields)
+			if _, ok := c.err.(*LineItemsError); ok {
+				_, ok = err.(*LineItemsError)
+				if !ok {
+					t.Errorf("%v %v: error should have been a *LineItemsError, but was %v instead.", name, c.fields, err)
+				}
+			} else if err != c.err {
+				t.Errorf("%v %v: error should have been %v, but was %v instead.", name, c.fields, c.err, err)
+			}
+		}
+		assertItems("update", "1:1*10.50-0.00=10.50 2:3*10.00-5.00=25.00 3:1*2.50-0.00=2.50", 3800, 3)
+
+		// while there is a single item, setting the amount replaces it
+		if _, err = store.ModifyLineItems("", 1, 0, func(i *Invoice, items []LineItem) ([]LineItem, error) { return items[1:2], nil }); err != nil {
+			t.Fatal(err)
+		}
+		err = repo.ModifyInvoice("", 1, 0, func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"amount": Money(100)}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertItems("set amount", "2:1*1.00-0.00=1.00", 100, 5)
+		if _, items, _ := store.GetLineItems("", 1); items[0].Description != "a" {
+			t.Errorf("%v: description should have been kept, but was %q instead.", name, items[0].Description)
+		}
+
+		if _, err = store.ModifyLineItems("", 1, 0, func(i *Invoice, items []LineItem) ([]LineItem, error) { return nil, nil }); err != nil {
+			t.Fatal(err)
+		}
+		assertItems("clear", "", 0, 6)
+		if _, err = repo.UpdateInvoice("", 1, 0, InvoiceFields{"amount": Money(700), "description": "new"}); err != nil {
+			t.Fatal(err)
+		}
+		assertItems("set amount of no items", "1:1*7.00-0.00=7.00", 700, 7)
+	}
+}
+
+func TestRepoTaxes(t *testing.T) {
+	jan := time.Date(2016, 1, 15, 12, 0, 0, 0, time.UTC)
+	for name, repo := range testRepos(t) {
+		store := repo.(TaxStore)
+		insertInvoices(t, repo, Invoice{Id: 1, CreatedAt: jan, Amount: 10000, IsActive: true})
+		store.SetTaxEngine(TaxRules{
+			{Code: "ISS", Rate: 50000, EffectiveFrom: "2016-01-01", Scope: TaxPerInvoice, Inclusive: true, Rounding: RoundHalfUp},
+			{Code: "PIS", Rate: 6500, EffectiveFrom: "2016-01-01", Scope: TaxPerLine, Rounding: RoundDown},
+		})
+		insertInvoices(t, repo,
+			Invoice{Id: 2, CreatedAt: jan, Amount: 10000, IsActive: true},
+			Invoice{Id: 3, TenantId: "other", CreatedAt: jan, Amount: 10000, IsActive: true},
+		)
+		assertTaxes := func(step string, id int, expected string) {
+			invoice, taxes, err := store.GetInvoiceTaxes("", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored, _ := repo.GetInvoiceById("", id); !invoice.Equals(stored) {
+				t.Errorf("%v %v: invoice should have been %+v, but was %+v instead.", name, step, stored, invoice)
+			}
+			if actual := taxesString(taxes); actual != expected {
+				t.Errorf("%v %v: taxes should have been %q, but were %q instead.", name, step, expected, actual)
+			}
+			if len(taxes) > 0 && !taxes[0].Inclusive {
+				t.Errorf("%v %v: %v should have been inclusive.", name, step, taxes[0].Code)
+			}
+		}
+
+		// invoices created before there was an engine have no taxes
+		assertTaxes("before the engine", 1, "")
+		assertTaxes("insert", 2, "ISS 5% of 100.00 = 4.76, PIS 0.65% of 100.00 = 0.65")
+
+		_, err := repo.(LineItemStore).ModifyLineItems("", 2, 0, func(i *Invoice, items []LineItem) ([]LineItem, error) {
+			return append(items, LineItem{Quantity: 1, UnitPrice: 99}), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertTaxes("items", 2, "ISS 5% of 100.99 = 4.81, PIS 0.65% of 100.99 = 0.65")
+
+		// taxes are kept when the rules change, until the invoice does
+		store.SetTaxEngine(TaxRules{{Code: "VAT", Rate: 200000, EffectiveFrom: "2016-01-01", Scope: TaxPerInvoice, Rounding: RoundHalfUp}})
+		if _, err = repo.UpdateInvoice("", 2, 0, InvoiceFields{"document": "a"}); err != nil {
+			t.Fatal(err)
+		}
+		assertTaxes("document", 2, "ISS 5% of 100.99 = 4.81, PIS 0.65% of 100.99 = 0.65")
+		if _, err = repo.UpdateInvoice("", 2, 0, InvoiceFields{"currency": "USD"}); err != nil {
+			t.Fatal(err)
+		}
+		_, taxes, _ := store.GetInvoiceTaxes("", 2)
+		if actual := taxesString(taxes); actual != "VAT 20% of 100.99 = 20.20" || taxes[0].Inclusive {
+			t.Errorf("%v currency: taxes should have been %q, but were %+v instead.", name, "VAT 20% of 100.99 = 20.20", taxes)
+		}
+		err = repo.ModifyInvoice("", 1, 0, func(i *Invoice) (InvoiceFields, error) {
+			return InvoiceFields{"amount": Money(5000)}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, taxes, _ = store.GetInvoiceTaxes("", 1)
+		if actual := taxesString(taxes); actual != "VAT 20% of 50.00 = 10.00" {
+			t.Errorf("%v amount: taxes should have been %q, but were %q instead.", name, "VAT 20% of 50.00 = 10.00", actual)
+		}
+
+		if _, _, err = store.GetInvoiceTaxes("", 3); err != InvoiceNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+		}
+		if _, err = repo.DeleteInvoice("", 2, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = store.GetInvoiceTaxes("", 2); err != InvoiceNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+		}
+	}
+}
+
+func TestRepoStatus(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		store := repo.(StatusStore)
+		insertInvoices(t, repo,
+			Invoice{Id: 1, Document: "a", Amount: 10000, Currency: "BRL", IsActive: true},
+			Invoice{Id: 2, Document: "b", Amount: 10000, Currency: "BRL", IsActive: true},
+			Invoice{Id: 3, Document: "c", Amount: 10000, Currency: "BRL", IsActive: true},
+			Invoice{Id: 4, TenantId: "other", Amount: 10000, Currency: "BRL", IsActive: true},
+		)
+
+		invoice, err := store.TransitionInvoice("", 1, 1, EventIssue, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invoice.Status != StatusIssued || invoice.Version != 2 {
+			t.Errorf("%v: invoice should have been issued at version 2, but was %v at version %v instead.", name, invoice.Status, invoice.Version)
+		}
+		if invoice, err = store.TransitionInvoice("", 1, 0, EventPay, 2550); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := repo.GetInvoiceById("", 1)
+		if stored.Status != StatusPartiallyPaid || stored.AmountPaid != 2550 || !stored.Equals(invoice) {
+			t.Errorf("%v: invoice should have been partially_paid with 25.50 paid, but was %+v instead.", name, stored)
+		}
+
+		var errors = []struct {
+			id      int
+			version int
+			event   InvoiceEvent
+			payment Money
+			err     string
+		}{
+			{1, 0, EventIssue, 0, "illegal transition: issue can't happen to an invoice that is partially_paid"},
+			{1, 0, EventPay, 10000, "invalid payment: the payment cannot exceed the balance of 74.50"},
+			{1, 1, EventPay, 0, VersionConflict.Error()},
+			{4, 0, EventIssue, 0, InvoiceNotFound.Error()},
+		}
+		for _, c := range errors {
+			if _, err = store.TransitionInvoice("", c.id, c.version, c.event, c.payment); err == nil || err.Error() != c.err {
+				t.Errorf("%v %v %v: error should have been %q, but was %v instead.", name, c.id, c.event, c.err, err)
+			}
+		}
+
+		// only drafts can be changed
+		if _, err = repo.UpdateInvoice("", 1, 0, InvoiceFields{"document": "x"}); err != InvoiceNotDraft {
+			t.Errorf("%v update: error should have been %v, but was %v instead.", name, InvoiceNotDraft, err)
+		}
+		_, err = repo.(LineItemStore).ModifyLineItems("", 1, 0, func(i *Invoice, items []LineItem) ([]LineItem, error) {
+			return items, nil
+		})
+		if err != InvoiceNotDraft {
+			t.Errorf("%v items: error should have been %v, but was %v instead.", name, InvoiceNotDraft, err)
+		}
+		if _, err = repo.DeleteInvoice("", 1, 0); err != InvoiceNotDraft {
+			t.Errorf("%v delete: error should have been %v, but was %v instead.", name, InvoiceNotDraft, err)
+		}
+		if _, err = repo.DeleteInvoice("", 1, 1); err != VersionConflict {
+			t.Errorf("%v delete: error should have been %v, but was %v instead.", name, VersionConflict, err)
+		}
+		if _, err = repo.UpdateInvoice("", 2, 0, InvoiceFields{"document": "x"}); err != nil {
+			t.Errorf("%v: a draft should have been changed, but was not: %v", name, err)
+		}
+
+		if _, err = store.TransitionInvoice("", 3, 0, EventVoid, 0); err != nil {
+			t.Fatal(err)
+		}
+		opts := QueryOptions{
+			Filters:    And{&Condition{Field: "status", Op: OpIn, Values: []interface{}{"draft", "void"}}},
+			Sorts:      []Sort{{Field: "status", Desc: true}},
+			Pagination: Pagination{Page: 1, PerPage: 5},
+		}
+		invoices, err := repo.GetInvoices("", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(invoices) != 2 || invoices[0].Id != 3 || invoices[1].Id != 2 {
+			t.Errorf("%v: invoices should have been 3 and 2, but were %v instead.", name, invoices)
+		}
+	}
+}
+
+func TestRepoTenantIsolation(t *testing.T) {
+	tenants := map[string]int{"acme": 0, "globex": 10}
+	for name, repo := range testRepos(t) {
+		for tenant, offset := range tenants {
+			for k, document := range []string{"b", "a", "a", "c", "a", "b"} {
+				insertInvoices(t, repo, Invoice{
+					Id: offset + k + 1, TenantId: tenant, Document: document,
+					ReferenceMonth: k%3 + 1, ReferenceYear: 2015 + k%2, IsActive: true,
+				})
+			}
+		}
+
+		filters := []Filter{
+			nil,
+			And{eq("document", "a")},
+			And{eq("referenceYear", 2016)},
+			And{eq("document", "a"), eq("referenceMonth", 2)},
+		}
+		sorts := [][]Sort{
+			nil,
+			{{Field: "id", Desc: true}},
+			{{Field: "document"}, {Field: "id"}},
+			{{Field: "referenceMonth", Desc: true}, {Field: "referenceYear"}, {Field: "id"}},
+		}
+		paginations := []Pagination{{Page: 1, PerPage: 2}, {Page: 2, PerPage: 2}, {Page: 1, PerPage: 100}}
+
+		for tenant, offset := range tenants {
+			for _, f := range filters {
+				for _, s := range sorts {
+					for _, p := range paginations {
+						opts := &QueryOptions{Filters: f, Sorts: s, Pagination: p}
+						invoices, err := repo.GetInvoices(tenant, opts)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for _, i := range invoices {
+							if i.TenantId != tenant || i.Id <= offset || i.Id > offset+6 {
+								t.Errorf("%v %v %v: invoice %v of tenant %q should not have been listed.", name, tenant, opts, i.Id, i.TenantId)
+							}
+						}
+
+						count, err := repo.CountInvoices(tenant, opts)
+						if err != nil {
+							t.Fatal(err)
+						}
+						all, _ := repo.GetInvoices(tenant, &QueryOptions{Filters: f, Pagination: Pagination{Page: 1, PerPage: 100}})
+						if count != len(all) {
+							t.Errorf("%v %v %v: count should have been %v, but was %v instead.", name, tenant, opts, len(all), count)
+						}
+					}
+				}
+			}
+		}
+
+		if count, _ := repo.CountInvoices("", &QueryOptions{}); count != 0 {
+			t.Errorf("%v: the default tenant should have no invoices, but had %v.", name, count)
+		}
+
+		// invoice 1 belongs to acme; globex must not be able to tell it exists
+		if _, err := repo.GetInvoiceById("globex", 1); err != InvoiceNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+		}
+		for _, version := range []int{0, 1, 2} {
+			if nRows, err := repo.UpdateInvoice("globex", 1, version, InvoiceFields{"document": "x"}); err != nil || nRows != 0 {
+				t.Errorf("%v: UpdateInvoice of another tenant should affect 0 rows, but returned %v, %v.", name, nRows, err)
+			}
+			if err := repo.ModifyInvoice("globex", 1, version, func(i *Invoice) (InvoiceFields, error) {
+				return InvoiceFields{"document": "x"}, nil
+			}); err != InvoiceNotFound {
+				t.Errorf("%v: error should have been %v, but was %v instead.", name, InvoiceNotFound, err)
+			}
+			if nRows, err := repo.DeleteInvoice("globex", 1, version); err != nil || nRows != 0 {
+				t.Errorf("%v: DeleteInvoice of another tenant should affect 0 rows, but returned %v, %v.", name, nRows, err)
+			}
+		}
+		invoice, err := repo.GetInvoiceById("acme", 1)
+		if err != nil || invoice.Document != "b" || invoice.Version != 1 {
+			t.Errorf("%v: invoice 1 should have been left untouched, but was %+v (%v).", name, invoice, err)
+		}
+	}
+}
+
+func TestRepoKeysetPagination(t *testing.T) {
+	createdAt := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, repo := range testRepos(t) {
+		for k, document := range []string{"b", "a", "c", "a", "b", "a", "c"} {
+			insertInvoices(t, repo, Invoice{
+				Id: 10 * (k + 1), Document: document, Amount: Money(k % 3 * 100), ReferenceMonth: k%2 + 1,
+				CreatedAt: createdAt.Add(time.Duration(k%4) * time.Hour), IsActive: true,
+			})
+		}
+
+		for _, sorts := range [][]Sort{
+			nil,
+			{{Field: "document"}},
+			{{Field: "document", Desc: true}, {Field: "referenceMonth"}},
+			{{Field: "amount", Desc: true}, {Field: "createdAt"}},
+			{{Field: "id", Desc: true}},
+		} {
+			all, err := repo.GetInvoices("", &QueryOptions{Sorts: sorts, Pagination: Pagination{Page: 1, PerPage: 100}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedIds := invoiceIds(all)
+
+			// forwards, a cursor at a time
+			var ids []int
+			cursor := &Cursor{}
+			for page := 0; page < 10; page++ {
+				invoices, err := repo.GetInvoices("", &QueryOptions{Sorts: sorts, Pagination: Pagination{PerPage: 3}, Cursor: cursor})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(invoices) == 0 {
+					break
+				}
+				ids = append(ids, invoiceIds(invoices)...)
+				cursor = NewCursor(invoices[len(invoices)-1], sorts, false)
+			}
+			assertIds(t, []interface{}{name, sorts, "forwards"}, ids, expectedIds...)
+
+			// and backwards from the last row
+			ids = []int{expectedIds[len(expectedIds)-1]}
+			cursor = NewCursor(all[len(all)-1], sorts, true)
+			for page := 0; page < 10; page++ {
+				invoices, err := repo.GetInvoices("", &QueryOptions{Sorts: sorts, Pagination: Pagination{PerPage: 3}, Cursor: cursor})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(invoices) == 0 {
+					break
+				}
+				ids = append(invoiceIds(invoices), ids...)
+				cursor = NewCursor(invoices[0], sorts, true)
+			}
+			assertIds(t, []interface{}{name, sorts, "backwards"}, ids, expectedIds...)
+		}
+
+		// rows inserted before the cursor don't shift the next page
+		sorts := []Sort{{Field: "document"}}
+		first, _ := repo.GetInvoices("", &QueryOptions{Sorts: sorts, Pagination: Pagination{PerPage: 3}, Cursor: &Cursor{}})
+		insertInvoices(t, repo, Invoice{Id: 5, Document: "a", IsActive: true})
+		next, _ := repo.GetInvoices("", &QueryOptions{Sorts: sorts, Pagination: Pagination{PerPage: 3}, Cursor: NewCursor(first[2], sorts, false)})
+		assertIds(t, name, invoiceIds(next), 10, 50, 30)
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	sorts := []Sort{{Field: "document", Desc: true}}
+	encoded := NewCursor(&Invoice{Id: 7, Document: "x"}, sorts, true).Encode(sorts)
+
+	cursor, err := DecodeCursor(encoded, sorts)
+	if err != nil || cursor.Id != 7 || !cursor.Before || len(cursor.Values) != 1 || cursor.Values[0] != "x" {
+		t.Errorf("cursor should have been decoded back, but was %+v (%v).", cursor, err)
+	}
+
+	for _, c := range []struct {
+		value string
+		sorts []Sort
+	}{
+		{encoded, []Sort{{Field: "document"}}},
+		{encoded, nil},
+		{"not base64!", sorts},
+		{"e30", sorts},
+		{NewCursor(&Invoice{Id: 7, Document: "x"}, sorts, false).Encode([]Sort{{Field: "referenceMonth"}}), []Sort{{Field: "referenceMonth"}}},
+	} {
+		if _, err := DecodeCursor(c.value, c.sorts); err != InvalidCursor {
+			t.Errorf("%v: error should have been %v, but was %v instead.", c, InvalidCursor, err)
+		}
+	}
+}
+
+func TestRepoRejectsUnknownFields(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		insertInvoices(t, repo, Invoice{Document: "a", IsActive: true})
+
+		opts := &QueryOptions{Filters: And{eq("isActive", 0)}, Pagination: Pagination{Page: 1, PerPage: 5}}
+		if _, err := repo.GetInvoices("", opts); !errors.Is(err, UnknownField) {
+			t.Errorf("%v: error for an unknown filter should have been %v, but was %v instead.", name, UnknownField, err)
+		}
+		opts = &QueryOptions{Sorts: []Sort{{Field: "deactiveAt"}}, Pagination: Pagination{Page: 1, PerPage: 5}}
+		if _, err := repo.GetInvoices("", opts); !errors.Is(err, UnknownField) {
+			t.Errorf("%v: error for an unknown sort should have been %v, but was %v instead.", name, UnknownField, err)
+		}
+	}
+}
+
+func TestRepoIdempotencyStore(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		store := repo.(IdempotencyStore)
+		since := time.Now().Add(-time.Hour)
+
+		if stored, err := store.ReserveIdempotencyKey("k", "f1", since); err != nil || stored != nil {
+			t.Fatalf("%v: reserving a free key should return nil, nil, but returned %v, %v.", name, stored, err)
+		}
+		stored, err := store.ReserveIdempotencyKey("k", "f1", since)
+		if err != nil || stored == nil || !stored.Pending() || stored.Fingerprint != "f1" {
+			t.Errorf("%v: a reserved key should be pending, but was %+v (%v).", name, stored, err)
+		}
+
+		// a failed request frees its key
+		if err = store.ReleaseIdempotencyKey("k"); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ = store.ReserveIdempotencyKey("k", "f2", since); stored != nil {
+			t.Errorf("%v: a released key should be free, but was %+v.", name, stored)
+		}
+
+		response := IdempotentResponse{Key: "k", StatusCode: 201, Location: "/invoices/1", Body: []byte("{}")}
+		if err = store.CompleteIdempotencyKey(response); err != nil {
+			t.Fatal(err)
+		}
+		store.ReleaseIdempotencyKey("k")
+		stored, err = store.ReserveIdempotencyKey("k", "f3", since)
+		if err != nil || stored == nil || stored.StatusCode != 201 || stored.Location != "/invoices/1" ||
+			string(stored.Body) != "{}" || stored.Fingerprint != "f2" {
+			t.Errorf("%v: the completed response should have been stored, but was %+v (%v).", name, stored, err)
+		}
+
+		// records older than the TTL are replaced
+		if stored, _ = store.ReserveIdempotencyKey("k", "f4", time.Now().Add(time.Hour)); stored != nil {
+			t.Errorf("%v: an expired key should be free, but was %+v.", name, stored)
+		}
+
+		if err = store.CompleteIdempotencyKey(IdempotentResponse{Key: "missing"}); err != IdempotencyKeyNotReserved {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, IdempotencyKeyNotReserved, err)
+		}
+	}
+}
+
+func TestRepoAPIKeyStore(t *testing.T) {
+	for name, repo := range testRepos(t) {
+		store := repo.(APIKeyStore)
+		secret, prefix, hash, err := NewAPIKeySecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if HashAPIKeySecret(secret) != hash || prefix != secret[:len(prefix)] {
+			t.Errorf("%v: hash and prefix should have been derived from the secret.", name)
+		}
+
+		expiresAt := NullTime{Time: time.Now().Add(time.Hour), Valid: true}
+		id, err := store.InsertAPIKey(APIKey{Name: "ci", Prefix: prefix, Hash: hash, Scopes: []string{ScopeInvoicesRead}, CreatedAt: time.Now(), ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := store.GetAPIKeyByHash(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Id != int(id) || key.Name != "ci" || len(key.Scopes) != 1 || key.Scopes[0] != ScopeInvoicesRead ||
+			!key.ExpiresAt.Valid || key.LastUsedAt.Valid || !key.Usable(time.Now()) {
+			t.Errorf("%v: stored key should have been the inserted one, but was %+v.", name, key)
+		}
+		if key.Usable(expiresAt.Time) {
+			t.Errorf("%v: key should not be usable once it expires.", name)
+		}
+
+		if err = store.TouchAPIKey(key.Id, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		_, _, newHash, _ := NewAPIKeySecret()
+		if err = store.RotateAPIKey("", key.Id, "gk_new", newHash); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.GetAPIKeyByHash(hash); err != APIKeyNotFound {
+			t.Errorf("%v: the old secret should have stopped working, but lookup returned %v.", name, err)
+		}
+		if key, err = store.GetAPIKeyById("", key.Id); err != nil || key.Prefix != "gk_new" || !key.LastUsedAt.Valid {
+			t.Errorf("%v: key should have been rotated and touched, but was %+v (%v).", name, key, err)
+		}
+
+		if _, err = store.GetAPIKeyById("other", key.Id); err != APIKeyNotFound {
+			t.Errorf("%v: keys of another tenant should not be found, but lookup returned %v.", name, err)
+		}
+		if err = store.RevokeAPIKey("other", key.Id, time.Now()); err != APIKeyNotFound {
+			t.Errorf("%v: keys of another tenant should not be revoked, but revoking returned %v.", name, err)
+		}
+		if keys, _ := store.GetAPIKeys("other"); len(keys) != 0 {
+			t.Errorf("%v: another tenant should have no keys, but got %v keys.", name, len(keys))
+		}
+
+		if err = store.RevokeAPIKey("", key.Id, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if key, _ = store.GetAPIKeyByHash(newHash); key.Usable(time.Now()) {
+			t.Errorf("%v: a revoked key should not be usable.", name)
+		}
+		if err = store.RotateAPIKey("", key.Id, "gk_x", "x"); err != APIKeyNotFound {
+			t.Errorf("%v: rotating a revoked key should fail with %v, but returned %v.", name, APIKeyNotFound, err)
+		}
+		if keys, _ := store.GetAPIKeys(""); len(keys) != 1 {
+			t.Errorf("%v: revoked keys should still be listed, but got %v keys.", name, len(keys))
+		}
+		if err = store.RevokeAPIKey("", 42, time.Now()); err != APIKeyNotFound {
+			t.Errorf("%v: error should have been %v, but was %v instead.", name, APIKeyNotFound, err)
+		}
+	}
+}
+
+func TestSQLRepoReadsDoNotLock(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+t.TempDir()+"/gorfiv.db?_busy_timeout=100&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = NewMigrator(db, SQLite).Up(); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewSQLRepo(db, SQLite)
+	insertInvoices(t, repo, Invoice{Document: "doc", Amount: 100, IsActive: true})
+
+	// a writer holds the database while the invoice is read
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, _, err := repo.GetLineItems("", 1); err != nil {
+		t.Errorf("the line items should have been read, but got %v.", err)
+	}
+	if _, _, err := repo.GetInvoiceTaxes("", 1); err != nil {
+		t.Errorf("the taxes should have been read, but got %v.", err)
+	}
+}
@@ -1,96 +1,344 @@
 package models
 
 import (
-	"bytes"
 	"database/sql"
-	"fmt"
+	"reflect"
 	"strings"
 	"time"
 )
 
 type SQLRepo struct {
-	db *sql.DB
+	db        boundDB
+	dialect   Dialect
+	taxEngine TaxEngine
 }
 
-func NewSQLRepo(db *sql.DB) *SQLRepo {
-	return &SQLRepo{db: db}
+func NewSQLRepo(db *sql.DB, dialect Dialect) *SQLRepo {
+	return &SQLRepo{db: boundDB{db, dialect}, dialect: dialect}
 }
 
-func (r *SQLRepo) GetInvoiceById(id int) (invoice *Invoice, err error) {
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvoice(row scanner, invoice *Invoice) error {
+	return row.Scan(&invoice.Id, &invoice.CreatedAt, &invoice.ReferenceMonth,
+		&invoice.ReferenceYear, &invoice.Document, &invoice.Description,
+		&invoice.Amount, &invoice.IsActive, &invoice.DeactiveAt, &invoice.Version,
+		&invoice.UpdatedAt, &invoice.TenantId, &invoice.Currency, &invoice.Status,
+		&invoice.AmountPaid)
+}
+
+type invoiceSelection []invoiceJSONField
+
+// selectInvoiceFields returns the columns behind opts.Fields, along with the
+// id and the sort keys, which keyset pagination needs to make cursors.
+func selectInvoiceFields(opts *QueryOptions) (invoiceSelection, error) {
+	if opts.Fields == nil {
+		return nil, nil
+	}
+	if err := CheckProjection(opts.Fields); err != nil {
+		return nil, err
+	}
+	needed := map[string]bool{}
+	for _, field := range opts.Fields {
+		needed[field] = true
+	}
+	for _, s := range orderKeys(opts.Sorts) {
+		needed[s.Field] = true
+	}
+
+	var selection invoiceSelection
+	for _, f := range invoiceJSONFields {
+		if needed[f.name] {
+			selection = append(selection, f)
+		}
+	}
+	return selection, nil
+}
+
+func (s invoiceSelection) columns() string {
+	if s == nil {
+		return "*"
+	}
+	columns := make([]string, len(s))
+	for k, f := range s {
+		columns[k] = f.column
+	}
+	return strings.Join(columns, ", ")
+}
+
+func (s invoiceSelection) scan(row scanner, invoice *Invoice) error {
+	if s == nil {
+		return scanInvoice(row, invoice)
+	}
+	v := reflect.ValueOf(invoice).Elem()
+	dest := make([]interface{}, len(s))
+	for k, f := range s {
+		dest[k] = v.Field(f.index).Addr().Interface()
+	}
+	return row.Scan(dest...)
+}
+
+func (r *SQLRepo) GetInvoiceById(tenant string, id int) (invoice *Invoice, err error) {
+	return r.getInvoice(r.db, tenant, id)
+}
+
+func (r *SQLRepo) getInvoice(q Querier, tenant string, id int) (invoice *Invoice, err error) {
 	invoice = &Invoice{}
-	err = r.db.
-		QueryRow("SELECT * FROM Invoice WHERE IsActive=1 AND Id=?;", id).
-		Scan(&invoice.Id, &invoice.CreatedAt, &invoice.ReferenceMonth,
-			&invoice.ReferenceYear, &invoice.Document, &invoice.Description,
-			&invoice.Amount, &invoice.IsActive, &invoice.DeactiveAt)
+	err = scanInvoice(q.QueryRow(r.dialect.Rebind("SELECT * FROM Invoice WHERE TenantId=? AND IsActive=1 AND Id=?;"), tenant, id), invoice)
 	if err == sql.ErrNoRows {
 		err = InvoiceNotFound
 	}
 	return
 }
 
-func (r *SQLRepo) UpdateInvoice(id int, newDescription string) (nRows int64, err error) {
-	fmt.Println(id) //DEBUG
-	stmt, err := r.db.Prepare("UPDATE Invoice SET Description=? WHERE IsActive=1 AND Id=?")
-	if err != nil {
+func (r *SQLRepo) UpdateInvoice(tenant string, id int, version int, fields InvoiceFields) (nRows int64, err error) {
+	// only drafts change, and amounts and currencies must fit the invoice
+	// and its items, which have to be read first
+	if len(fields) == 0 {
+		return 0, NoFieldsToUpdate
+	}
+	err = r.ModifyInvoice(tenant, id, version, func(*Invoice) (InvoiceFields, error) {
+		return fields, nil
+	})
+	switch err {
+	case nil:
+		return 1, nil
+	case InvoiceNotFound:
+		return 0, nil
+	}
+	return 0, err
+}
+
+func (r *SQLRepo) updateInvoice(q Querier, tenant string, id int, version int, fields InvoiceFields) (nRows int64, err error) {
+	var b queryBuilder
+	b.Write("UPDATE Invoice SET ")
+	if err = b.WriteAssignments(fields); err != nil {
 		return
 	}
-	defer stmt.Close()
+	b.Write(", Version=Version+1, UpdatedAt=")
+	b.Bind(time.Now())
+	writeInvoiceKey(&b, tenant, id)
+	r.writeVersionCheck(&b, version)
 
-	res, err := stmt.Exec(newDescription, id)
+	res, err := q.Exec(r.dialect.Rebind(b.String()), b.Args()...)
 	if err != nil {
 		return
 	}
 
 	nRows, err = res.RowsAffected()
-	fmt.Println(nRows)
+	if err == nil && nRows == 0 {
+		err = r.checkVersionConflict(q, tenant, id, version)
+	}
 	return
 }
 
-func (r *SQLRepo) DeleteInvoice(id int) (nRows int64, err error) {
-	stmt, err := r.db.Prepare("UPDATE Invoice SET IsActive=0, DeactiveAt=? WHERE IsActive=1 AND Id=?")
+func (r *SQLRepo) ModifyInvoice(tenant string, id int, version int, modify func(*Invoice) (InvoiceFields, error)) (err error) {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	res, err := stmt.Exec(time.Now(), id)
+	invoice, err := r.lockInvoice(tx, tenant, id, version)
+	if err != nil {
+		return
+	}
+
+	fields, err := modify(invoice)
+	if err != nil {
+		return
+	}
+	if len(fields) > 0 {
+		if err = fields.Check(); err != nil {
+			return
+		}
+		if err = fields.CheckFor(invoice); err != nil {
+			return
+		}
+		if err = r.setLineItems(tx, invoice, fields); err != nil {
+			return
+		}
+		if _, err = r.updateInvoice(tx, tenant, id, invoice.Version, fields); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *SQLRepo) lockInvoice(tx Querier, tenant string, id int, version int) (*Invoice, error) {
+	invoice := &Invoice{}
+	err := scanInvoice(tx.QueryRow(r.dialect.Rebind("SELECT * FROM Invoice WHERE TenantId=? AND IsActive=1 AND Id=?"+r.dialect.ForUpdate()), tenant, id), invoice)
+	if err == sql.ErrNoRows {
+		return nil, InvoiceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && invoice.Version != version {
+		return nil, VersionConflict
+	}
+	return invoice, nil
+}
+
+func (r *SQLRepo) DeleteInvoice(tenant string, id int, version int) (nRows int64, err error) {
+	var b queryBuilder
+	now := time.Now()
+	b.Write("UPDATE Invoice SET IsActive=0, DeactiveAt=")
+	b.Bind(now)
+	b.Write(", Version=Version+1, UpdatedAt=")
+	b.Bind(now)
+	writeInvoiceKey(&b, tenant, id)
+	r.writeVersionCheck(&b, version)
+	b.Write(" AND Status=")
+	b.Bind(StatusDraft)
+
+	res, err := r.db.Exec(r.dialect.Rebind(b.String()), b.Args()...)
 	if err != nil {
 		return
 	}
 
 	nRows, err = res.RowsAffected()
+	if err == nil && nRows == 0 {
+		err = r.checkDeleteConflict(tenant, id, version)
+	}
 	return
 }
 
+func (r *SQLRepo) checkDeleteConflict(tenant string, id int, version int) error {
+	invoice := &Invoice{}
+	err := scanInvoice(r.db.QueryRow(r.dialect.Rebind("SELECT * FROM Invoice WHERE TenantId=? AND IsActive=1 AND Id=?"), tenant, id), invoice)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if version != 0 && invoice.Version != version {
+		return VersionConflict
+	}
+	return invoice.checkDraft()
+}
+
+func writeInvoiceKey(b *queryBuilder, tenant string, id int) {
+	b.Write(" WHERE TenantId=")
+	b.Bind(tenant)
+	b.Write(" AND IsActive=1 AND Id=")
+	b.Bind(id)
+}
+
+func (r *SQLRepo) writeVersionCheck(b *queryBuilder, version int) {
+	if version != 0 {
+		b.Write(" AND Version=")
+		b.Bind(version)
+	}
+}
+
+func (r *SQLRepo) checkVersionConflict(q Querier, tenant string, id int, version int) error {
+	if version == 0 {
+		return nil
+	}
+	var count int
+	err := q.QueryRow(r.dialect.Rebind("SELECT COUNT(*) FROM Invoice WHERE TenantId=? AND IsActive=1 AND Id=?"), tenant, id).Scan(&count)
+	if err == nil && count > 0 {
+		err = VersionConflict
+	}
+	return err
+}
+
 func (r *SQLRepo) InsertInvoice(i Invoice) (id int64, err error) {
-	stmt, err := r.db.Prepare(`INSERT INTO Invoice SET
-	                           CreatedAt=?, ReferenceMonth=?, ReferenceYear=?,
-	                           Document=?, Description=?, Amount=?,
-	                           IsActive=?, DeactiveAt=?`)
+	if i.Id != 0 {
+		return r.insertInvoice(i)
+	}
+	// a random id may already belong to an invoice of any tenant
+	for {
+		if i.Id, err = drawInvoiceId(); err != nil {
+			return
+		}
+		if id, err = r.insertInvoice(i); err != InvoiceIdTaken {
+			return
+		}
+	}
+}
+
+func (r *SQLRepo) insertInvoice(i Invoice) (id int64, err error) {
+	if i.Currency == "" {
+		i.Currency = DefaultCurrency
+	}
+	if i.Status == "" {
+		i.Status = StatusDraft
+	}
+	items := []LineItem{singleLineItem(&i)}
+	taxes, err := computeTaxes(r.taxEngine, &i, items)
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
-
-	res, err := stmt.Exec(i.CreatedAt, i.ReferenceMonth, i.ReferenceYear,
-		i.Document, i.Description, i.Amount, i.IsActive, nil)
+	tx, err := r.db.Begin()
 	if err != nil {
 		return
 	}
+	_, err = tx.Exec(r.dialect.Rebind(`INSERT INTO Invoice
+	                               (Id, TenantId, CreatedAt, ReferenceMonth, ReferenceYear,
+	                               Document, Description, Amount, AmountPaid, Currency, Status,
+	                               IsActive, DeactiveAt, Version, UpdatedAt)
+	                               VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		i.Id, i.TenantId, i.CreatedAt, i.ReferenceMonth, i.ReferenceYear,
+		i.Document, i.Description, i.Amount, i.AmountPaid, i.Currency, i.Status,
+		boolToInt(i.IsActive), nil, 1, i.CreatedAt)
+	if err == nil {
+		err = r.insertLineItems(tx, i.Id, items)
+	}
+	if err == nil {
+		err = r.insertTaxes(tx, i.Id, taxes)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		var n int
+		if r.db.QueryRow(r.dialect.Rebind("SELECT COUNT(*) FROM Invoice WHERE Id=?"), i.Id).Scan(&n) == nil && n > 0 {
+			err = InvoiceIdTaken
+		}
+		return 0, err
+	}
+	return int64(i.Id), nil
+}
 
-	id, err = res.LastInsertId()
-	return
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
-func (r *SQLRepo) CountInvoices(opts *QueryOptions) (count int, err error) {
-	err = r.db.QueryRow("SELECT COUNT(*) FROM Invoice WHERE IsActive=1" + r.QueryStringWithoutLimit(opts)).Scan(&count)
+func (r *SQLRepo) CountInvoices(tenant string, opts *QueryOptions) (count int, err error) {
+	queryStr, args, err := r.QueryStringWithoutLimit(opts)
+	if err != nil {
+		return
+	}
+	args = append([]interface{}{tenant}, args...)
+	err = r.db.QueryRow(r.dialect.Rebind("SELECT COUNT(*) FROM Invoice WHERE TenantId=?"+queryStr), args...).Scan(&count)
 	return
 }
 
-func (r *SQLRepo) GetInvoices(opts *QueryOptions) (invoices []*Invoice, err error) {
-	queryStr := "SELECT * FROM Invoice WHERE IsActive=1" + r.QueryString(opts)
-	rows, err := r.db.Query(queryStr)
+func (r *SQLRepo) GetInvoices(tenant string, opts *QueryOptions) (invoices []*Invoice, err error) {
+	queryStr, args, err := r.QueryString(opts)
+	if err != nil {
+		return
+	}
+	args = append([]interface{}{tenant}, args...)
+	selection, err := selectInvoiceFields(opts)
+	if err != nil {
+		return
+	}
+	rows, err := r.db.Query(r.dialect.Rebind("SELECT "+selection.columns()+" FROM Invoice WHERE TenantId=?"+queryStr), args...)
 	if err != nil {
 		return
 	}
@@ -98,65 +346,448 @@ func (r *SQLRepo) GetInvoices(opts *QueryOptions) (invoices []*Invoice, err erro
 
 	for rows.Next() {
 		var invoice Invoice
-		err = rows.Scan(&invoice.Id, &invoice.CreatedAt, &invoice.ReferenceMonth,
-			&invoice.ReferenceYear, &invoice.Document, &invoice.Description,
-			&invoice.Amount, &invoice.IsActive, &invoice.DeactiveAt)
-		if err != nil {
+		if err = selection.scan(rows, &invoice); err != nil {
 			return
 		}
 		invoices = append(invoices, &invoice)
 	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if opts.Cursor != nil && opts.Cursor.Before {
+		reverseInvoices(invoices)
+	}
+	return
+}
+
+func (r *SQLRepo) AggregateInvoices(tenant string, opts *AggregateOptions) (groups []*Group, count int, err error) {
+	if err = opts.check(); err != nil {
+		return
+	}
+	var where queryBuilder
+	where.Bind(tenant)
+	if err = where.WriteFilters(&opts.QueryOptions); err != nil {
+		return
+	}
+	where.WriteGroupBy(opts)
+
+	var currencies sql.NullInt64
+	err = r.db.QueryRow(r.dialect.Rebind("SELECT COUNT(*), MAX(n) FROM (SELECT COUNT(DISTINCT Currency) AS n FROM Invoice WHERE TenantId="+where.String()+") AS g"), where.Args()...).Scan(&count, &currencies)
+	if err != nil {
+		return
+	}
+	if opts.mixesCurrencies() && currencies.Int64 > 1 {
+		return nil, 0, MixedCurrencies
+	}
+
+	var b queryBuilder
+	b.Write("SELECT ")
+	b.WriteAggregate(opts)
+	b.Write(" FROM Invoice WHERE TenantId=" + where.String())
+	b.args = append(b.args, where.Args()...)
+	b.WriteGroupPage(opts)
+	rows, err := r.db.Query(r.dialect.Rebind(b.String()), b.Args()...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g *Group
+		if g, err = scanGroup(rows, opts); err != nil {
+			return
+		}
+		groups = append(groups, g)
+	}
+	err = rows.Err()
+	return
+}
+
+func (r *SQLRepo) QueryString(q *QueryOptions) (queryStr string, args []interface{}, err error) {
+	var b queryBuilder
+	if err = b.WriteFilters(q); err != nil {
+		return
+	}
+	if err = b.WritePage(q); err != nil {
+		return
+	}
+	return b.String(), b.Args(), nil
+}
+
+func (r *SQLRepo) QueryStringWithoutLimit(q *QueryOptions) (queryStr string, args []interface{}, err error) {
+	var b queryBuilder
+	if err = b.WriteFilters(q); err != nil {
+		return
+	}
+	return b.String(), b.Args(), nil
+}
+
+func (r *SQLRepo) ReserveIdempotencyKey(key string, fingerprint string, expiredBefore time.Time) (*IdempotentResponse, error) {
+	_, err := r.db.Exec(r.dialect.Rebind("DELETE FROM IdempotencyKey WHERE CreatedAt<?"), expiredBefore.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = r.db.Exec(r.dialect.Rebind("INSERT INTO IdempotencyKey (RequestKey, Fingerprint, CreatedAt) VALUES (?, ?, ?)"),
+		key, fingerprint, time.Now().UTC())
+	if err == nil {
+		return nil, nil
+	}
+
+	// the insert fails when the key is taken, so look for who holds it
+	response := &IdempotentResponse{}
+	scanErr := r.db.QueryRow(r.dialect.Rebind("SELECT RequestKey, Fingerprint, StatusCode, Location, Body, CreatedAt FROM IdempotencyKey WHERE RequestKey=?"), key).
+		Scan(&response.Key, &response.Fingerprint, &response.StatusCode, &response.Location, &response.Body, &response.CreatedAt)
+	if scanErr != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *SQLRepo) CompleteIdempotencyKey(response IdempotentResponse) error {
+	result, err := r.db.Exec(r.dialect.Rebind("UPDATE IdempotencyKey SET StatusCode=?, Location=?, Body=? WHERE RequestKey=?"),
+		response.StatusCode, response.Location, response.Body, response.Key)
+	if err != nil {
+		return err
+	}
+	if nRows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if nRows == 0 {
+		return IdempotencyKeyNotReserved
+	}
+	return nil
+}
+
+func (r *SQLRepo) ReleaseIdempotencyKey(key string) error {
+	_, err := r.db.Exec(r.dialect.Rebind("DELETE FROM IdempotencyKey WHERE RequestKey=? AND StatusCode=0"), key)
+	return err
+}
+
+const apiKeyColumns = "Id, Name, Prefix, Hash, Scopes, CreatedAt, ExpiresAt, LastUsedAt, RevokedAt, TenantId"
+
+func scanAPIKey(row scanner) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes string
+	err := row.Scan(&k.Id, &k.Name, &k.Prefix, &k.Hash, &scopes, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.TenantId)
+	if err == sql.ErrNoRows {
+		return nil, APIKeyNotFound
+	}
+	k.Scopes = splitScopes(scopes)
+	return k, err
+}
+
+func (r *SQLRepo) InsertAPIKey(k APIKey) (id int64, err error) {
+	return r.dialect.Insert(r.db, "INSERT INTO APIKey (TenantId, Name, Prefix, Hash, Scopes, CreatedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		k.TenantId, k.Name, k.Prefix, k.Hash, joinScopes(k.Scopes), k.CreatedAt, k.ExpiresAt)
+}
+
+func (r *SQLRepo) GetAPIKeys(tenant string) (keys []*APIKey, err error) {
+	rows, err := r.db.Query(r.dialect.Rebind("SELECT "+apiKeyColumns+" FROM APIKey WHERE TenantId=? ORDER BY Id"), tenant)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
 
+	keys = []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
 	err = rows.Err()
 	return
 }
 
-func (r *SQLRepo) QueryString(q *QueryOptions) string {
-	var queryStr bytes.Buffer
-	for k, v := range q.Filters {
-		queryStr.WriteString(" AND " + k + "=\"" + v + "\"")
+func (r *SQLRepo) GetAPIKeyById(tenant string, id int) (*APIKey, error) {
+	return scanAPIKey(r.db.QueryRow(r.dialect.Rebind("SELECT "+apiKeyColumns+" FROM APIKey WHERE TenantId=? AND Id=?"), tenant, id))
+}
+
+func (r *SQLRepo) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	return scanAPIKey(r.db.QueryRow(r.dialect.Rebind("SELECT "+apiKeyColumns+" FROM APIKey WHERE Hash=?"), hash))
+}
+
+func (r *SQLRepo) RotateAPIKey(tenant string, id int, prefix string, hash string) error {
+	return r.execAPIKey("UPDATE APIKey SET Prefix=?, Hash=? WHERE TenantId=? AND Id=? AND RevokedAt IS NULL", prefix, hash, tenant, id)
+}
+
+func (r *SQLRepo) RevokeAPIKey(tenant string, id int, at time.Time) error {
+	return r.execAPIKey("UPDATE APIKey SET RevokedAt=COALESCE(RevokedAt, ?) WHERE TenantId=? AND Id=?", at, tenant, id)
+}
+
+func (r *SQLRepo) TouchAPIKey(id int, at time.Time) error {
+	return r.execAPIKey("UPDATE APIKey SET LastUsedAt=? WHERE Id=?", at, id)
+}
+
+func (r *SQLRepo) execAPIKey(query string, args ...interface{}) error {
+	result, err := r.db.Exec(r.dialect.Rebind(query), args...)
+	if err != nil {
+		return err
 	}
+	if nRows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if nRows == 0 {
+		return APIKeyNotFound
+	}
+	return nil
+}
 
-	if len(q.Sorts) > 0 {
-		queryStr.WriteString(" ORDER BY ")
-		var sortsStr = make([]string, len(q.Sorts))
-		for i, sort := range q.Sorts {
-			sortsStr[i] = r.SortToString(sort)
+func (r *SQLRepo) UpsertFXRates(rates []FXRate) (err error) {
+	for k := range rates {
+		if err = rates[k].Check(); err != nil {
+			return
 		}
-		queryStr.WriteString(strings.Join(sortsStr, ", "))
 	}
 
-	var limitClauseStr = fmt.Sprint(" LIMIT ",
-		(q.Pagination.Page-1)*q.Pagination.PerPage, ", ", q.Pagination.PerPage)
-	queryStr.WriteString(limitClauseStr)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	return queryStr.String()
+	query := r.dialect.Rebind("INSERT INTO FXRate (FromCurrency, ToCurrency, RateDate, Rate) VALUES (?, ?, ?, ?)" +
+		r.dialect.OnConflictUpdate([]string{"FromCurrency", "ToCurrency", "RateDate"}, []string{"Rate"}))
+	for _, rate := range rates {
+		if _, err = tx.Exec(query, rate.From, rate.To, rate.Date, rate.Rate); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
 }
 
-func (r *SQLRepo) QueryStringWithoutLimit(q *QueryOptions) string {
-	var queryStr bytes.Buffer
-	for k, v := range q.Filters {
-		queryStr.WriteString(" AND " + k + "=\"" + v + "\"")
+func (r *SQLRepo) FindFXRate(from string, to string, date string) (*FXRate, error) {
+	rate := &FXRate{From: from, To: to}
+	err := r.db.QueryRow(r.dialect.Rebind("SELECT RateDate, Rate FROM FXRate WHERE FromCurrency=? AND ToCurrency=? AND RateDate<=? ORDER BY RateDate DESC LIMIT 1"), from, to, date).
+		Scan(&rate.Date, &rate.Rate)
+	if err == sql.ErrNoRows {
+		return nil, FXRateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rate, nil
+}
+
+const lineItemColumns = "Id, Description, Quantity, UnitPrice, Discount"
+
+func (r *SQLRepo) lineItems(q Querier, invoiceId int) (items []LineItem, err error) {
+	rows, err := q.Query(r.dialect.Rebind("SELECT "+lineItemColumns+" FROM LineItem WHERE InvoiceId=? ORDER BY Id"), invoiceId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	items = []LineItem{}
+	for rows.Next() {
+		var item LineItem
+		if err = rows.Scan(&item.Id, &item.Description, &item.Quantity, &item.UnitPrice, &item.Discount); err != nil {
+			return nil, err
+		}
+		gross, _ := item.gross()
+		item.Total = gross - item.Discount
+		items = append(items, item)
 	}
+	err = rows.Err()
+	return
+}
 
-	if len(q.Sorts) > 0 {
-		queryStr.WriteString(" ORDER BY ")
-		var sortsStr = make([]string, len(q.Sorts))
-		for i, sort := range q.Sorts {
-			sortsStr[i] = r.SortToString(sort)
+func (r *SQLRepo) insertLineItems(q Querier, invoiceId int, items []LineItem) error {
+	query := r.dialect.Rebind("INSERT INTO LineItem (InvoiceId, " + lineItemColumns + ") VALUES (?, ?, ?, ?, ?, ?)")
+	for _, item := range items {
+		if _, err := q.Exec(query, invoiceId, item.Id, item.Description, item.Quantity, item.UnitPrice, item.Discount); err != nil {
+			return err
 		}
-		queryStr.WriteString(strings.Join(sortsStr, ", "))
 	}
+	return nil
+}
 
-	return queryStr.String()
+func (r *SQLRepo) replaceLineItems(q Querier, invoiceId int, items []LineItem) error {
+	if _, err := q.Exec(r.dialect.Rebind("DELETE FROM LineItem WHERE InvoiceId=?"), invoiceId); err != nil {
+		return err
+	}
+	return r.insertLineItems(q, invoiceId, items)
 }
 
-func (*SQLRepo) SortToString(s Sort) (str string) {
-	str = s.Field
-	if s.Desc {
-		str += " DESC"
-	} else {
-		str += " ASC"
+func (r *SQLRepo) setLineItems(q Querier, invoice *Invoice, fields InvoiceFields) error {
+	_, amount := fields["amount"]
+	_, currency := fields["currency"]
+	if !amount && !currency {
+		return nil
+	}
+	items, err := r.lineItems(q, invoice.Id)
+	if err != nil {
+		return err
+	}
+	items, changed, err := fields.lineItemsFor(invoice, items)
+	if err != nil || !changed && !currency {
+		return err
+	}
+	updated := *invoice
+	updated.Set(fields)
+	taxes, err := computeTaxes(r.taxEngine, &updated, items)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err = r.replaceLineItems(q, invoice.Id, items); err != nil {
+			return err
+		}
+	}
+	return r.replaceTaxes(q, invoice.Id, taxes)
+}
+
+// GetLineItems reads the invoice and its items in one transaction, so that
+// the version of the invoice is that of the items.
+func (r *SQLRepo) GetLineItems(tenant string, invoiceId int) (invoice *Invoice, items []LineItem, err error) {
+	tx, err := r.db.BeginRead()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if invoice, err = r.getInvoice(tx, tenant, invoiceId); err != nil {
+		return nil, nil, err
+	}
+	if items, err = r.lineItems(tx, invoiceId); err != nil {
+		return nil, nil, err
+	}
+	return invoice, items, nil
+}
+
+func (r *SQLRepo) ModifyLineItems(tenant string, invoiceId int, version int, modify func(*Invoice, []LineItem) ([]LineItem, error)) (items []LineItem, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	invoice, err := r.lockInvoice(tx, tenant, invoiceId, version)
+	if err != nil {
+		return
+	}
+	if err = invoice.checkDraft(); err != nil {
+		return
+	}
+	if items, err = r.lineItems(tx, invoiceId); err != nil {
+		return
+	}
+	if items, err = modify(invoice, items); err != nil {
+		return
+	}
+	numberLineItems(items)
+	total, err := checkLineItems(invoice.Currency, items)
+	if err != nil {
+		return
+	}
+	invoice.Amount = total
+	taxes, err := computeTaxes(r.taxEngine, invoice, items)
+	if err != nil {
+		return
+	}
+	if err = r.replaceLineItems(tx, invoiceId, items); err != nil {
+		return
+	}
+	if err = r.replaceTaxes(tx, invoiceId, taxes); err != nil {
+		return
+	}
+	if _, err = r.updateInvoice(tx, tenant, invoiceId, invoice.Version, InvoiceFields{"amount": total}); err != nil {
+		return
+	}
+	return items, tx.Commit()
+}
+
+func (r *SQLRepo) SetTaxEngine(engine TaxEngine) {
+	r.taxEngine = engine
+}
+
+const taxColumns = "Code, Rate, Inclusive, Base, Amount"
+
+func (r *SQLRepo) GetInvoiceTaxes(tenant string, id int) (invoice *Invoice, taxes []Tax, err error) {
+	tx, err := r.db.BeginRead()
+	if err != nil {
+		return
 	}
+	defer tx.Rollback()
+
+	if invoice, err = r.getInvoice(tx, tenant, id); err != nil {
+		return nil, nil, err
+	}
+	if taxes, err = r.taxes(tx, id); err != nil {
+		return nil, nil, err
+	}
+	return invoice, taxes, nil
+}
+
+func (r *SQLRepo) taxes(q Querier, invoiceId int) (taxes []Tax, err error) {
+	rows, err := q.Query(r.dialect.Rebind("SELECT "+taxColumns+" FROM InvoiceTax WHERE InvoiceId=? ORDER BY Code"), invoiceId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	taxes = []Tax{}
+	for rows.Next() {
+		var tax Tax
+		if err = rows.Scan(&tax.Code, &tax.Rate, &tax.Inclusive, &tax.Base, &tax.Amount); err != nil {
+			return nil, err
+		}
+		taxes = append(taxes, tax)
+	}
+	err = rows.Err()
 	return
 }
+
+func (r *SQLRepo) insertTaxes(q Querier, invoiceId int, taxes []Tax) error {
+	query := r.dialect.Rebind("INSERT INTO InvoiceTax (InvoiceId, " + taxColumns + ") VALUES (?, ?, ?, ?, ?, ?)")
+	for _, tax := range taxes {
+		if _, err := q.Exec(query, invoiceId, tax.Code, tax.Rate, boolToInt(tax.Inclusive), tax.Base, tax.Amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLRepo) replaceTaxes(q Querier, invoiceId int, taxes []Tax) error {
+	if _, err := q.Exec(r.dialect.Rebind("DELETE FROM InvoiceTax WHERE InvoiceId=?"), invoiceId); err != nil {
+		return err
+	}
+	return r.insertTaxes(q, invoiceId, taxes)
+}
+
+func (r *SQLRepo) TransitionInvoice(tenant string, id int, version int, event InvoiceEvent, payment Money) (invoice *Invoice, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if invoice, err = r.lockInvoice(tx, tenant, id, version); err != nil {
+		return
+	}
+	if err = invoice.Apply(event, payment); err != nil {
+		return
+	}
+	_, err = tx.Exec(r.dialect.Rebind("UPDATE Invoice SET Status=?, AmountPaid=?, Version=Version+1, UpdatedAt=? WHERE TenantId=? AND Id=?"),
+		invoice.Status, invoice.AmountPaid, time.Now(), tenant, id)
+	if err != nil {
+		return
+	}
+	if invoice, err = r.lockInvoice(tx, tenant, id, 0); err != nil {
+		return
+	}
+	return invoice, tx.Commit()
+}
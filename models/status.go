@@ -0,0 +1,155 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+type InvoiceStatus string
+
+const (
+	StatusDraft         InvoiceStatus = "draft"
+	StatusIssued        InvoiceStatus = "issued"
+	StatusPartiallyPaid InvoiceStatus = "partially_paid"
+	StatusPaid          InvoiceStatus = "paid"
+	StatusOverdue       InvoiceStatus = "overdue"
+	StatusVoid          InvoiceStatus = "void"
+	StatusRefunded      InvoiceStatus = "refunded"
+)
+
+var InvoiceStatuses = []InvoiceStatus{StatusDraft, StatusIssued, StatusPartiallyPaid, StatusPaid, StatusOverdue, StatusVoid, StatusRefunded}
+
+type InvoiceEvent string
+
+const (
+	EventIssue   InvoiceEvent = "issue"
+	EventPay     InvoiceEvent = "pay"
+	EventOverdue InvoiceEvent = "overdue"
+	EventVoid    InvoiceEvent = "void"
+	EventRefund  InvoiceEvent = "refund"
+)
+
+var InvoiceEvents = []InvoiceEvent{EventIssue, EventPay, EventOverdue, EventVoid, EventRefund}
+
+// transitions lists the statuses each event may happen in. Void and
+// refunded invoices are final. An overdue invoice may have been partially
+// paid, so whether it can be voided or refunded also depends on
+// Invoice.AmountPaid, as Apply checks.
+var transitions = map[InvoiceEvent][]InvoiceStatus{
+	EventIssue:   {StatusDraft},
+	EventPay:     {StatusIssued, StatusPartiallyPaid, StatusOverdue},
+	EventOverdue: {StatusIssued, StatusPartiallyPaid},
+	EventVoid:    {StatusDraft, StatusIssued, StatusOverdue},
+	EventRefund:  {StatusPartiallyPaid, StatusPaid, StatusOverdue},
+}
+
+var (
+	UnknownStatus     = errors.New("unknown status")
+	IllegalTransition = errors.New("illegal transition")
+	InvoiceNotDraft   = errors.New("only draft invoices can be changed")
+	InvalidPayment    = errors.New("invalid payment")
+)
+
+func CheckInvoiceStatus(status string) error {
+	for _, s := range InvoiceStatuses {
+		if string(s) == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", UnknownStatus, status)
+}
+
+type TransitionError struct {
+	Event  InvoiceEvent
+	Status InvoiceStatus
+	Paid   *Money
+}
+
+func (e *TransitionError) Error() string {
+	msg := fmt.Sprintf("%v: %s can't happen to an invoice that is %s", IllegalTransition, e.Event, e.Status)
+	switch {
+	case e.Paid == nil:
+	case *e.Paid == 0:
+		msg += " with nothing paid"
+	default:
+		msg += fmt.Sprintf(" with %v paid", *e.Paid)
+	}
+	return msg
+}
+
+type PaymentError struct {
+	Reason string
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("%v: %s", InvalidPayment, e.Reason)
+}
+
+func (i *Invoice) checkDraft() error {
+	if i.Status != StatusDraft {
+		return InvoiceNotDraft
+	}
+	return nil
+}
+
+func (i *Invoice) Balance() Money {
+	return i.Amount - i.AmountPaid
+}
+
+func (i *Invoice) Apply(event InvoiceEvent, payment Money) error {
+	allowed := false
+	for _, status := range transitions[event] {
+		allowed = allowed || status == i.Status
+	}
+	if !allowed {
+		return &TransitionError{Event: event, Status: i.Status}
+	}
+	// voiding would strand what was paid, which only a refund gives back
+	if (event == EventVoid && i.AmountPaid != 0) || (event == EventRefund && i.AmountPaid == 0) {
+		paid := i.AmountPaid
+		return &TransitionError{Event: event, Status: i.Status, Paid: &paid}
+	}
+
+	switch event {
+	case EventIssue:
+		i.Status = StatusIssued
+	case EventPay:
+		if payment == 0 {
+			payment = i.Balance()
+		} else if err := i.checkPayment(payment); err != nil {
+			return err
+		}
+		if payment > 0 {
+			i.AmountPaid += payment
+		}
+		if i.Balance() <= 0 {
+			i.Status = StatusPaid
+		} else {
+			i.Status = StatusPartiallyPaid
+		}
+	case EventOverdue:
+		i.Status = StatusOverdue
+	case EventVoid:
+		i.Status = StatusVoid
+	case EventRefund:
+		i.Status = StatusRefunded
+	}
+	return nil
+}
+
+func (i *Invoice) checkPayment(payment Money) error {
+	if payment < 0 {
+		return &PaymentError{"the payment must be positive"}
+	}
+	if CheckAmount(i.Currency, payment) != nil {
+		return &PaymentError{fmt.Sprintf("the payment cannot have more than %d decimals in %s", MinorUnits(i.Currency), i.Currency)}
+	}
+	if payment > i.Balance() {
+		return &PaymentError{fmt.Sprintf("the payment cannot exceed the balance of %v", i.Balance())}
+	}
+	return nil
+}
+
+type StatusStore interface {
+	TransitionInvoice(tenant string, id int, version int, event InvoiceEvent, payment Money) (*Invoice, error)
+}
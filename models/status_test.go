@@ -0,0 +1,67 @@
+package models
+
+import "testing"
+
+func TestApply(t *testing.T) {
+	var cases = []struct {
+		status     InvoiceStatus
+		paid       Money
+		event      InvoiceEvent
+		payment    Money
+		expected   InvoiceStatus
+		expectPaid Money
+		err        string
+	}{
+		{StatusDraft, 0, EventIssue, 0, StatusIssued, 0, ""},
+		{StatusDraft, 0, EventVoid, 0, StatusVoid, 0, ""},
+		{StatusDraft, 0, EventPay, 0, StatusDraft, 0, "illegal transition: pay can't happen to an invoice that is draft"},
+		{StatusIssued, 0, EventIssue, 0, StatusIssued, 0, "illegal transition: issue can't happen to an invoice that is issued"},
+		// paying the balance by default
+		{StatusIssued, 0, EventPay, 0, StatusPaid, 10000, ""},
+		{StatusIssued, 0, EventPay, 4000, StatusPartiallyPaid, 4000, ""},
+		{StatusPartiallyPaid, 4000, EventPay, 6000, StatusPaid, 10000, ""},
+		{StatusPartiallyPaid, 4000, EventPay, 0, StatusPaid, 10000, ""},
+		{StatusOverdue, 0, EventPay, 100, StatusPartiallyPaid, 100, ""},
+		{StatusPartiallyPaid, 4000, EventPay, 6001, StatusPartiallyPaid, 4000, "invalid payment: the payment cannot exceed the balance of 60.00"},
+		{StatusIssued, 0, EventPay, -100, StatusIssued, 0, "invalid payment: the payment must be positive"},
+		{StatusIssued, 0, EventOverdue, 0, StatusOverdue, 0, ""},
+		{StatusPartiallyPaid, 4000, EventOverdue, 0, StatusOverdue, 4000, ""},
+		{StatusOverdue, 0, EventVoid, 0, StatusVoid, 0, ""},
+		// what was paid of an overdue invoice is refunded, not voided
+		{StatusOverdue, 4000, EventVoid, 0, StatusOverdue, 4000, "illegal transition: void can't happen to an invoice that is overdue with 40.00 paid"},
+		{StatusOverdue, 4000, EventRefund, 0, StatusRefunded, 4000, ""},
+		{StatusOverdue, 0, EventRefund, 0, StatusOverdue, 0, "illegal transition: refund can't happen to an invoice that is overdue with nothing paid"},
+		{StatusPartiallyPaid, 4000, EventVoid, 0, StatusPartiallyPaid, 4000, "illegal transition: void can't happen to an invoice that is partially_paid"},
+		{StatusPaid, 10000, EventRefund, 0, StatusRefunded, 10000, ""},
+		{StatusPaid, 10000, EventPay, 0, StatusPaid, 10000, "illegal transition: pay can't happen to an invoice that is paid"},
+		{StatusVoid, 0, EventIssue, 0, StatusVoid, 0, "illegal transition: issue can't happen to an invoice that is void"},
+		{StatusRefunded, 10000, EventRefund, 0, StatusRefunded, 10000, "illegal transition: refund can't happen to an invoice that is refunded"},
+	}
+	for _, c := range cases {
+		i := Invoice{Amount: 10000, AmountPaid: c.paid, Currency: "BRL", Status: c.status}
+		err := i.Apply(c.event, c.payment)
+		if (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("%v %v %v: error should have been %q, but was %v instead.", c.status, c.event, c.payment, c.err, err)
+		}
+		if i.Status != c.expected || i.AmountPaid != c.expectPaid {
+			t.Errorf("%v %v %v: invoice should have been %v with %v paid, but was %v with %v paid instead.", c.status, c.event, c.payment, c.expected, c.expectPaid, i.Status, i.AmountPaid)
+		}
+	}
+
+	i := Invoice{Amount: 10000, Currency: "JPY", Status: StatusIssued}
+	expected := "invalid payment: the payment cannot have more than 0 decimals in JPY"
+	if err := i.Apply(EventPay, 150); err == nil || err.Error() != expected {
+		t.Errorf("error should have been %q, but was %v instead.", expected, err)
+	}
+}
+
+func TestCheckInvoiceStatus(t *testing.T) {
+	for _, status := range InvoiceStatuses {
+		if err := CheckInvoiceStatus(string(status)); err != nil {
+			t.Errorf("%v should have been valid, but was %v instead.", status, err)
+		}
+	}
+	if err := CheckInvoiceStatus("open"); err == nil {
+		t.Errorf("open should have been invalid.")
+	}
+}
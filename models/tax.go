@@ -0,0 +1,226 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	TAX_CODE_MAX_LENGTH  = 16
+	taxRateDecimals      = 4
+	taxRateIntegerDigits = 3
+	taxRateScale         = 10000
+	wholeTaxRate         = 100 * taxRateScale
+)
+
+var InvalidTaxRule = errors.New("invalid tax rule")
+
+type TaxRate int64
+
+var taxRateFormat = fixedPoint{decimals: taxRateDecimals, integerDigits: taxRateIntegerDigits, min: 0, max: wholeTaxRate, trimZeros: true,
+	kind: InvalidTaxRule, rule: "rate must be a percentage from 0 to 100 with up to four decimals"}
+
+func ParseTaxRate(s string) (TaxRate, error) {
+	units, err := taxRateFormat.parse(s)
+	return TaxRate(units), err
+}
+
+func (r TaxRate) String() string {
+	return taxRateFormat.format(int64(r))
+}
+
+func (r TaxRate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *TaxRate) UnmarshalJSON(b []byte) error {
+	units, err := taxRateFormat.unmarshalJSON(b)
+	*r = TaxRate(units)
+	return err
+}
+
+func (r *TaxRate) Scan(value interface{}) error {
+	units, err := taxRateFormat.scan(value)
+	*r = TaxRate(units)
+	return err
+}
+
+func (r TaxRate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+type TaxScope string
+
+const (
+	TaxPerInvoice TaxScope = "invoice"
+	TaxPerLine    TaxScope = "line"
+)
+
+// TaxRule is the rate of the tax Code from EffectiveFrom on, until the rule
+// of a later date. An inclusive tax is part of the amounts it is computed
+// over, as ISS usually is in Brazil; an exclusive one is added to them, as
+// sales taxes are.
+type TaxRule struct {
+	Code          string       `json:"code"`
+	Rate          TaxRate      `json:"rate"`
+	EffectiveFrom string       `json:"effective_from"`
+	Scope         TaxScope     `json:"scope"`
+	Inclusive     bool         `json:"inclusive"`
+	Rounding      RoundingMode `json:"rounding"`
+}
+
+func (r *TaxRule) Check() error {
+	if r.Code == "" || utf8.RuneCountInString(r.Code) > TAX_CODE_MAX_LENGTH {
+		return fmt.Errorf("%w: code must have between 1 and %d characters", InvalidTaxRule, TAX_CODE_MAX_LENGTH)
+	}
+	if r.Rate < 0 || r.Rate > wholeTaxRate {
+		return fmt.Errorf("%w: rate must be a percentage from 0 to 100", InvalidTaxRule)
+	}
+	if _, err := time.Parse(FXRateDateFormat, r.EffectiveFrom); err != nil {
+		return fmt.Errorf("%w: effective_from must look like %s", InvalidTaxRule, FXRateDateFormat)
+	}
+	if r.Scope == "" {
+		r.Scope = TaxPerInvoice
+	}
+	if r.Scope != TaxPerInvoice && r.Scope != TaxPerLine {
+		return fmt.Errorf("%w: scope must be %s or %s", InvalidTaxRule, TaxPerInvoice, TaxPerLine)
+	}
+	if r.Rounding == "" {
+		r.Rounding = RoundHalfUp
+	}
+	for _, mode := range RoundingModes {
+		if r.Rounding == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: rounding must be one of %v", InvalidTaxRule, RoundingModes)
+}
+
+func (r *TaxRule) tax(base Money, currency string) (Money, error) {
+	n := new(big.Int).Mul(big.NewInt(int64(base)), big.NewInt(int64(r.Rate)))
+	d := big.NewInt(wholeTaxRate)
+	if r.Inclusive {
+		d.Add(d, big.NewInt(int64(r.Rate)))
+	}
+	return divideMoney(n, d, currency, r.Rounding)
+}
+
+type Tax struct {
+	Code      string  `json:"code"`
+	Rate      TaxRate `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Base      Money   `json:"base"`
+	Amount    Money   `json:"amount"`
+}
+
+type TaxEngine interface {
+	ComputeTaxes(invoice *Invoice, items []LineItem) ([]Tax, error)
+}
+
+// TaxRules is a TaxEngine that applies, for each code, the rule in effect
+// on the day an invoice was created, in UTC. A rule with a rate of 0 stops
+// the tax.
+type TaxRules []TaxRule
+
+func ReadTaxRules(r io.Reader) (TaxRules, error) {
+	var document struct {
+		Rules []json.RawMessage `json:"rules"`
+	}
+	if err := decodeStrictJSON(r, &document); err != nil {
+		return nil, fmt.Errorf("%w: %w", InvalidTaxRule, err)
+	}
+	rules := make(TaxRules, len(document.Rules))
+	for k, raw := range document.Rules {
+		err := decodeStrictJSON(bytes.NewReader(raw), &rules[k])
+		if err == nil {
+			err = rules[k].Check()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", k, err)
+		}
+	}
+	sort.SliceStable(rules, func(a, b int) bool {
+		if rules[a].Code != rules[b].Code {
+			return rules[a].Code < rules[b].Code
+		}
+		return rules[a].EffectiveFrom < rules[b].EffectiveFrom
+	})
+	for k := 1; k < len(rules); k++ {
+		if rules[k].Code == rules[k-1].Code && rules[k].EffectiveFrom == rules[k-1].EffectiveFrom {
+			return nil, fmt.Errorf("%w: %s has two rules from %s", InvalidTaxRule, rules[k].Code, rules[k].EffectiveFrom)
+		}
+	}
+	return rules, nil
+}
+
+func decodeStrictJSON(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func (rules TaxRules) inEffect(date string) (effective []TaxRule) {
+	for _, rule := range rules {
+		if rule.EffectiveFrom > date {
+			continue
+		}
+		last := len(effective) - 1
+		if last >= 0 && effective[last].Code == rule.Code {
+			effective[last] = rule
+		} else {
+			effective = append(effective, rule)
+		}
+	}
+	return
+}
+
+func (rules TaxRules) ComputeTaxes(invoice *Invoice, items []LineItem) (taxes []Tax, err error) {
+	for _, rule := range rules.inEffect(invoice.CreatedAt.UTC().Format(FXRateDateFormat)) {
+		if rule.Rate == 0 {
+			continue
+		}
+		tax := Tax{Code: rule.Code, Rate: rule.Rate, Inclusive: rule.Inclusive}
+		for _, item := range items {
+			tax.Base += item.Total
+			if rule.Scope == TaxPerLine {
+				amount, err := rule.tax(item.Total, invoice.Currency)
+				if err != nil {
+					return nil, err
+				}
+				if tax.Amount += amount; tax.Amount.Check() != nil {
+					return nil, MoneyOutOfRange
+				}
+			}
+		}
+		if rule.Scope == TaxPerInvoice {
+			if tax.Amount, err = rule.tax(tax.Base, invoice.Currency); err != nil {
+				return nil, err
+			}
+		}
+		taxes = append(taxes, tax)
+	}
+	return taxes, nil
+}
+
+func computeTaxes(engine TaxEngine, i *Invoice, items []LineItem) ([]Tax, error) {
+	if engine == nil {
+		return nil, nil
+	}
+	return engine.ComputeTaxes(i, items)
+}
+
+// TaxStore keeps the taxes of invoices. Stores compute them with their
+// engine whenever an invoice is created or its items or currency change, so
+// the taxes of an invoice stay those of the rules of the time.
+type TaxStore interface {
+	SetTaxEngine(engine TaxEngine)
+	GetInvoiceTaxes(tenant string, id int) (*Invoice, []Tax, error)
+}
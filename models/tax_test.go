@@ -0,0 +1,160 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// taxesString writes taxes as "code rate% of base = amount".
+func taxesString(taxes []Tax) string {
+	s := make([]string, len(taxes))
+	for k, tax := range taxes {
+		s[k] = fmt.Sprintf("%s %v%% of %v = %v", tax.Code, tax.Rate, tax.Base, tax.Amount)
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestParseTaxRate(t *testing.T) {
+	var cases = []struct {
+		value    string
+		expected TaxRate
+		valid    bool
+	}{
+		{"0", 0, true},
+		{"5", 50000, true},
+		{"9.25", 92500, true},
+		{"0.0001", 1, true},
+		{"100", 1000000, true},
+		{"0.00001", 0, false},
+		{"100.0001", 0, false},
+		{"-1", 0, false},
+		{"5%", 0, false},
+	}
+	for _, c := range cases {
+		r, err := ParseTaxRate(c.value)
+		if r != c.expected || (err == nil) != c.valid {
+			t.Errorf("%q: rate should have been %v (valid: %v), but was %v (%v) instead.", c.value, c.expected, c.valid, r, err)
+		}
+		if c.valid && r.String() != c.value {
+			t.Errorf("%q: string should have been %q, but was %q instead.", c.value, c.value, r.String())
+		}
+	}
+}
+
+func TestReadTaxRules(t *testing.T) {
+	rules, err := ReadTaxRules(strings.NewReader(`{"rules": [
+		{"code": "PIS", "rate": 0.65, "effective_from": "2016-01-01", "scope": "line", "inclusive": true, "rounding": "half_even"},
+		{"code": "ISS", "rate": "5", "effective_from": "2016-07-01"},
+		{"code": "ISS", "rate": 2, "effective_from": "2016-01-01"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TaxRules{
+		{Code: "ISS", Rate: 20000, EffectiveFrom: "2016-01-01", Scope: TaxPerInvoice, Rounding: RoundHalfUp},
+		{Code: "ISS", Rate: 50000, EffectiveFrom: "2016-07-01", Scope: TaxPerInvoice, Rounding: RoundHalfUp},
+		{Code: "PIS", Rate: 6500, EffectiveFrom: "2016-01-01", Scope: TaxPerLine, Inclusive: true, Rounding: RoundHalfEven},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(expected) {
+		t.Errorf("rules should have been %+v, but were %+v instead.", expected, rules)
+	}
+
+	var errors = []struct {
+		json string
+		err  string
+	}{
+		{`{"rules": [{"code": "", "rate": 5, "effective_from": "2016-01-01"}]}`, "rule 0: invalid tax rule: code must have between 1 and 16 characters"},
+		{`{"rules": [{"code": "ISS", "rate": 101, "effective_from": "2016-01-01"}]}`, "rule 0: invalid tax rule: rate must be a percentage from 0 to 100 with up to four decimals"},
+		{`{"rules": [{"code": "ISS", "rate": 5, "effective_from": "01/01/2016"}]}`, "rule 0: invalid tax rule: effective_from must look like 2006-01-02"},
+		{`{"rules": [{"code": "ISS", "rate": 5, "effective_from": "2016-01-01", "scope": "item"}]}`, "rule 0: invalid tax rule: scope must be invoice or line"},
+		{`{"rules": [{"code": "ISS", "rate": 5, "effective_from": "2016-01-01", "rounding": "ceil"}]}`, "rule 0: invalid tax rule: rounding must be one of [half_up half_even down up]"},
+		{`{"rules": [{"code": "ISS", "rate": 5, "effective_from": "2016-01-01"}, {"code": "ISS", "rate": 2, "effective_from": "2016-01-01"}]}`, "invalid tax rule: ISS has two rules from 2016-01-01"},
+		{`{"rules": [{"code": "ISS", "rate": 5, "effective_from": "2016-01-01", "inclusve": true}]}`, `rule 0: json: unknown field "inclusve"`},
+	}
+	for _, c := range errors {
+		if _, err := ReadTaxRules(strings.NewReader(c.json)); err == nil || err.Error() != c.err {
+			t.Errorf("%s: error should have been %q, but was %v instead.", c.json, c.err, err)
+		}
+	}
+}
+
+func TestComputeTaxes(t *testing.T) {
+	rule := func(rate TaxRate, scope TaxScope, inclusive bool, rounding RoundingMode) TaxRule {
+		return TaxRule{Code: "T", Rate: rate, EffectiveFrom: "2016-01-01", Scope: scope, Inclusive: inclusive, Rounding: rounding}
+	}
+	item := func(total Money) LineItem {
+		return LineItem{Quantity: 1, UnitPrice: total, Total: total}
+	}
+	jan := time.Date(2016, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		rule     TaxRule
+		currency string
+		items    []LineItem
+		expected string
+	}{
+		// 5% of 10.10 is 0.505 and of 10.30 is 0.515
+		{rule(50000, TaxPerInvoice, false, RoundHalfUp), "BRL", []LineItem{item(1010)}, "T 5% of 10.10 = 0.51"},
+		{rule(50000, TaxPerInvoice, false, RoundHalfEven), "BRL", []LineItem{item(1010)}, "T 5% of 10.10 = 0.50"},
+		{rule(50000, TaxPerInvoice, false, RoundHalfEven), "BRL", []LineItem{item(1030)}, "T 5% of 10.30 = 0.52"},
+		{rule(50000, TaxPerInvoice, false, RoundDown), "BRL", []LineItem{item(1030)}, "T 5% of 10.30 = 0.51"},
+		{rule(50000, TaxPerInvoice, false, RoundUp), "BRL", []LineItem{item(1005)}, "T 5% of 10.05 = 0.51"},
+		{rule(50000, TaxPerInvoice, false, RoundHalfUp), "BRL", []LineItem{item(-1010)}, "T 5% of -10.10 = -0.51"},
+		{rule(50000, TaxPerInvoice, false, RoundDown), "BRL", []LineItem{item(-1030)}, "T 5% of -10.30 = -0.51"},
+		// an inclusive 5% is 5/105 of the amounts
+		{rule(50000, TaxPerInvoice, true, RoundHalfUp), "BRL", []LineItem{item(10500)}, "T 5% of 105.00 = 5.00"},
+		{rule(50000, TaxPerInvoice, true, RoundHalfUp), "BRL", []LineItem{item(10000)}, "T 5% of 100.00 = 4.76"},
+		// 5% of 0.10 is half a cent, rounded per item or once
+		{rule(50000, TaxPerLine, false, RoundHalfUp), "BRL", []LineItem{item(10), item(10), item(10)}, "T 5% of 0.30 = 0.03"},
+		{rule(50000, TaxPerInvoice, false, RoundHalfUp), "BRL", []LineItem{item(10), item(10), item(10)}, "T 5% of 0.30 = 0.02"},
+		// rounded to whole yen
+		{rule(30000, TaxPerInvoice, false, RoundHalfUp), "JPY", []LineItem{item(15000)}, "T 3% of 150.00 = 5.00"},
+		{rule(30000, TaxPerInvoice, false, RoundHalfEven), "JPY", []LineItem{item(15000)}, "T 3% of 150.00 = 4.00"},
+		{rule(50000, TaxPerInvoice, false, RoundHalfUp), "BRL", nil, "T 5% of 0.00 = 0.00"},
+		{rule(0, TaxPerInvoice, false, RoundHalfUp), "BRL", []LineItem{item(1000)}, ""},
+	}
+	for _, c := range cases {
+		taxes, err := TaxRules{c.rule}.ComputeTaxes(&Invoice{CreatedAt: jan, Currency: c.currency}, c.items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := taxesString(taxes); actual != c.expected {
+			t.Errorf("%+v in %v: taxes should have been %q, but were %q instead.", c.rule, c.currency, c.expected, actual)
+		}
+	}
+
+	if _, err := (TaxRules{rule(wholeTaxRate, TaxPerLine, false, RoundHalfUp)}).ComputeTaxes(&Invoice{CreatedAt: jan, Currency: "BRL"}, []LineItem{item(MaxMoney), item(1)}); err != MoneyOutOfRange {
+		t.Errorf("error should have been %v, but was %v instead.", MoneyOutOfRange, err)
+	}
+}
+
+func TestComputeTaxesByEffectiveDate(t *testing.T) {
+	rules := TaxRules{
+		{Code: "A", Rate: 100000, EffectiveFrom: "2016-01-01", Scope: TaxPerInvoice, Rounding: RoundHalfUp},
+		{Code: "A", Rate: 0, EffectiveFrom: "2016-07-01", Scope: TaxPerInvoice, Rounding: RoundHalfUp},
+		{Code: "B", Rate: 200000, EffectiveFrom: "2016-07-01", Scope: TaxPerInvoice, Rounding: RoundHalfUp},
+	}
+	brt := time.FixedZone("BRT", -3*3600)
+
+	var cases = []struct {
+		at       time.Time
+		expected string
+	}{
+		{time.Date(2015, 12, 31, 12, 0, 0, 0, time.UTC), ""},
+		{time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC), "A 10% of 100.00 = 10.00"},
+		// a day starts at midnight UTC
+		{time.Date(2016, 6, 30, 20, 0, 0, 0, brt), "A 10% of 100.00 = 10.00"},
+		{time.Date(2016, 6, 30, 21, 0, 0, 0, brt), "B 20% of 100.00 = 20.00"},
+	}
+	for _, c := range cases {
+		taxes, err := rules.ComputeTaxes(&Invoice{CreatedAt: c.at, Currency: "BRL"}, []LineItem{{Quantity: 1, UnitPrice: 10000, Total: 10000}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := taxesString(taxes); actual != c.expected {
+			t.Errorf("%v: taxes should have been %q, but were %q instead.", c.at, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
+)
+
+const (
+	apiKeyNameMaxLength = 255
+)
+
+func (env *Env) apiKeysIndex(c *gin.Context) {
+	keys, err := env.apiKeys.GetAPIKeys(tenant(c))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": keys})
+}
+
+func (env *Env) apiKeysCreate(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" || len(name) > apiKeyNameMaxLength {
+		respondWithError(c, http.StatusBadRequest, "name parameter must have between 1 and 255 characters")
+		return
+	}
+
+	scopes := strings.Fields(strings.Replace(c.PostForm("scopes"), ",", " ", -1))
+	if len(scopes) == 0 || models.CheckScopes(scopes) != nil {
+		respondWithError(c, http.StatusBadRequest, "scopes parameter must list some of "+strings.Join(models.Scopes, ", "))
+		return
+	}
+	if !holdsAll(c, scopes) {
+		return
+	}
+
+	var expiresAt models.NullTime
+	if value := c.PostForm("expiresAt"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil || !t.After(time.Now()) {
+			respondWithError(c, http.StatusBadRequest, "expiresAt parameter must be a future RFC 3339 date")
+			return
+		}
+		expiresAt = models.NullTime{Time: t, Valid: true}
+	}
+
+	secret, prefix, hash, err := models.NewAPIKeySecret()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	key := models.APIKey{
+		TenantId:  tenant(c),
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	id, err := env.apiKeys.InsertAPIKey(key)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	key.Id = int(id)
+
+	c.Header("Location", fmt.Sprint(c.Request.Host, "/admin/apikeys/", id))
+	c.JSON(http.StatusCreated, gin.H{"item": key, "secret": secret})
+}
+
+func (env *Env) apiKeysRotate(c *gin.Context) {
+	id, ok := apiKeyIdParam(c)
+	if !ok {
+		return
+	}
+	key, err := env.apiKeys.GetAPIKeyById(tenant(c), id)
+	if err != nil {
+		respondWithAPIKeyError(c, err)
+		return
+	}
+	if !holdsAll(c, key.Scopes) {
+		return
+	}
+
+	secret, prefix, hash, err := models.NewAPIKeySecret()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = env.apiKeys.RotateAPIKey(tenant(c), id, prefix, hash); err != nil {
+		respondWithAPIKeyError(c, err)
+		return
+	}
+	if key, err = env.apiKeys.GetAPIKeyById(tenant(c), id); err != nil {
+		respondWithAPIKeyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": key, "secret": secret})
+}
+
+func (env *Env) apiKeysRevoke(c *gin.Context) {
+	id, ok := apiKeyIdParam(c)
+	if !ok {
+		return
+	}
+	if err := env.apiKeys.RevokeAPIKey(tenant(c), id, time.Now()); err != nil {
+		respondWithAPIKeyError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func apiKeyIdParam(c *gin.Context) (id int, ok bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "parameter id should be an integer")
+		return 0, false
+	}
+	return id, true
+}
+
+func respondWithAPIKeyError(c *gin.Context, err error) {
+	if err == models.APIKeyNotFound {
+		respondWithError(c, http.StatusNotFound, "there is no active API key with the specified id")
+		return
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+}
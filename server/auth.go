@@ -0,0 +1,249 @@
+package server
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/igormartire/gorfiv/models"
+)
+
+const (
+	apiKeyLastUsedResolution = time.Minute
+)
+
+var (
+	errUnknownKey = errors.New("token signed with an unknown key")
+	errNoExpiry   = errors.New("token has no exp claim")
+)
+
+type JWTConfig struct {
+	Secret    []byte
+	PublicKey crypto.PublicKey
+	KeySet    map[string]interface{}
+	Audience  string
+	Issuer    string
+	// TenantClaim is the claim naming the tenant of the principal, "tenant"
+	// by default. Tokens without it are rejected, unless DefaultTenant is
+	// set, in which case they belong to DefaultTenant.
+	TenantClaim   string
+	DefaultTenant string
+}
+
+type Principal struct {
+	Subject  string
+	Claims   map[string]interface{}
+	Scopes   []string
+	APIKeyId int
+	TenantId string
+	Operator bool
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func principal(c *gin.Context) *Principal {
+	if p, ok := c.Get("Principal"); ok {
+		return p.(*Principal)
+	}
+	return nil
+}
+
+func tenant(c *gin.Context) string {
+	if p := principal(c); p != nil {
+		return p.TenantId
+	}
+	return ""
+}
+
+func (config JWTConfig) key(token *jwt.Token) (interface{}, error) {
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok := config.KeySet[kid]; ok {
+			return key, nil
+		}
+		return nil, errUnknownKey
+	}
+
+	var key interface{}
+	if token.Method == jwt.SigningMethodHS256 {
+		key = config.Secret
+		if len(config.Secret) == 0 {
+			key = nil
+		}
+	} else {
+		key = config.PublicKey
+	}
+	if key == nil {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+func (config JWTConfig) parseToken(raw string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}))
+	if _, err := parser.ParseWithClaims(raw, claims, config.key); err != nil {
+		return nil, err
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, errNoExpiry
+	}
+	if config.Audience != "" && !claims.VerifyAudience(config.Audience, true) {
+		return nil, errors.New("token has an invalid audience")
+	}
+	if config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return nil, errors.New("token has an invalid issuer")
+	}
+	return claims, nil
+}
+
+func authMiddleware(config Config, apiKeys models.APIKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var p *Principal
+		switch {
+		case c.GetHeader("X-API-Key") != "":
+			p = apiKeyPrincipal(c, apiKeys)
+		case c.GetHeader("Authorization") != "" || !config.LegacyTokenAuth:
+			p = bearerPrincipal(c, config.JWT)
+		default:
+			p = legacyPrincipal(c, config.APIToken)
+		}
+		if p == nil {
+			return
+		}
+
+		c.Set("Principal", p)
+		c.Next()
+	}
+}
+
+func bearerPrincipal(c *gin.Context, config JWTConfig) *Principal {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="gorfiv"`)
+		respondWithError(c, http.StatusUnauthorized, "Authorization header required")
+		return nil
+	}
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		c.Header("WWW-Authenticate", `Bearer realm="gorfiv"`)
+		respondWithError(c, http.StatusUnauthorized, "Authorization header must be a Bearer token")
+		return nil
+	}
+
+	claims, err := config.parseToken(strings.TrimSpace(header[7:]))
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="gorfiv", error="invalid_token"`)
+		respondWithError(c, http.StatusUnauthorized, "Invalid bearer token: "+err.Error())
+		return nil
+	}
+
+	tenantId, err := config.claimTenant(claims)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="gorfiv", error="invalid_token"`)
+		respondWithError(c, http.StatusUnauthorized, "Invalid bearer token: "+err.Error())
+		return nil
+	}
+
+	subject, _ := claims["sub"].(string)
+	return &Principal{Subject: subject, Claims: claims, Scopes: claimScopes(claims), TenantId: tenantId}
+}
+
+// claimTenant reads the tenant claim, which must be a string of at most
+// models.TENANT_MAX_LENGTH characters. Tokens without it never fall into
+// the tenant of the legacy apiToken, "", unless it is configured.
+func (config JWTConfig) claimTenant(claims jwt.MapClaims) (string, error) {
+	name := config.TenantClaim
+	if name == "" {
+		name = "tenant"
+	}
+	value, ok := claims[name]
+	if !ok {
+		if config.DefaultTenant == "" {
+			return "", fmt.Errorf("token has no %s claim", name)
+		}
+		return config.DefaultTenant, nil
+	}
+	tenantId, ok := value.(string)
+	if !ok || len(tenantId) > models.TENANT_MAX_LENGTH {
+		return "", fmt.Errorf("token has an invalid %s claim", name)
+	}
+	return tenantId, nil
+}
+
+func claimScopes(claims jwt.MapClaims) (scopes []string) {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	switch scp := claims["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []interface{}:
+		for _, scope := range scp {
+			if s, ok := scope.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return
+}
+
+func apiKeyPrincipal(c *gin.Context, apiKeys models.APIKeyStore) *Principal {
+	if apiKeys == nil {
+		respondWithError(c, http.StatusUnauthorized, "API keys are not supported")
+		return nil
+	}
+
+	key, err := apiKeys.GetAPIKeyByHash(models.HashAPIKeySecret(c.GetHeader("X-API-Key")))
+	if err == models.APIKeyNotFound {
+		respondWithError(c, http.StatusUnauthorized, "Invalid API key")
+		return nil
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil
+	}
+
+	now := time.Now()
+	if !key.Usable(now) {
+		respondWithError(c, http.StatusUnauthorized, "Invalid API key")
+		return nil
+	}
+	// recording every single use would turn each read into a write
+	if !key.LastUsedAt.Valid || now.Sub(key.LastUsedAt.Time) > apiKeyLastUsedResolution {
+		if err = apiKeys.TouchAPIKey(key.Id, now); err != nil {
+			c.Error(err)
+		}
+	}
+
+	return &Principal{Subject: "apikey:" + strconv.Itoa(key.Id), Scopes: key.Scopes, APIKeyId: key.Id, TenantId: key.TenantId}
+}
+
+func legacyPrincipal(c *gin.Context, apiToken string) *Principal {
+	userToken := c.Request.FormValue("apiToken")
+
+	if userToken == "" {
+		respondWithError(c, http.StatusUnauthorized, "API token required")
+		return nil
+	}
+
+	if userToken != apiToken {
+		respondWithError(c, http.StatusUnauthorized, "Invalid API token")
+		return nil
+	}
+
+	// the shared token could do everything, in the only tenant, before
+	// scopes and tenants existed
+	return &Principal{Subject: "apiToken", Scopes: models.Scopes, Operator: true}
+}
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/igormartire/gorfiv/models"
+)
+
+const jwtSecret = "a-very-secret-secret"
+
+// jwtTenant is the tenant of the tokens signed by the tests.
+const jwtTenant = "acme"
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":    "alice",
+		"scope":  "invoices:read",
+		"aud":    "gorfiv",
+		"iss":    "https://issuer.example",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"roles":  []string{RoleViewer},
+		"tenant": jwtTenant,
+	}
+}
+
+// writeJWKS writes a key set holding ecKey under kid to a temporary file.
+func writeJWKS(t *testing.T, kid string, ecKey *ecdsa.PublicKey) string {
+	coordinate := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	set := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": kid,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   coordinate(ecKey.X.FillBytes(make([]byte, 32))),
+			"y":   coordinate(ecKey.Y.FillBytes(make([]byte, 32))),
+		}},
+	}
+	b, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writePublicKeyPEM(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherECKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	publicKey, err := LoadPublicKey(writePublicKeyPEM(t, &rsaKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySet, err := LoadJWKS(writeJWKS(t, "ec1", &ecKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig
+	config.LegacyTokenAuth = false
+	config.JWT = JWTConfig{
+		Secret:    []byte(jwtSecret),
+		PublicKey: publicKey,
+		KeySet:    keySet,
+		Audience:  "gorfiv",
+		Issuer:    "https://issuer.example",
+	}
+	server := New(NewEnv(newTenantRepoWithStub(jwtTenant)), config)
+
+	claimsWith := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	hs256 := func(claims jwt.MapClaims) string {
+		return "Bearer " + signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims)
+	}
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	var cases = []struct {
+		name          string
+		authorization string
+		expectedCode  int
+	}{
+		{"HS256", hs256(validClaims()), http.StatusOK},
+		{"lowercase scheme", "bearer " + signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), validClaims()), http.StatusOK},
+		{"RS256", "Bearer " + signToken(t, jwt.SigningMethodRS256, "", rsaKey, validClaims()), http.StatusOK},
+		{"ES256 by kid", "Bearer " + signToken(t, jwt.SigningMethodES256, "ec1", ecKey, validClaims()), http.StatusOK},
+		{"missing header", "", http.StatusUnauthorized},
+		{"basic scheme", "Basic YWxpY2U6cGFzcw==", http.StatusUnauthorized},
+		{"malformed", "Bearer not-a-jwt", http.StatusUnauthorized},
+		{"wrong secret", "Bearer " + signToken(t, jwt.SigningMethodHS256, "", []byte("wrong"), validClaims()), http.StatusUnauthorized},
+		{"unknown kid", "Bearer " + signToken(t, jwt.SigningMethodES256, "ec2", ecKey, validClaims()), http.StatusUnauthorized},
+		{"other EC key", "Bearer " + signToken(t, jwt.SigningMethodES256, "ec1", otherECKey, validClaims()), http.StatusUnauthorized},
+		{"alg none", "Bearer " + unsigned, http.StatusUnauthorized},
+		{"HS384", "Bearer " + signToken(t, jwt.SigningMethodHS384, "", []byte(jwtSecret), validClaims()), http.StatusUnauthorized},
+		{"expired", hs256(claimsWith("exp", time.Now().Add(-time.Minute).Unix())), http.StatusUnauthorized},
+		{"no exp", hs256(claimsWith("exp", nil)), http.StatusUnauthorized},
+		{"not yet valid", hs256(claimsWith("nbf", time.Now().Add(time.Hour).Unix())), http.StatusUnauthorized},
+		{"wrong audience", hs256(claimsWith("aud", "other")), http.StatusUnauthorized},
+		{"audience list", hs256(claimsWith("aud", []string{"other", "gorfiv"})), http.StatusOK},
+		{"wrong issuer", hs256(claimsWith("iss", "https://evil.example")), http.StatusUnauthorized},
+		{"no tenant", hs256(claimsWith("tenant", nil)), http.StatusUnauthorized},
+		{"legacy token", "", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		path := "/invoices/1"
+		if c.name == "legacy token" {
+			path += "?apiToken=" + apiToken
+		}
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.name, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.expectedCode == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%v: WWW-Authenticate header should have been set.", c.name)
+		}
+	}
+}
+
+func TestJWTPrincipal(t *testing.T) {
+	config := Config{JWT: JWTConfig{Secret: []byte(jwtSecret)}}
+	var got *Principal
+	router := gin.New()
+	router.GET("/", authMiddleware(config, nil), func(c *gin.Context) {
+		got = principal(c)
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	claims := validClaims()
+	req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got == nil || got.Subject != "alice" || got.Claims["scope"] != "invoices:read" {
+		t.Errorf("principal should have been alice with the token claims, but was %+v instead.", got)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	invoice := invoiceStub
+	invoice.TenantId = "acme"
+	repo.InsertInvoice(invoice)
+	server := New(NewEnv(repo), Config{JWT: JWTConfig{Secret: []byte(jwtSecret), TenantClaim: "org"}})
+
+	token := func(tenant interface{}) string {
+		claims := validClaims()
+		claims["scope"] = "invoices:read invoices:write invoices:delete"
+		claims["roles"] = []string{RoleSupervisor}
+		if tenant != nil {
+			claims["org"] = tenant
+		}
+		return signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims)
+	}
+	do := func(method string, path string, tenant interface{}, idempotencyKey string) *httptest.ResponseRecorder {
+		body, contentType := url.Values{"document": {"doc"}, "amount": {"1"}}.Encode(), "application/x-www-form-urlencoded"
+		if method == "PATCH" {
+			body, contentType = `{"document": "doc"}`, mergePatchContentType
+		}
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+token(tenant))
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	var cases = []struct {
+		method       string
+		path         string
+		tenant       interface{}
+		expectedCode int
+	}{
+		{"GET", "/invoices/1", "acme", http.StatusOK},
+		{"GET", "/invoices/1", "globex", http.StatusNotFound},
+		{"GET", "/invoices/1", nil, http.StatusUnauthorized},
+		{"PUT", "/invoices/1", "globex", http.StatusNotFound},
+		{"PATCH", "/invoices/1", "globex", http.StatusNotFound},
+		{"DELETE", "/invoices/1", "globex", http.StatusNotFound},
+		{"GET", "/invoices/1", 42, http.StatusUnauthorized},
+		{"GET", "/invoices/1", strings.Repeat("x", 65), http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		newAssert(t, c, do(c.method, c.path, c.tenant, "")).StatusCodeEquals(c.expectedCode)
+	}
+	newAssert(t, "GET /invoices globex", do("GET", "/invoices", "globex", "")).HeaderEquals("X-Total-Count", "0")
+
+	// the same Idempotency-Key means different requests in different tenants
+	newAssert(t, "POST acme", do("POST", "/invoices", "acme", "k")).StatusCodeEquals(http.StatusCreated)
+	w := do("POST", "/invoices", "globex", "k")
+	assert := newAssert(t, "POST globex", w)
+	assert.StatusCodeEquals(http.StatusCreated)
+	assert.HeaderEquals("Idempotent-Replayed", "")
+
+	for tenant, expected := range map[string]int{"acme": 2, "globex": 1, "": 0} {
+		if count, _ := repo.CountInvoices(tenant, &models.QueryOptions{}); count != expected {
+			t.Errorf("tenant %q should have had %v invoices, but had %v.", tenant, expected, count)
+		}
+	}
+
+	// tokens without the claim only get a tenant when one is configured
+	server = New(NewEnv(repo), Config{JWT: JWTConfig{Secret: []byte(jwtSecret), TenantClaim: "org", DefaultTenant: "acme"}})
+	newAssert(t, "GET /invoices/1 default tenant", do("GET", "/invoices/1", nil, "")).StatusCodeEquals(http.StatusOK)
+}
+
+func TestAPIKeys(t *testing.T) {
+	server := New(NewEnv(newMemoryRepoWithStub()), testConfig)
+	do := func(method string, path string, form url.Values, apiKey string) *httptest.ResponseRecorder {
+		if apiKey == "" {
+			path += "?apiToken=" + apiToken
+		}
+		req, err := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+	create := func(form url.Values) (id int, secret string) {
+		w := do("POST", "/admin/apikeys", form, "")
+		newAssert(t, form, w).StatusCodeEquals(http.StatusCreated)
+		var response struct {
+			Item   models.APIKey
+			Secret string
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if strings.Contains(w.Body.String(), models.HashAPIKeySecret(response.Secret)) {
+			t.Error("the key hash should not have been exposed.")
+		}
+		return response.Item.Id, response.Secret
+	}
+
+	for _, form := range []url.Values{
+		{"scopes": {"invoices:read"}},
+		{"name": {"ci"}},
+		{"name": {"ci"}, "scopes": {"invoices:everything"}},
+		{"name": {"ci"}, "scopes": {"fxrates:manage"}},
+		{"name": {"ci"}, "scopes": {"invoices:read"}, "expiresAt": {"2000-01-01T00:00:00Z"}},
+	} {
+		newAssert(t, form, do("POST", "/admin/apikeys", form, "")).StatusCodeEquals(http.StatusBadRequest)
+	}
+
+	readerId, reader := create(url.Values{"name": {"reader"}, "scopes": {"invoices:read"}})
+	writerId, writer := create(url.Values{"name": {"writer"}, "scopes": {"invoices:read, invoices:write"}})
+	var cases = []struct {
+		method       string
+		path         string
+		apiKey       string
+		expectedCode int
+	}{
+		{"GET", "/invoices/1", reader, http.StatusOK},
+		{"GET", "/invoices", reader, http.StatusOK},
+		{"PATCH", "/invoices/1", reader, http.StatusForbidden},
+		{"DELETE", "/invoices/1", reader, http.StatusForbidden},
+		{"GET", "/admin/apikeys", reader, http.StatusForbidden},
+		{"PUT", "/invoices/1", writer, http.StatusBadRequest},
+		{"DELETE", "/invoices/1", writer, http.StatusForbidden},
+		{"GET", "/invoices/1", "gk_wrong", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		newAssert(t, c, do(c.method, c.path, nil, c.apiKey)).StatusCodeEquals(c.expectedCode)
+	}
+
+	// a key can't hand out, or take over, scopes it doesn't hold
+	_, manager := create(url.Values{"name": {"manager"}, "scopes": {"apikeys:manage"}})
+	escalate := url.Values{"name": {"admin"}, "scopes": {"apikeys:manage invoices:delete"}}
+	newAssert(t, "create with more scopes", do("POST", "/admin/apikeys", escalate, manager)).StatusCodeEquals(http.StatusForbidden)
+	newAssert(t, "create with the same scopes", do("POST", "/admin/apikeys", url.Values{"name": {"manager2"}, "scopes": {"apikeys:manage"}}, manager)).StatusCodeEquals(http.StatusCreated)
+	newAssert(t, "rotate with more scopes", do("POST", "/admin/apikeys/"+strconv.Itoa(writerId)+"/rotate", nil, manager)).StatusCodeEquals(http.StatusForbidden)
+	newAssert(t, "writer not rotated", do("GET", "/invoices/1", nil, writer)).StatusCodeEquals(http.StatusOK)
+
+	w := do("POST", "/admin/apikeys/"+strconv.Itoa(readerId)+"/rotate", nil, "")
+	newAssert(t, "rotate", w).StatusCodeEquals(http.StatusOK)
+	var rotated struct{ Secret string }
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	newAssert(t, "old secret", do("GET", "/invoices/1", nil, reader)).StatusCodeEquals(http.StatusUnauthorized)
+	newAssert(t, "new secret", do("GET", "/invoices/1", nil, rotated.Secret)).StatusCodeEquals(http.StatusOK)
+
+	newAssert(t, "revoke", do("DELETE", "/admin/apikeys/"+strconv.Itoa(readerId), nil, "")).StatusCodeEquals(http.StatusNoContent)
+	newAssert(t, "revoked", do("GET", "/invoices/1", nil, rotated.Secret)).StatusCodeEquals(http.StatusUnauthorized)
+	newAssert(t, "rotate revoked", do("POST", "/admin/apikeys/"+strconv.Itoa(readerId)+"/rotate", nil, "")).StatusCodeEquals(http.StatusNotFound)
+
+	w = do("GET", "/admin/apikeys", nil, "")
+	var listed struct{ Items []models.APIKey }
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed.Items) != 4 || !listed.Items[0].RevokedAt.Valid || !listed.Items[0].LastUsedAt.Valid {
+		t.Errorf("all keys should have been listed, the first one used and revoked, but got %+v.", listed.Items)
+	}
+}
+
+func TestPolicyRoles(t *testing.T) {
+	policy, err := NewPolicy(nil, nil, map[string][]string{"Bob": {RoleSupervisor}}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig
+	config.JWT = JWTConfig{Secret: []byte(jwtSecret)}
+	config.Policy = policy
+	server := New(NewEnv(newTenantRepoWithStub(jwtTenant)), config)
+
+	token := func(subject string, roles ...string) string {
+		claims := jwt.MapClaims{"sub": subject, "roles": roles, "tenant": jwtTenant, "exp": time.Now().Add(time.Hour).Unix()}
+		return signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims)
+	}
+	scoped := func(scope string, roles ...string) string {
+		claims := jwt.MapClaims{"sub": "dave", "roles": roles, "scope": scope, "tenant": jwtTenant, "exp": time.Now().Add(time.Hour).Unix()}
+		return signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims)
+	}
+	var cases = []struct {
+		method       string
+		token        string
+		expectedCode int
+	}{
+		{"GET", token("alice", RoleViewer), http.StatusOK},
+		{"PATCH", token("alice", RoleViewer), http.StatusForbidden},
+		{"DELETE", token("alice", RoleViewer), http.StatusForbidden},
+		{"GET", token("alice"), http.StatusForbidden},
+		{"GET", token("alice", "unknown"), http.StatusForbidden},
+		{"PATCH", token("carol", RoleClerk), http.StatusNoContent},
+		{"DELETE", token("carol", RoleClerk), http.StatusForbidden},
+		// the scopes of a JWT narrow its roles, but never add to them
+		{"DELETE", scoped("invoices:delete", RoleViewer), http.StatusForbidden},
+		{"GET", scoped("invoices:read"), http.StatusForbidden},
+		{"PATCH", scoped("invoices:read", RoleSupervisor), http.StatusForbidden},
+		{"GET", scoped("invoices:read", RoleSupervisor), http.StatusOK},
+		{"DELETE", token("bob"), http.StatusNoContent},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, "/invoices/1", strings.NewReader(`{"description": "x"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Content-Type", mergePatchContentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c, w)
+		assert.StatusCodeEquals(c.expectedCode)
+
+		if c.expectedCode == http.StatusForbidden {
+			var body map[string]string
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body["code"] != "forbidden" || body["route"] != c.method+" /invoices/:id" || body["permission"] == "" || body["error"] == "" {
+				t.Errorf("%v: 403 body should describe the denied permission, but was %v.", c, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestPolicyDeniesUnlistedRoutes(t *testing.T) {
+	policy, err := NewPolicy(nil, map[string]string{"get /invoices/:id": models.ScopeInvoicesRead}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig
+	config.Policy = policy
+	server := New(NewEnv(newMemoryRepoWithStub()), config)
+
+	for path, expectedCode := range map[string]int{"/invoices/1": http.StatusOK, "/invoices": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", path+"?apiToken="+apiToken, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, path, w).StatusCodeEquals(expectedCode)
+	}
+
+	if _, err = NewPolicy(nil, map[string]string{"/invoices": ""}, nil, "", nil); err == nil {
+		t.Error("a route without a method should have been rejected.")
+	}
+	if _, err = NewPolicy(nil, nil, map[string][]string{"bob": {"owner"}}, "", nil); err == nil {
+		t.Error("a subject with an unknown role should have been rejected.")
+	}
+	if _, err = NewPolicy(map[string][]string{"admin": {models.ScopeFXRatesManage}}, nil, nil, "", nil); err == nil {
+		t.Error("a role granting an operator permission should have been rejected.")
+	}
+}
+
+func TestPolicyOperators(t *testing.T) {
+	policy, err := NewPolicy(nil, nil, nil, "", []string{"Ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig
+	config.JWT = JWTConfig{Secret: []byte(jwtSecret)}
+	config.Policy = policy
+	server := New(NewEnv(newTenantRepoWithStub(jwtTenant)), config)
+
+	token := func(subject string, roles ...string) string {
+		claims := jwt.MapClaims{"sub": subject, "roles": roles, "tenant": jwtTenant, "exp": time.Now().Add(time.Hour).Unix()}
+		return "Bearer " + signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims)
+	}
+	var cases = []struct {
+		authorization string
+		expectedCode  int
+	}{
+		{token("alice", RoleAdmin), http.StatusForbidden},
+		{token("ops"), http.StatusNoContent},
+		{"", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		path := "/admin/fxrates"
+		if c.authorization == "" {
+			path += "?apiToken=" + apiToken
+		}
+		req, err := http.NewRequest("POST", path, strings.NewReader(`[{"date": "2016-01-01", "from": "USD", "to": "BRL", "rate": 4}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, c, w).StatusCodeEquals(c.expectedCode)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func versionETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// parseVersionETag is the inverse of versionETag. Weak ETags never match.
+func parseVersionETag(etag string) (version int, ok bool) {
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil || len(etag) == 0 || etag[0] != '"' {
+		return 0, false
+	}
+	version, err = strconv.Atoi(unquoted)
+	return version, err == nil && version > 0
+}
+
+func ifMatchVersion(c *gin.Context) int {
+	version, _ := c.Get("IfMatchVersion")
+	v, _ := version.(int)
+	return v
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeValidators sets the caching headers of a GET response and answers
+// 304 Not Modified when the client's copy is still fresh, in which case the
+// handler must not write a body. lastModified may be zero when unknown.
+func writeValidators(c *gin.Context, etag string, lastModified time.Time) (notModified bool) {
+	if cacheControl, ok := c.Get("CacheControl"); ok && cacheControl != "" {
+		c.Header("Cache-Control", cacheControl.(string))
+	}
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		notModified = etagMatches(ifNoneMatch, etag)
+	} else if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		notModified = !lastModified.Truncate(time.Second).After(since)
+	}
+
+	if notModified {
+		c.Status(http.StatusNotModified)
+	}
+	return
+}
+
+func cacheControlMiddleware(policy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("CacheControl", policy)
+		c.Next()
+	}
+}
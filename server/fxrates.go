@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
+)
+
+const csvContentType = "text/csv"
+
+func (env *Env) fxRatesUpsert(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var rates []models.FXRate
+	switch c.ContentType() {
+	case csvContentType:
+		if rates, err = models.ReadFXRatesCSV(bytes.NewReader(body)); err != nil {
+			respondWithError(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	case "application/json":
+		if err = decodeJSON(body, &rates); err != nil {
+			respondWithError(c, http.StatusBadRequest, "the body must be a JSON array of rates, each with a date, from, to and rate")
+			return
+		}
+		for k := range rates {
+			if err = rates[k].Check(); err != nil {
+				respondWithError(c, http.StatusUnprocessableEntity, "rate "+strconv.Itoa(k)+": "+err.Error())
+				return
+			}
+		}
+	default:
+		respondWithError(c, http.StatusUnsupportedMediaType, "Content-Type must be application/json or "+csvContentType)
+		return
+	}
+	if len(rates) == 0 {
+		respondWithError(c, http.StatusBadRequest, "the body must hold at least one rate")
+		return
+	}
+
+	if err = env.fxRates.UpsertFXRates(rates); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -13,11 +17,28 @@ import (
 )
 
 type Env struct {
-	repo models.Repo
+	repo        models.Repo
+	idempotency models.IdempotencyStore
+	apiKeys     models.APIKeyStore
+	fxRates     models.FXRateStore
+	lineItems   models.LineItemStore
+	taxes       models.TaxStore
+	statuses    models.StatusStore
 }
 
 func NewEnv(r models.Repo) *Env {
-	return &Env{repo: r}
+	store, _ := r.(models.IdempotencyStore)
+	apiKeys, _ := r.(models.APIKeyStore)
+	fxRates, _ := r.(models.FXRateStore)
+	lineItems, _ := r.(models.LineItemStore)
+	taxes, _ := r.(models.TaxStore)
+	statuses, _ := r.(models.StatusStore)
+	return &Env{repo: r, idempotency: store, apiKeys: apiKeys, fxRates: fxRates, lineItems: lineItems, taxes: taxes, statuses: statuses}
+}
+
+type invoiceWithTaxes struct {
+	*models.Invoice
+	Taxes []models.Tax `json:"taxes"`
 }
 
 func (env *Env) invoicesShow(c *gin.Context) {
@@ -29,7 +50,24 @@ func (env *Env) invoicesShow(c *gin.Context) {
 		return
 	}
 
-	invoice, err := env.repo.GetInvoiceById(id)
+	var fields []string
+	if value, ok := c.GetQuery("fields"); ok {
+		var errMsg string
+		if fields, errMsg = parseFieldsParam(value); errMsg != "" {
+			respondWithError(c, http.StatusBadRequest, errMsg)
+			return
+		}
+	}
+
+	// the whole row is read anyway, as the validators need the version. The
+	// taxes are read along with it, so that they match its ETag.
+	var invoice *models.Invoice
+	var taxes []models.Tax
+	if fields == nil && env.taxes != nil {
+		invoice, taxes, err = env.taxes.GetInvoiceTaxes(tenant(c), id)
+	} else {
+		invoice, err = env.repo.GetInvoiceById(tenant(c), id)
+	}
 
 	if err != nil {
 		if err == models.InvoiceNotFound {
@@ -41,12 +79,39 @@ func (env *Env) invoicesShow(c *gin.Context) {
 			return
 		}
 	} else {
+		if writeValidators(c, versionETag(invoice.Version), invoice.UpdatedAt) {
+			return
+		}
+		var item interface{} = invoice
+		if fields != nil {
+			item = invoice.Project(fields)
+		} else if env.taxes != nil {
+			item = invoiceWithTaxes{invoice, taxes}
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"item": invoice,
+			"item": item,
 		})
 	}
 }
 
+func respondWithVersionConflict(c *gin.Context) {
+	c.JSON(http.StatusPreconditionFailed, gin.H{
+		"error": "the invoice was modified since it was read: If-Match does not match the current ETag",
+	})
+}
+
+func respondWithItemsConflict(c *gin.Context, id int, err error) bool {
+	if err == models.AmountIsComputed {
+		respondWithError(c, http.StatusConflict, "the amount is the total of the line items of the invoice: change them at /invoices/"+strconv.Itoa(id)+"/items")
+		return true
+	}
+	if _, ok := err.(*models.LineItemsError); ok {
+		respondWithError(c, http.StatusUnprocessableEntity, err.Error())
+		return true
+	}
+	return false
+}
+
 func (env *Env) invoicesDelete(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -56,7 +121,14 @@ func (env *Env) invoicesDelete(c *gin.Context) {
 		return
 	}
 
-	nRows, err := env.repo.DeleteInvoice(id)
+	nRows, err := env.repo.DeleteInvoice(tenant(c), id, ifMatchVersion(c))
+	if err == models.VersionConflict {
+		respondWithVersionConflict(c)
+		return
+	}
+	if respondWithNotDraft(c, err) {
+		return
+	}
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -80,30 +152,136 @@ func (env *Env) invoicesPut(c *gin.Context) {
 		return
 	}
 
-	newDescription, exist := c.GetPostForm("description")
-	if !exist {
+	amount, _ := models.ParseMoney(c.PostForm("amount")) //err already checked in middleware
+
+	nRows, err := env.repo.UpdateInvoice(tenant(c), id, ifMatchVersion(c), models.InvoiceFields{
+		"document":    c.PostForm("document"),
+		"description": c.PostForm("description"),
+		"amount":      amount,
+		"currency":    c.DefaultPostForm("currency", models.DefaultCurrency),
+	})
+	if err == models.VersionConflict {
+		respondWithVersionConflict(c)
+		return
+	}
+	if respondWithNotDraft(c, err) || respondWithItemsConflict(c, id, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if nRows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "there is no resource with the specified id",
+		})
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (env *Env) invoicesPatch(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "paramater description must be specified",
+			"error": "parameter id should be an integer",
 		})
 		return
 	}
 
-	_, err = env.repo.UpdateInvoice(id, newDescription)
+	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	c.Status(http.StatusNoContent)
+	var apply func(doc interface{}) (interface{}, error)
+	switch c.ContentType() {
+	case mergePatchContentType:
+		var patch interface{}
+		if err = decodeJSON(body, &patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "malformed JSON body",
+			})
+			return
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, patch), nil
+		}
+	case jsonPatchContentType:
+		ops, err := parseJSONPatch(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return applyJSONPatch(doc, ops)
+		}
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "Content-Type must be " + mergePatchContentType + " or " + jsonPatchContentType,
+		})
+		return
+	}
+
+	var errMsg string
+	var errStatus int
+	err = env.repo.ModifyInvoice(tenant(c), id, ifMatchVersion(c), func(invoice *models.Invoice) (fields models.InvoiceFields, err error) {
+		original, err := invoiceDocument(invoice)
+		if err != nil {
+			return
+		}
+		// patches modify their target, so patch a second copy
+		target, _ := invoiceDocument(invoice)
+
+		patched, err := apply(target)
+		if err != nil {
+			errMsg, errStatus = err.Error(), http.StatusUnprocessableEntity
+			if patchErr, ok := err.(*jsonPatchError); ok && patchErr.err == errTestFailed {
+				errStatus = http.StatusConflict
+			}
+			return
+		}
+
+		fields, errMsg = patchedInvoiceFields(original, patched)
+		if errMsg != "" {
+			errStatus = http.StatusUnprocessableEntity
+			err = errors.New(errMsg)
+		}
+		return
+	})
+
+	switch {
+	case err == nil:
+		c.Status(http.StatusNoContent)
+	case err == models.InvoiceNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "there is no resource with the specified id",
+		})
+	case err == models.VersionConflict:
+		respondWithVersionConflict(c)
+	case respondWithNotDraft(c, err), respondWithItemsConflict(c, id, err):
+	case errMsg != "":
+		c.JSON(errStatus, gin.H{
+			"error": errMsg,
+		})
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
 }
 
 func (env *Env) invoicesPost(c *gin.Context) {
-	amount, _ := strconv.ParseFloat(c.PostForm("amount"), 64) //err already checked in middleware
+	amount, _ := models.ParseMoney(c.PostForm("amount")) //err already checked in middleware
 
 	id, err := env.repo.InsertInvoice(models.Invoice{
+		TenantId:       tenant(c),
 		Document:       c.PostForm("document"),
 		Description:    c.PostForm("description"),
 		Amount:         amount,
+		Currency:       c.DefaultPostForm("currency", models.DefaultCurrency),
 		CreatedAt:      time.Now(),
 		ReferenceMonth: int(time.Now().Month()),
 		ReferenceYear:  time.Now().Year(),
@@ -127,16 +305,19 @@ func (env *Env) invoicesIndex(c *gin.Context) {
 	}
 
 	opts := getValue.(*models.QueryOptions)
+	if opts.Cursor != nil {
+		env.invoicesKeysetIndex(c, opts)
+		return
+	}
 
-	totalCount, err := env.repo.CountInvoices(opts)
+	totalCount, err := env.repo.CountInvoices(tenant(c), opts)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
 	if totalCount == 0 {
-		c.Header("X-Total-Count", "0")
-		c.JSON(http.StatusOK, gin.H{"items": []*models.Invoice{}})
+		respondWithList(c, []*models.Invoice{}, totalCount, opts.Fields)
 		return
 	}
 
@@ -148,33 +329,211 @@ func (env *Env) invoicesIndex(c *gin.Context) {
 		return
 	}
 
-	invoices, err := env.repo.GetInvoices(opts)
+	invoices, err := env.getInvoices(c, opts)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	if !env.convertInvoices(c, invoices) {
+		return
+	}
+
+	writePageLinks(c, opts.Pagination, lastPageNumber)
+	respondWithList(c, invoices, totalCount, opts.Fields)
+}
 
+func writePageLinks(c *gin.Context, p models.Pagination, lastPageNumber int) {
 	var linksHeader []string
-	linkPrefix := "<" + c.Request.Host + "/invoices?"
+	linkPrefix := "<" + c.Request.Host + c.Request.URL.Path + "?"
 	values := c.Request.URL.Query()
-	if opts.Pagination.Page < lastPageNumber {
+	if p.Page < lastPageNumber {
 		//next
-		values.Set("page", strconv.Itoa(opts.Pagination.Page+1))
+		values.Set("page", strconv.Itoa(p.Page+1))
 		linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"next\"")
 		//last
 		values.Set("page", strconv.Itoa(lastPageNumber))
 		linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"last\"")
 	}
-	if opts.Pagination.Page > 1 {
+	if p.Page > 1 {
 		//first
 		values.Set("page", "1")
 		linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"first\"")
 		//prev
-		values.Set("page", strconv.Itoa(opts.Pagination.Page-1))
+		values.Set("page", strconv.Itoa(p.Page-1))
 		linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"prev\"")
 	}
 
-	c.Header("X-Total-Count", strconv.Itoa(totalCount))
 	c.Header("Link", strings.Join(linksHeader, ", "))
-	c.JSON(http.StatusOK, gin.H{"items": invoices})
+}
+
+func (env *Env) invoicesAggregate(c *gin.Context) {
+	getValue, exist := c.Get("AggregateOptions")
+	if !exist {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("Couldn't get AggregateOptions @ handlers.invoicesAggregate"))
+		return
+	}
+	opts := getValue.(*models.AggregateOptions)
+
+	groups, totalCount, err := env.repo.AggregateInvoices(tenant(c), opts)
+	if err == models.MixedCurrencies {
+		respondWithError(c, http.StatusUnprocessableEntity, "metrics over amounts can't add up invoices in different currencies: group by currency or filter on a single one")
+		return
+	} else if err == models.MoneyOutOfRange {
+		respondWithError(c, http.StatusUnprocessableEntity, "the amounts of a group add up to more than a sum can hold: filter or group the invoices further")
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var lastPageNumber = opts.Pagination.LastPageNumber(totalCount)
+	if totalCount > 0 && (opts.Pagination.Page < 1 || opts.Pagination.Page > lastPageNumber) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid page number passed as parameter.",
+		})
+		return
+	}
+
+	items := make([]map[string]interface{}, len(groups))
+	for k, g := range groups {
+		items[k] = map[string]interface{}{}
+		for j, field := range opts.GroupBy {
+			items[k][field] = g.Keys[j]
+		}
+		for j, m := range opts.Metrics {
+			items[k][m.String()] = g.Values[j]
+		}
+	}
+
+	writePageLinks(c, opts.Pagination, lastPageNumber)
+	respondWithItems(c, items, totalCount)
+}
+
+func (env *Env) invoicesKeysetIndex(c *gin.Context, opts *models.QueryOptions) {
+	limit := opts.Pagination.PerPage
+	fetch := *opts
+	fetch.Pagination.PerPage = limit + 1
+	invoices, err := env.getInvoices(c, &fetch)
+	if err == models.InvalidCursor {
+		respondWithError(c, http.StatusBadRequest, "parameter cursor is invalid or was made for another sort")
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if invoices == nil {
+		invoices = []*models.Invoice{}
+	}
+	if !env.convertInvoices(c, invoices) {
+		return
+	}
+
+	before := opts.Cursor.Before
+	more := len(invoices) > limit
+	if more && before {
+		invoices = invoices[1:]
+	} else if more {
+		invoices = invoices[:limit]
+	}
+	// coming back from a later page, or going on from an earlier one,
+	// means there is a page on the other side
+	hasNext := more || before
+	hasPrev := (more && before) || (!before && !opts.Cursor.IsStart())
+
+	var linksHeader []string
+	linkPrefix := "<" + c.Request.Host + "/invoices?"
+	values := c.Request.URL.Query()
+	values.Set("limit", strconv.Itoa(limit))
+	if len(invoices) > 0 {
+		if hasNext {
+			values.Set("cursor", models.NewCursor(invoices[len(invoices)-1], opts.Sorts, false).Encode(opts.Sorts))
+			linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"next\"")
+		}
+		if hasPrev {
+			values.Set("cursor", models.NewCursor(invoices[0], opts.Sorts, true).Encode(opts.Sorts))
+			linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"prev\"")
+		}
+	}
+	if !opts.Cursor.IsStart() {
+		values.Del("cursor")
+		linksHeader = append(linksHeader, linkPrefix+values.Encode()+">; rel=\"first\"")
+	}
+
+	c.Header("Link", strings.Join(linksHeader, ", "))
+	respondWithList(c, invoices, -1, opts.Fields)
+}
+
+func (env *Env) getInvoices(c *gin.Context, opts *models.QueryOptions) ([]*models.Invoice, error) {
+	if c.GetString("Currency") != "" && opts.Fields != nil {
+		fetch := *opts
+		fetch.Fields = append([]string{"amount", "amountPaid", "currency", "createdAt"}, opts.Fields...)
+		opts = &fetch
+	}
+	return env.repo.GetInvoices(tenant(c), opts)
+}
+
+func (env *Env) convertInvoices(c *gin.Context, invoices []*models.Invoice) bool {
+	currency := c.GetString("Currency")
+	if currency == "" {
+		return true
+	}
+	if env.fxRates == nil {
+		respondWithError(c, http.StatusNotImplemented, "currency conversion is not supported by this server")
+		return false
+	}
+
+	converter := models.NewConverter(env.fxRates, currency)
+	for _, invoice := range invoices {
+		amount, err := converter.Convert(invoice.Amount, invoice.Currency, invoice.CreatedAt)
+		if missing, ok := err.(*models.MissingFXRateError); ok {
+			respondWithError(c, http.StatusUnprocessableEntity, "there is no exchange rate from "+missing.From+" to "+missing.To+" on or before "+missing.Date)
+			return false
+		} else if err == models.MoneyOutOfRange {
+			respondWithError(c, http.StatusUnprocessableEntity, "the amount of invoice "+strconv.Itoa(invoice.Id)+" is too large in "+currency)
+			return false
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+		amountPaid, err := converter.Convert(invoice.AmountPaid, invoice.Currency, invoice.CreatedAt)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+		invoice.Amount, invoice.AmountPaid, invoice.Currency = amount, amountPaid, currency
+	}
+	return true
+}
+
+func respondWithList(c *gin.Context, invoices []*models.Invoice, totalCount int, fields []string) {
+	var items interface{} = invoices
+	if fields != nil {
+		projections := make([]map[string]interface{}, len(invoices))
+		for k, invoice := range invoices {
+			projections[k] = invoice.Project(fields)
+		}
+		items = projections
+	}
+	respondWithItems(c, items, totalCount)
+}
+
+func respondWithItems(c *gin.Context, items interface{}, totalCount int) {
+	body, err := json.Marshal(gin.H{"items": items})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	hash := sha1.New()
+	hash.Write(body)
+	fmt.Fprint(hash, totalCount)
+	etag := strconv.Quote(hex.EncodeToString(hash.Sum(nil)))
+
+	if totalCount >= 0 {
+		c.Header("X-Total-Count", strconv.Itoa(totalCount))
+	}
+	if writeValidators(c, etag, time.Time{}) {
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
 }
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
+)
+
+const (
+	idempotencyKeyMaxLength = 255
+	defaultIdempotencyTTL   = 24 * time.Hour
+)
+
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+func requestFingerprint(c *gin.Context) string {
+	// fills PostForm for both url-encoded and multipart bodies
+	c.Request.ParseMultipartForm(32 << 20)
+
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n"))
+	hash.Write([]byte(c.Request.PostForm.Encode()))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func tenantIdempotencyKey(tenant string, key string) string {
+	sum := sha256.Sum256([]byte(tenant + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyMiddleware makes a request carrying an Idempotency-Key header
+// run at most once within ttl: repeats get the stored status, Location and
+// body of the first response back. Server errors are not stored, so that the
+// request can be retried. Without a store the header is ignored.
+func idempotencyMiddleware(store models.IdempotencyStore, ttl time.Duration) gin.HandlerFunc {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" || store == nil {
+			c.Next()
+			return
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			respondWithError(c, http.StatusBadRequest, "Idempotency-Key must have at most 255 characters")
+			return
+		}
+
+		key = tenantIdempotencyKey(tenant(c), key)
+		fingerprint := requestFingerprint(c)
+		stored, err := store.ReserveIdempotencyKey(key, fingerprint, time.Now().Add(-ttl))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.Fingerprint != fingerprint:
+				respondWithError(c, http.StatusUnprocessableEntity, "Idempotency-Key was already used with another request")
+			case stored.Pending():
+				respondWithError(c, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+			default:
+				if stored.Location != "" {
+					c.Header("Location", stored.Location)
+				}
+				c.Header("Idempotent-Replayed", "true")
+				if len(stored.Body) > 0 {
+					c.Data(stored.StatusCode, "application/json; charset=utf-8", stored.Body)
+				} else {
+					c.Status(stored.StatusCode)
+				}
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		// a panicking handler must not leave the key pending until it expires
+		completed := false
+		defer func() {
+			if !completed {
+				store.ReleaseIdempotencyKey(key)
+			}
+		}()
+		c.Next()
+		completed = true
+
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			err = store.ReleaseIdempotencyKey(key)
+		} else {
+			err = store.CompleteIdempotencyKey(models.IdempotentResponse{
+				Key:         key,
+				Fingerprint: fingerprint,
+				StatusCode:  c.Writer.Status(),
+				Location:    c.Writer.Header().Get("Location"),
+				Body:        recorder.body.Bytes(),
+			})
+		}
+		if err != nil {
+			c.Error(err)
+		}
+	}
+}
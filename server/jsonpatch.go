@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	jsonPatchContentType = "application/json-patch+json"
+)
+
+var (
+	errPathNotFound = errors.New("path not found")
+	errTestFailed   = errors.New("test failed")
+)
+
+type jsonPatchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+	value interface{}
+}
+
+func parseJSONPatch(body []byte) (ops []jsonPatchOp, err error) {
+	if err = json.Unmarshal(body, &ops); err != nil {
+		return nil, errors.New("a JSON Patch must be an array of operations")
+	}
+
+	for k := range ops {
+		op := &ops[k]
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, errors.New("operation " + strconv.Itoa(k) + " (" + op.Op + ") is missing its value")
+			}
+			if err = decodeJSON(*op.Value, &op.value); err != nil {
+				return nil, err
+			}
+		case "move", "copy":
+			if _, err = splitJSONPointer(op.From); err != nil {
+				return nil, err
+			}
+		case "remove":
+		default:
+			return nil, errors.New("operation " + strconv.Itoa(k) + " has an invalid op " + strconv.Quote(op.Op))
+		}
+		if _, err = splitJSONPointer(op.Path); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) (interface{}, error) {
+	var err error
+	for k, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, op.Path, op.value)
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, op.Path)
+		case "replace":
+			if doc, _, err = jsonPointerRemove(doc, op.Path); err == nil {
+				doc, err = jsonPointerAdd(doc, op.Path, op.value)
+			}
+		case "move":
+			var value interface{}
+			if doc, value, err = jsonPointerRemove(doc, op.From); err == nil {
+				doc, err = jsonPointerAdd(doc, op.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = jsonPointerGet(doc, op.From); err == nil {
+				doc, err = jsonPointerAdd(doc, op.Path, deepCopy(value))
+			}
+		case "test":
+			var value interface{}
+			if value, err = jsonPointerGet(doc, op.Path); err == nil && !jsonEqual(value, op.value) {
+				err = errTestFailed
+			}
+		}
+		if err != nil {
+			return nil, &jsonPatchError{index: k, op: op, err: err}
+		}
+	}
+	return doc, nil
+}
+
+type jsonPatchError struct {
+	index int
+	op    jsonPatchOp
+	err   error
+}
+
+func (e *jsonPatchError) Error() string {
+	return "operation " + strconv.Itoa(e.index) + " (" + e.op.Op + " " + e.op.Path + "): " + e.err.Error()
+}
+
+func splitJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, errors.New("invalid JSON Pointer " + strconv.Quote(pointer))
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for k, token := range tokens {
+		tokens[k] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func jsonPointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = node[token]; !ok {
+				return nil, errPathNotFound
+			}
+		case []interface{}:
+			k, err := strconv.Atoi(token)
+			if err != nil || k < 0 || k >= len(node) {
+				return nil, errPathNotFound
+			}
+			doc = node[k]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+func jsonPointerParent(doc interface{}, pointer string) (parent interface{}, last string, err error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err = jsonPointerGet(doc, parentPointer)
+	return parent, tokens[len(tokens)-1], err
+}
+
+func jsonPointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	if pointer == "" {
+		return value, nil
+	}
+	parent, last, err := jsonPointerParent(doc, pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		k := len(node)
+		if last != "-" {
+			if k, err = strconv.Atoi(last); err != nil || k < 0 || k > len(node) {
+				return nil, errPathNotFound
+			}
+		}
+		node = append(node, nil)
+		copy(node[k+1:], node[k:])
+		node[k] = value
+		return jsonPointerReplaceArray(doc, pointer[:strings.LastIndex(pointer, "/")], node)
+	default:
+		return nil, errPathNotFound
+	}
+	return doc, nil
+}
+
+func jsonPointerRemove(doc interface{}, pointer string) (newDoc interface{}, removed interface{}, err error) {
+	if removed, err = jsonPointerGet(doc, pointer); err != nil {
+		return
+	}
+	if pointer == "" {
+		return nil, removed, nil
+	}
+	parent, last, err := jsonPointerParent(doc, pointer)
+	if err != nil {
+		return
+	}
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		delete(node, last)
+	case []interface{}:
+		k, _ := strconv.Atoi(last)
+		node = append(node[:k:k], node[k+1:]...)
+		newDoc, err = jsonPointerReplaceArray(doc, pointer[:strings.LastIndex(pointer, "/")], node)
+		return newDoc, removed, err
+	}
+	return doc, removed, nil
+}
+
+func jsonPointerReplaceArray(doc interface{}, pointer string, array []interface{}) (interface{}, error) {
+	if pointer == "" {
+		return array, nil
+	}
+	parent, last, err := jsonPointerParent(doc, pointer)
+	if err != nil {
+		return nil, err
+	}
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = array
+	case []interface{}:
+		k, _ := strconv.Atoi(last)
+		node[k] = array
+	}
+	return doc, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	b, _ := json.Marshal(value)
+	var c interface{}
+	decodeJSON(b, &c)
+	return c
+}
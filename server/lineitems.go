@@ -0,0 +1,257 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
+)
+
+var errLineItemNotFound = errors.New("line item not found")
+
+func (env *Env) lineItemsIndex(c *gin.Context) {
+	id, ok := invoiceIdParam(c)
+	if !ok {
+		return
+	}
+	invoice, items, err := env.lineItems.GetLineItems(tenant(c), id)
+	if err != nil {
+		respondWithLineItemsError(c, err, "")
+		return
+	}
+	if writeValidators(c, versionETag(invoice.Version), invoice.UpdatedAt) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+func (env *Env) lineItemsShow(c *gin.Context) {
+	id, ok := invoiceIdParam(c)
+	if !ok {
+		return
+	}
+	itemId, ok := lineItemIdParam(c)
+	if !ok {
+		return
+	}
+	invoice, items, err := env.lineItems.GetLineItems(tenant(c), id)
+	if err != nil {
+		respondWithLineItemsError(c, err, "")
+		return
+	}
+	k := models.FindLineItem(items, itemId)
+	if k < 0 {
+		respondWithLineItemsError(c, errLineItemNotFound, "")
+		return
+	}
+	if writeValidators(c, versionETag(invoice.Version), invoice.UpdatedAt) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": items[k]})
+}
+
+func (env *Env) lineItemsCreate(c *gin.Context) {
+	id, ok := invoiceIdParam(c)
+	if !ok {
+		return
+	}
+	item, ok := lineItemFromForm(c)
+	if !ok {
+		return
+	}
+
+	var errMsg string
+	items, err := env.lineItems.ModifyLineItems(tenant(c), id, ifMatchVersion(c), func(invoice *models.Invoice, items []models.LineItem) ([]models.LineItem, error) {
+		if err := item.Check(invoice.Currency); err != nil {
+			errMsg = err.Error()
+			return nil, err
+		}
+		return append(items, item), nil
+	})
+	if err != nil {
+		respondWithLineItemsError(c, err, errMsg)
+		return
+	}
+
+	c.Header("Location", fmt.Sprint(c.Request.Host, "/invoices/", id, "/items/", items[len(items)-1].Id))
+	c.Status(http.StatusCreated)
+}
+
+// lineItemsReplace replaces every item of an invoice by those of a JSON
+// array, numbered again from 1. An empty array leaves the invoice without
+// items, and with an amount of 0.
+func (env *Env) lineItemsReplace(c *gin.Context) {
+	id, ok := invoiceIdParam(c)
+	if !ok {
+		return
+	}
+	if c.ContentType() != "application/json" {
+		respondWithError(c, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var documents []struct {
+		Description string        `json:"description"`
+		Quantity    *int          `json:"quantity"`
+		UnitPrice   *models.Money `json:"unitPrice"`
+		Discount    models.Money  `json:"discount"`
+	}
+	if err = decodeJSON(body, &documents); err != nil || documents == nil {
+		respondWithError(c, http.StatusBadRequest, "the body must be a JSON array of items, each with a description, quantity, unitPrice and discount")
+		return
+	}
+	replacement := make([]models.LineItem, len(documents))
+	for k, doc := range documents {
+		if doc.UnitPrice == nil {
+			respondWithError(c, http.StatusUnprocessableEntity, "item "+strconv.Itoa(k)+": unitPrice is required")
+			return
+		}
+		replacement[k] = models.LineItem{Description: doc.Description, Quantity: 1, UnitPrice: *doc.UnitPrice, Discount: doc.Discount}
+		if doc.Quantity != nil {
+			replacement[k].Quantity = *doc.Quantity
+		}
+	}
+
+	_, err = env.lineItems.ModifyLineItems(tenant(c), id, ifMatchVersion(c), func(*models.Invoice, []models.LineItem) ([]models.LineItem, error) {
+		return replacement, nil
+	})
+	if err != nil {
+		respondWithLineItemsError(c, err, "")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (env *Env) lineItemsUpdate(c *gin.Context) {
+	id, ok := invoiceIdParam(c)
+	if !ok {
+		return
+	}
+	itemId, ok := lineItemIdParam(c)
+	if !ok {
+		return
+	}
+	item, ok := lineItemFromForm(c)
+	if !ok {
+		return
+	}
+	item.Id = itemId
+
+	var errMsg string
+	_, err := env.lineItems.ModifyLineItems(tenant(c), id, ifMatchVersion(c), func(invoice *models.Invoice, items []models.LineItem) ([]models.LineItem, error) {
+		k := models.FindLineItem(items, itemId)
+		if k < 0 {
+			return nil, errLineItemNotFound
+		}
+		if err := item.Check(invoice.Currency); err != nil {
+			errMsg = err.Error()
+			return nil, err
+		}
+		items[k] = item
+		return items, nil
+	})
+	if err != nil {
+		respondWithLineItemsError(c, err, errMsg)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (env *Env) lineItemsDelete(c *gin.Context) {
+	id, ok := invoiceIdParam(c)
+	if !ok {
+		return
+	}
+	itemId, ok := lineItemIdParam(c)
+	if !ok {
+		return
+	}
+
+	_, err := env.lineItems.ModifyLineItems(tenant(c), id, ifMatchVersion(c), func(_ *models.Invoice, items []models.LineItem) ([]models.LineItem, error) {
+		k := models.FindLineItem(items, itemId)
+		if k < 0 {
+			return nil, errLineItemNotFound
+		}
+		return append(items[:k], items[k+1:]...), nil
+	})
+	if err != nil {
+		respondWithLineItemsError(c, err, "")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func lineItemFromForm(c *gin.Context) (item models.LineItem, ok bool) {
+	item.Description = c.PostForm("description")
+
+	var err error
+	if item.Quantity, err = strconv.Atoi(c.DefaultPostForm("quantity", "1")); err != nil {
+		respondWithError(c, http.StatusBadRequest, "quantity parameter must be an integer")
+		return item, false
+	}
+
+	item.UnitPrice, err = models.ParseMoney(c.PostForm("unitPrice"))
+	if err == models.InvalidMoney {
+		respondWithError(c, http.StatusBadRequest, "unitPrice parameter must be specified and must be a number")
+		return item, false
+	} else if err != nil {
+		respondWithError(c, http.StatusUnprocessableEntity, moneyErrorMsg("unitPrice parameter", err))
+		return item, false
+	}
+
+	item.Discount, err = models.ParseMoney(c.DefaultPostForm("discount", "0"))
+	if err == models.InvalidMoney {
+		respondWithError(c, http.StatusBadRequest, "discount parameter must be a number")
+		return item, false
+	} else if err != nil {
+		respondWithError(c, http.StatusUnprocessableEntity, moneyErrorMsg("discount parameter", err))
+		return item, false
+	}
+	return item, true
+}
+
+func invoiceIdParam(c *gin.Context) (id int, ok bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "parameter id should be an integer")
+		return 0, false
+	}
+	return id, true
+}
+
+func lineItemIdParam(c *gin.Context) (id int, ok bool) {
+	id, err := strconv.Atoi(c.Param("item"))
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, "parameter item should be an integer")
+		return 0, false
+	}
+	return id, true
+}
+
+func respondWithLineItemsError(c *gin.Context, err error, errMsg string) {
+	_, invalid := err.(*models.LineItemsError)
+	switch {
+	case invalid:
+		respondWithError(c, http.StatusUnprocessableEntity, err.Error())
+	case err == models.InvoiceNotFound:
+		respondWithError(c, http.StatusNotFound, "there is no resource with the specified id")
+	case err == errLineItemNotFound:
+		respondWithError(c, http.StatusNotFound, "there is no line item with the specified id")
+	case err == models.VersionConflict:
+		respondWithVersionConflict(c)
+	case respondWithNotDraft(c, err):
+	case errMsg != "":
+		respondWithError(c, http.StatusUnprocessableEntity, errMsg)
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
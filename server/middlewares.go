@@ -3,6 +3,7 @@ package server
 import (
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -18,45 +19,94 @@ func respondWithError(c *gin.Context, code int, errorMsg string) {
 	c.Abort()
 }
 
-func tokenAuthMiddleware(apiToken string) gin.HandlerFunc {
+// ifMatchMiddleware turns the If-Match header into the invoice version the
+// client expects, which handlers pass on to the repo. Without the header the
+// version is 0, meaning any version, unless the header is required.
+func ifMatchMiddleware(required bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userToken := c.Request.FormValue("apiToken")
+		header := strings.TrimSpace(c.GetHeader("If-Match"))
+		version := 0
 
-		if userToken == "" {
-			respondWithError(c, http.StatusUnauthorized, "API token required")
-			return
-		}
-
-		if userToken != apiToken {
-			respondWithError(c, http.StatusUnauthorized, "Invalid API token")
+		switch {
+		case header == "":
+			if required {
+				respondWithError(c, http.StatusPreconditionRequired, "If-Match header required")
+				return
+			}
+		case header == "*":
+		case strings.Contains(header, ","):
+			respondWithError(c, http.StatusBadRequest, "If-Match must be * or a single ETag")
 			return
+		default:
+			var ok bool
+			if version, ok = parseVersionETag(header); !ok {
+				respondWithError(c, http.StatusPreconditionFailed, "If-Match does not match the current ETag")
+				return
+			}
 		}
 
+		c.Set("IfMatchVersion", version)
 		c.Next()
 	}
 }
 
 func validatePostFormMiddleware(c *gin.Context) {
 	document := c.PostForm("document")
-	_, err := strconv.ParseFloat(c.PostForm("amount"), 64)
-	if err != nil {
+	amount, err := models.ParseMoney(c.PostForm("amount"))
+	if err == models.InvalidMoney {
 		respondWithError(c, http.StatusBadRequest, "amount parameter must be specified and must be a number")
 		return
+	} else if err != nil {
+		respondWithError(c, http.StatusUnprocessableEntity, moneyErrorMsg("amount parameter", err))
+		return
 	}
 
-	if document == "" {
-		respondWithError(c, http.StatusBadRequest, "missing or empty document parameter")
+	currency := c.DefaultPostForm("currency", models.DefaultCurrency)
+	if models.CheckCurrency(currency) != nil {
+		respondWithError(c, http.StatusBadRequest, currencyErrorMsg("currency parameter"))
+		return
+	}
+	if err = models.CheckAmount(currency, amount); err != nil {
+		respondWithError(c, http.StatusUnprocessableEntity, amountInCurrencyErrorMsg("amount parameter", currency))
 		return
 	}
 
-	if utf8.RuneCountInString(document) > models.DOCUMENT_MAX_LENGTH {
-		respondWithError(c, http.StatusBadRequest, documentMaxLengthErrorMsg)
+	if errMsg := validateDocument(document); errMsg != "" {
+		respondWithError(c, http.StatusBadRequest, errMsg)
 		return
 	}
 
 	c.Next()
 }
 
+func moneyErrorMsg(name string, err error) string {
+	switch err {
+	case models.MoneyTooPrecise:
+		return name + " cannot have more than two decimals"
+	case models.MoneyOutOfRange:
+		return name + " must be between -" + models.MaxMoney.String() + " and " + models.MaxMoney.String()
+	}
+	return name + " must be a decimal number, as in 10.50"
+}
+
+func currencyErrorMsg(name string) string {
+	return name + " must be one of " + strings.Join(models.Currencies(), ", ")
+}
+
+func amountInCurrencyErrorMsg(name string, currency string) string {
+	return name + " cannot have more than " + strconv.Itoa(models.MinorUnits(currency)) + " decimals in " + currency
+}
+
+func validateDocument(document string) (errMsg string) {
+	if document == "" {
+		return "missing or empty document parameter"
+	}
+	if utf8.RuneCountInString(document) > models.DOCUMENT_MAX_LENGTH {
+		return documentMaxLengthErrorMsg
+	}
+	return ""
+}
+
 func prepareQueryOptions(c *gin.Context) {
 	values := c.Request.Form
 	errors := validateFormValuesForQueryOptions(values)
@@ -65,77 +115,308 @@ func prepareQueryOptions(c *gin.Context) {
 			"errors": errors,
 		})
 		c.Abort()
+		return
+	}
+
+	opts := queryOptionsFromValues(values)
+	c.Set("Currency", values.Get("currency"))
+
+	// cursor and limit switch to keyset pagination
+	if _, ok := values["limit"]; ok || values.Get("cursor") != "" {
+		opts.Cursor = &models.Cursor{}
+		if cursor := values.Get("cursor"); cursor != "" {
+			var err error
+			if opts.Cursor, err = models.DecodeCursor(cursor, opts.Sorts); err != nil {
+				respondWithError(c, http.StatusBadRequest, "parameter cursor is invalid or was made for another sort")
+				return
+			}
+		}
 	}
 
+	c.Set("QueryOptions", opts)
+	c.Next()
+}
+
+func queryOptionsFromValues(values url.Values) *models.QueryOptions {
 	var opts = models.QueryOptions{
-		Filters: map[string]string{},
-		Sorts:   []models.Sort{},
+		Sorts: []models.Sort{},
 		Pagination: models.Pagination{
 			Page:    1,
 			PerPage: 5,
 		},
 	}
 
+	// sorted, so that the same query always makes the same SQL
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var filters models.And
+	for _, k := range names {
+		if condition, ok, _ := parseFilterParam(k, values.Get(k)); ok {
+			filters = append(filters, condition)
+		}
+	}
+	if expr := values.Get("filter"); expr != "" {
+		filter, _ := models.ParseFilter(expr)
+		filters = append(filters, filter)
+	}
+	if len(filters) > 0 {
+		opts.Filters = filters
+	}
+
 	for k, v := range values {
 		switch k {
-		case "document", "referenceMonth", "referenceYear":
+		case "includeInactive":
+			if len(v) == 1 {
+				opts.IncludeInactive, _ = strconv.ParseBool(v[0])
+			}
+		case "fields":
 			if len(v) == 1 {
-				opts.Filters[k] = v[0]
+				opts.Fields, _ = parseFieldsParam(v[0])
 			}
 		case "page":
 			if len(v) == 1 {
 				opts.Pagination.Page, _ = strconv.Atoi(v[0])
 			}
-		case "perPage":
+		case "perPage", "limit":
 			if len(v) == 1 {
 				opts.Pagination.PerPage, _ = strconv.Atoi(v[0])
 			}
 		case "sort":
 			if len(v) == 1 {
-				fields := strings.Split(v[0], ",")
-				sorts := make([]models.Sort, len(fields))
-				for i, field := range fields {
-					if field[0] == '-' {
-						sorts[i].Desc = true
-						field = field[1:]
-					}
-					sorts[i].Field = field
-				}
-				opts.Sorts = sorts
+				opts.Sorts = parseSorts(v[0])
+			}
+		}
+	}
+	return &opts
+}
+
+func parseSorts(value string) []models.Sort {
+	fields := strings.Split(value, ",")
+	sorts := make([]models.Sort, len(fields))
+	for i, field := range fields {
+		if field[0] == '-' {
+			sorts[i].Desc = true
+			field = field[1:]
+		}
+		sorts[i].Field = field
+	}
+	return sorts
+}
+
+func prepareAggregateOptions(c *gin.Context) {
+	values := c.Request.Form
+	rest := url.Values{}
+	for k, v := range values {
+		switch k {
+		case "groupBy", "metrics", "sort":
+		default:
+			rest[k] = v
+		}
+	}
+	errors := validateFormValuesForQueryOptions(rest)
+	for _, k := range []string{"cursor", "limit", "fields", "currency"} {
+		if _, ok := values[k]; ok {
+			errors = append(errors, "parameter "+k+" can't be used with aggregate")
+		}
+	}
+	for _, k := range []string{"groupBy", "metrics", "sort"} {
+		if len(values[k]) > 1 {
+			errors = append(errors, "duplicate parameter "+k)
+		}
+	}
+
+	opts := &models.AggregateOptions{Metrics: []models.Metric{{Func: models.MetricCount}}}
+	if value, ok := values["groupBy"]; ok {
+		opts.GroupBy = strings.Split(value[0], ",")
+		for k, field := range opts.GroupBy {
+			if !isOneOf(field, models.GroupableFields) || isOneOf(field, opts.GroupBy[:k]) {
+				errors = append(errors, "parameter groupBy can't group by "+strconv.Quote(field)+". Fields: "+strings.Join(models.GroupableFields, ", "))
+				break
+			}
+		}
+	}
+	if value, ok := values["metrics"]; ok {
+		opts.Metrics = nil
+		for _, name := range strings.Split(value[0], ",") {
+			metric, err := models.ParseMetric(name)
+			if err != nil {
+				errors = append(errors, "parameter metrics has unknown metric "+strconv.Quote(name)+". Metrics: "+strings.Join(models.Metrics(), ", "))
+				break
+			}
+			opts.Metrics = append(opts.Metrics, metric)
+		}
+	}
+	if value, ok := values["sort"]; ok {
+		keys := append([]string{}, opts.GroupBy...)
+		for _, m := range opts.Metrics {
+			keys = append(keys, m.String())
+		}
+		for _, f := range strings.Split(value[0], ",") {
+			if !isOneOf(strings.TrimPrefix(f, "-"), keys) {
+				errors = append(errors, "malformed sort query. Correct syntax: sort=[-](groupBy field|metric)[,...]")
+				break
 			}
 		}
 	}
 
-	c.Set("QueryOptions", &opts)
+	if len(errors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errors": errors,
+		})
+		c.Abort()
+		return
+	}
+
+	opts.QueryOptions = *queryOptionsFromValues(rest)
+	if value, ok := values["sort"]; ok {
+		opts.Sorts = parseSorts(value[0])
+	}
+	c.Set("AggregateOptions", opts)
 	c.Next()
 }
 
+func isOneOf(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// filterOperators lists the fields GET /invoices filters on and their
+// operators, as in amount[gte]=10. A bare field, as in document=x, is OpEq.
+// The currency parameter converts amounts instead, so invoices are filtered
+// on their currency by the filter parameter only.
+var filterOperators = map[string][]models.Operator{
+	"document":       {models.OpEq, models.OpIn},
+	"description":    {models.OpContains},
+	"referenceMonth": {models.OpEq, models.OpIn, models.OpGt, models.OpGte, models.OpLt, models.OpLte},
+	"referenceYear":  {models.OpEq, models.OpIn, models.OpGt, models.OpGte, models.OpLt, models.OpLte},
+	"amount":         {models.OpEq, models.OpGt, models.OpGte, models.OpLt, models.OpLte},
+	"createdAt":      {models.OpGt, models.OpGte, models.OpLt, models.OpLte},
+	"status":         {models.OpEq, models.OpIn},
+}
+
+func parseFilterParam(name string, value string) (condition *models.Condition, isFilter bool, errMsg string) {
+	field, op := name, models.OpEq
+	if i := strings.IndexByte(name, '['); i > 0 && strings.HasSuffix(name, "]") {
+		field, op = name[:i], models.Operator(name[i+1:len(name)-1])
+	}
+	operators, ok := filterOperators[field]
+	if !ok {
+		return nil, false, ""
+	}
+	supported := false
+	for _, o := range operators {
+		supported = supported || o == op
+	}
+	if !supported {
+		return nil, true, "operator " + string(op) + " is not supported on " + field
+	}
+
+	args := []string{value}
+	if op == models.OpIn {
+		args = strings.Split(value, ",")
+	}
+	if field == "document" {
+		for _, arg := range args {
+			if utf8.RuneCountInString(arg) > models.DOCUMENT_MAX_LENGTH {
+				return nil, true, documentMaxLengthErrorMsg
+			}
+		}
+	}
+	if field == "status" {
+		for _, arg := range args {
+			if models.CheckInvoiceStatus(arg) != nil {
+				return nil, true, "parameter " + name + " must be one of " + statusList()
+			}
+		}
+	}
+	condition, err := models.NewCondition(field, op, args...)
+	if err != nil {
+		kind, _ := models.FieldKindOf(field)
+		return nil, true, "parameter " + name + " must be " + kind.Describe()
+	}
+	return condition, true, ""
+}
+
+func parseFieldsParam(value string) (fields []string, errMsg string) {
+	fields = strings.Split(value, ",")
+	for _, field := range fields {
+		if models.CheckProjection([]string{field}) != nil {
+			return nil, "parameter fields has unknown field " + strconv.Quote(field) + ". Fields: " + strings.Join(models.InvoiceJSONFields(), ", ")
+		}
+	}
+	return fields, ""
+}
+
 func validateFormValuesForQueryOptions(values url.Values) (errors []string) {
 	for k, v := range values {
 		switch k {
-		case "document", "referenceMonth", "referenceYear", "sort", "apiToken", "page", "perPage":
-			if len(v) > 1 {
-				errors = append(errors, "duplicate parameter "+k)
-			}
+		case "sort", "filter", "fields", "currency", "apiToken", "page", "perPage", "cursor", "limit", "includeInactive":
 		default:
-			errors = append(errors, "invalid parameter "+k)
+			if _, isFilter, _ := parseFilterParam(k, ""); !isFilter {
+				errors = append(errors, "invalid parameter "+k)
+				continue
+			}
+			for _, value := range v {
+				if _, _, errMsg := parseFilterParam(k, value); errMsg != "" {
+					errors = append(errors, errMsg)
+					break
+				}
+			}
+		}
+		if len(v) > 1 {
+			errors = append(errors, "duplicate parameter "+k)
 		}
 
 		switch k {
-		case "document":
+		case "fields":
+			for _, value := range v {
+				if _, errMsg := parseFieldsParam(value); errMsg != "" {
+					errors = append(errors, errMsg)
+					break
+				}
+			}
+		case "filter":
+			for _, value := range v {
+				if _, err := models.ParseFilter(value); err != nil {
+					errors = append(errors, "parameter filter is invalid: "+err.Error())
+					break
+				}
+			}
+		case "currency":
+			for _, value := range v {
+				if models.CheckCurrency(value) != nil {
+					errors = append(errors, currencyErrorMsg("parameter currency"))
+					break
+				}
+			}
+		case "includeInactive":
 			for _, value := range v {
-				if utf8.RuneCountInString(value) > models.DOCUMENT_MAX_LENGTH {
-					errors = append(errors, documentMaxLengthErrorMsg)
+				if _, err := strconv.ParseBool(value); err != nil {
+					errors = append(errors, "parameter includeInactive must be true or false")
 					break
 				}
 			}
-		case "referenceMonth", "referenceYear", "page", "perPage":
+		case "page", "perPage":
 			for _, value := range v {
 				if _, err := strconv.Atoi(value); err != nil {
 					errors = append(errors, "parameter "+k+" must be an integer")
 					break
 				}
 			}
+		case "limit":
+			for _, value := range v {
+				if n, err := strconv.Atoi(value); err != nil || n < 1 {
+					errors = append(errors, "parameter limit must be a positive integer")
+					break
+				}
+			}
 		case "sort":
 			for _, value := range v {
 				fields := strings.Split(value, ",")
@@ -147,12 +428,19 @@ func validateFormValuesForQueryOptions(values url.Values) (errors []string) {
 					if f[0] == '-' {
 						f = f[1:]
 					}
-					if f != "document" && f != "referenceMonth" && f != "referenceYear" {
-						errors = append(errors, "malformed sort query. Correct syntax: sort=[-](document|referenceMonth|referenceYear)[,...]")
+					if f != "document" && f != "referenceMonth" && f != "referenceYear" && f != "status" {
+						errors = append(errors, "malformed sort query. Correct syntax: sort=[-](document|referenceMonth|referenceYear|status)[,...]")
 					}
 				}
 			}
 		}
 	}
+	_, page := values["page"]
+	_, perPage := values["perPage"]
+	_, cursor := values["cursor"]
+	_, limit := values["limit"]
+	if (page || perPage) && (cursor || limit) {
+		errors = append(errors, "parameters page and perPage can't be used with cursor and limit")
+	}
 	return
 }
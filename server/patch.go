@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"reflect"
+
+	"github.com/igormartire/gorfiv/models"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+)
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// decodeJSON is json.Unmarshal with numbers decoded as json.Number, so that
+// amounts are never rounded through a float.
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := jsonNumberValue(a); ok {
+		y, ok := jsonNumberValue(b)
+		return ok && x.Cmp(y) == 0
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			if !jsonEqual(a[k], b[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func jsonNumberValue(v interface{}) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(string(v))
+	case float64:
+		r := new(big.Rat).SetFloat64(v)
+		return r, r != nil
+	}
+	return nil, false
+}
+
+func invoiceDocument(invoice *models.Invoice) (doc map[string]interface{}, err error) {
+	b, err := json.Marshal(invoice)
+	if err != nil {
+		return
+	}
+	err = decodeJSON(b, &doc)
+	return
+}
+
+func patchedInvoiceFields(original map[string]interface{}, patched interface{}) (fields models.InvoiceFields, errMsg string) {
+	doc, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, "the patched invoice must be a JSON object"
+	}
+
+	mutable := map[string]bool{}
+	for _, field := range models.MutableInvoiceFields {
+		mutable[field] = true
+	}
+	for field, value := range doc {
+		if _, known := original[field]; !known {
+			return nil, "unknown field " + field
+		}
+		if !mutable[field] && !jsonEqual(value, original[field]) {
+			return nil, "field " + field + " is read-only"
+		}
+	}
+	for field := range original {
+		if _, kept := doc[field]; !kept && !mutable[field] {
+			return nil, "field " + field + " is read-only"
+		}
+	}
+
+	fields = models.InvoiceFields{}
+	document, ok := doc["document"].(string)
+	if !ok {
+		return nil, "field document must be a string"
+	}
+	if errMsg = validateDocument(document); errMsg != "" {
+		return nil, errMsg
+	}
+	fields["document"] = document
+
+	// removing the description leaves it empty, like a POST without one
+	description, ok := doc["description"].(string)
+	if !ok && doc["description"] != nil {
+		return nil, "field description must be a string"
+	}
+	fields["description"] = description
+
+	number, ok := doc["amount"].(json.Number)
+	if !ok {
+		return nil, "field amount must be a number"
+	}
+	amount, err := models.ParseMoney(string(number))
+	if err != nil {
+		return nil, moneyErrorMsg("field amount", err)
+	}
+	fields["amount"] = amount
+
+	currency, ok := doc["currency"].(string)
+	if !ok || models.CheckCurrency(currency) != nil {
+		return nil, currencyErrorMsg("field currency")
+	}
+	if models.CheckAmount(currency, amount) != nil {
+		return nil, amountInCurrencyErrorMsg("field amount", currency)
+	}
+	fields["currency"] = currency
+
+	return fields, ""
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
+)
+
+const (
+	RoleViewer     = "viewer"
+	RoleClerk      = "clerk"
+	RoleSupervisor = "supervisor"
+	RoleAdmin      = "admin"
+)
+
+type Policy struct {
+	Roles map[string][]string
+	// Routes maps "METHOD /path", with the path as registered in the
+	// router, to the permission it requires. "" only requires the principal
+	// to be authenticated. Routes without an entry are denied.
+	Routes     map[string]string
+	Subjects   map[string][]string
+	RolesClaim string
+	Operators  map[string]bool
+}
+
+var operatorPermissions = []string{models.ScopeFXRatesManage}
+
+func isOperatorPermission(permission string) bool {
+	for _, p := range operatorPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Roles: map[string][]string{
+			RoleViewer:     {models.ScopeInvoicesRead},
+			RoleClerk:      {models.ScopeInvoicesRead, models.ScopeInvoicesWrite},
+			RoleSupervisor: {models.ScopeInvoicesRead, models.ScopeInvoicesWrite, models.ScopeInvoicesDelete},
+			RoleAdmin:      models.Scopes,
+		},
+		Routes: map[string]string{
+			"GET /":                            "",
+			"GET /invoices":                    models.ScopeInvoicesRead,
+			"GET /invoices/aggregate":          models.ScopeInvoicesRead,
+			"GET /invoices/:id":                models.ScopeInvoicesRead,
+			"POST /invoices":                   models.ScopeInvoicesWrite,
+			"PUT /invoices/:id":                models.ScopeInvoicesWrite,
+			"PATCH /invoices/:id":              models.ScopeInvoicesWrite,
+			"DELETE /invoices/:id":             models.ScopeInvoicesDelete,
+			"GET /invoices/:id/items":          models.ScopeInvoicesRead,
+			"POST /invoices/:id/items":         models.ScopeInvoicesWrite,
+			"PUT /invoices/:id/items":          models.ScopeInvoicesWrite,
+			"GET /invoices/:id/items/:item":    models.ScopeInvoicesRead,
+			"PUT /invoices/:id/items/:item":    models.ScopeInvoicesWrite,
+			"DELETE /invoices/:id/items/:item": models.ScopeInvoicesWrite,
+			"POST /invoices/:id/issue":         models.ScopeInvoicesWrite,
+			"POST /invoices/:id/pay":           models.ScopeInvoicesWrite,
+			"POST /invoices/:id/overdue":       models.ScopeInvoicesWrite,
+			// voiding and refunding undo an invoice, as deleting does
+			"POST /invoices/:id/void":        models.ScopeInvoicesDelete,
+			"POST /invoices/:id/refund":      models.ScopeInvoicesDelete,
+			"GET /admin/apikeys":             models.ScopeAPIKeysManage,
+			"POST /admin/apikeys":            models.ScopeAPIKeysManage,
+			"POST /admin/apikeys/:id/rotate": models.ScopeAPIKeysManage,
+			"DELETE /admin/apikeys/:id":      models.ScopeAPIKeysManage,
+			"POST /admin/fxrates":            models.ScopeFXRatesManage,
+		},
+		Subjects:   map[string][]string{},
+		RolesClaim: "roles",
+		Operators:  map[string]bool{},
+	}
+}
+
+func NewPolicy(roles map[string][]string, routes map[string]string, subjects map[string][]string, rolesClaim string, operators []string) (*Policy, error) {
+	p := DefaultPolicy()
+	if len(roles) > 0 {
+		p.Roles = roles
+	}
+	for role, permissions := range p.Roles {
+		for _, permission := range permissions {
+			if isOperatorPermission(permission) {
+				return nil, errors.New("role " + role + " can't grant " + permission + ", which only operators hold")
+			}
+		}
+	}
+	if len(routes) > 0 {
+		p.Routes = map[string]string{}
+		for route, permission := range routes {
+			fields := strings.Fields(route)
+			if len(fields) != 2 || !strings.HasPrefix(fields[1], "/") {
+				return nil, errors.New("policy route " + route + ` should look like "GET /invoices"`)
+			}
+			p.Routes[strings.ToUpper(fields[0])+" "+fields[1]] = permission
+		}
+	}
+	for subject, subjectRoles := range subjects {
+		for _, role := range subjectRoles {
+			if _, ok := p.Roles[role]; !ok {
+				return nil, errors.New("subject " + subject + " has unknown role " + role)
+			}
+		}
+		p.Subjects[strings.ToLower(subject)] = subjectRoles
+	}
+	if rolesClaim != "" {
+		p.RolesClaim = rolesClaim
+	}
+	for _, subject := range operators {
+		p.Operators[strings.ToLower(subject)] = true
+	}
+	return p, nil
+}
+
+func (p *Policy) PrincipalRoles(principal *Principal) (roles []string) {
+	switch claim := principal.Claims[p.RolesClaim].(type) {
+	case string:
+		roles = strings.Fields(claim)
+	case []interface{}:
+		for _, role := range claim {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	}
+	return append(roles, p.Subjects[strings.ToLower(principal.Subject)]...)
+}
+
+// Allows tells whether principal holds permission. The scopes of an API
+// key, or of the legacy apiToken, grant permissions by themselves. The
+// scopes of a JWT only narrow what its roles grant, so a token can't give
+// its bearer more than the roles of its subject.
+func (p *Policy) Allows(principal *Principal, permission string) bool {
+	if permission == "" {
+		return true
+	}
+	if isOperatorPermission(permission) {
+		return principal.Operator || principal.Claims != nil && p.Operators[strings.ToLower(principal.Subject)]
+	}
+	if principal.Claims == nil {
+		if principal.HasScope(permission) {
+			return true
+		}
+	} else if len(principal.Scopes) > 0 && !principal.HasScope(permission) {
+		return false
+	}
+	for _, role := range p.PrincipalRoles(principal) {
+		for _, granted := range p.Roles[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func authorize(policy *Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("Policy", policy)
+		route := c.Request.Method + " " + c.FullPath()
+		permission, ok := policy.Routes[route]
+		if !ok {
+			respondWithForbidden(c, route, "", "there is no access policy for this route")
+			return
+		}
+
+		p := principal(c)
+		if p == nil || !policy.Allows(p, permission) {
+			respondWithForbidden(c, route, permission, "permission "+permission+" required")
+			return
+		}
+		c.Next()
+	}
+}
+
+// holdsAll answers 403 unless the principal of the request holds every one
+// of permissions, so that it can't hand out more than it has.
+func holdsAll(c *gin.Context, permissions []string) bool {
+	policy := c.MustGet("Policy").(*Policy)
+	p := principal(c)
+	for _, permission := range permissions {
+		if p == nil || !policy.Allows(p, permission) {
+			respondWithForbidden(c, c.Request.Method+" "+c.FullPath(), permission, "permission "+permission+" required")
+			return false
+		}
+	}
+	return true
+}
+
+func respondWithForbidden(c *gin.Context, route string, permission string, errorMsg string) {
+	body := gin.H{
+		"error": errorMsg,
+		"code":  "forbidden",
+		"route": route,
+	}
+	if permission != "" {
+		body["permission"] = permission
+	}
+	if p := principal(c); p != nil {
+		body["subject"] = p.Subject
+	}
+	c.JSON(http.StatusForbidden, body)
+	c.Abort()
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RouteGroupInvoices = "invoices"
+	RouteGroupAdmin    = "admin"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, errors.New("rate limit " + s + ` should look like "100/1m"`)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || requests < 1 {
+		return RateLimit{}, errors.New("rate limit " + s + " should allow a positive number of requests")
+	}
+	period := strings.TrimSpace(parts[1])
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, errors.New("rate limit " + s + " should have a positive period")
+	}
+	return RateLimit{Requests: requests, Period: d}, nil
+}
+
+func (l RateLimit) Unlimited() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the buckets of every client. MemoryRateLimitStore is
+// enough for a single instance; several instances need a shared store, which
+// must take the token atomically.
+type RateLimitStore interface {
+	Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+type RateLimitConfig struct {
+	Store RateLimitStore
+	// IP limits every client IP across all routes. It is checked before
+	// authentication, so that guessing credentials is throttled too.
+	IP     RateLimit
+	Groups map[string]RateLimit
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func (l RateLimit) take(b *tokenBucket, now time.Time) RateLimitResult {
+	capacity := float64(l.Requests)
+	perSecond := capacity / l.Period.Seconds()
+
+	if b.updated.IsZero() {
+		b.tokens = capacity
+	} else if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*perSecond)
+	}
+	b.updated = now
+
+	result := RateLimitResult{Limit: l.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.full = now.Add(time.Duration((capacity - b.tokens) / perSecond * float64(time.Second)))
+	result.Remaining = int(b.tokens)
+	result.Reset = b.full
+	return result
+}
+
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > rateLimitSweepInterval {
+		for k, b := range s.buckets {
+			if !b.full.After(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{}
+		s.buckets[key] = b
+	}
+	return limit.take(b, now), nil
+}
+
+// rateLimitMiddleware takes a token for each request from the bucket that
+// key picks, answering 429 once it is empty. The X-RateLimit-* headers show
+// the most exhausted bucket the request went through. Store failures let
+// requests through rather than take the API down.
+func rateLimitMiddleware(store RateLimitStore, limit RateLimit, key func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit.Unlimited() {
+			c.Next()
+			return
+		}
+
+		result, err := store.Take(key(c), limit, time.Now())
+		if err != nil {
+			c.Error(err)
+			c.Next()
+			return
+		}
+
+		previous, seen := c.Get("RateLimit")
+		if !seen || !result.Allowed || result.Remaining <= previous.(RateLimitResult).Remaining {
+			c.Set("RateLimit", result)
+			c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+			c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			c.Header("X-RateLimit-Reset", strconv.FormatInt(result.Reset.Unix(), 10))
+		}
+		if !result.Allowed {
+			retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			respondWithError(c, http.StatusTooManyRequests, "rate limit exceeded, retry in "+strconv.Itoa(retryAfter)+" seconds")
+			return
+		}
+		c.Next()
+	}
+}
+
+func clientIPKey(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// principalKey keys the buckets of a route group by principal. Subjects are
+// only unique within a tenant.
+func principalKey(group string) func(c *gin.Context) string {
+	return func(c *gin.Context) string {
+		subject := ""
+		if p := principal(c); p != nil {
+			subject = p.Subject
+		}
+		return group + ":" + strconv.Quote(tenant(c)) + ":" + subject
+	}
+}
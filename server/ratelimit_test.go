@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	var cases = []struct {
+		value    string
+		expected RateLimit
+		valid    bool
+	}{
+		{"", RateLimit{}, true},
+		{"100/1m", RateLimit{100, time.Minute}, true},
+		{"5/s", RateLimit{5, time.Second}, true},
+		{" 10 / 2h ", RateLimit{10, 2 * time.Hour}, true},
+		{"100", RateLimit{}, false},
+		{"0/1m", RateLimit{}, false},
+		{"x/1m", RateLimit{}, false},
+		{"10/forever", RateLimit{}, false},
+		{"10/-1m", RateLimit{}, false},
+	}
+	for _, c := range cases {
+		limit, err := ParseRateLimit(c.value)
+		if (err == nil) != c.valid || limit != c.expected {
+			t.Errorf("%q: limit should have been %v (valid: %v), but was %v (%v) instead.", c.value, c.expected, c.valid, limit, err)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Requests: 2, Period: time.Second}
+	t0 := time.Now()
+
+	var cases = []struct {
+		key        string
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{"a", 0, true, 1, 0},
+		{"a", 0, true, 0, 0},
+		{"a", 0, false, 0, 500 * time.Millisecond},
+		{"b", 0, true, 1, 0},
+		{"a", 250 * time.Millisecond, false, 0, 250 * time.Millisecond},
+		{"a", 500 * time.Millisecond, true, 0, 0},
+		{"a", 5 * time.Second, true, 1, 0},
+	}
+	for _, c := range cases {
+		result, err := store.Take(c.key, limit, t0.Add(c.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != c.allowed || result.Remaining != c.remaining || result.Limit != 2 ||
+			(result.RetryAfter-c.retryAfter).Round(time.Millisecond) != 0 {
+			t.Errorf("%v: result should have been %v, %v remaining, retry after %v, but was %+v instead.", c, c.allowed, c.remaining, c.retryAfter, result)
+		}
+	}
+
+	result, _ := store.Take("c", limit, t0)
+	if expected := t0.Add(500 * time.Millisecond); !result.Reset.Equal(expected) {
+		t.Errorf("reset should have been %v, but was %v instead.", expected, result.Reset)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	config := Config{
+		JWT: JWTConfig{Secret: []byte(jwtSecret)},
+		RateLimit: RateLimitConfig{
+			IP:     RateLimit{Requests: 5, Period: time.Minute},
+			Groups: map[string]RateLimit{RouteGroupInvoices: {Requests: 2, Period: time.Minute}},
+		},
+	}
+	server := New(NewEnv(newTenantRepoWithStub(jwtTenant)), config)
+	get := func(subject string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/invoices/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := validClaims()
+		claims["sub"] = subject
+		req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, "", []byte(jwtSecret), claims))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	var cases = []struct {
+		subject      string
+		expectedCode int
+		remaining    string
+		retryAfter   string
+	}{
+		{"alice", http.StatusOK, "1", ""},
+		{"alice", http.StatusOK, "0", ""},
+		{"alice", http.StatusTooManyRequests, "0", "30"},
+		{"bob", http.StatusOK, "1", ""},
+		// the IP bucket, 5 requests, is emptied by now
+		{"bob", http.StatusOK, "0", ""},
+		{"carol", http.StatusTooManyRequests, "0", "12"},
+	}
+	for _, c := range cases {
+		w := get(c.subject)
+		assert := newAssert(t, c, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		assert.HeaderEquals("X-RateLimit-Remaining", c.remaining)
+		assert.HeaderEquals("Retry-After", c.retryAfter)
+		if w.Header().Get("X-RateLimit-Reset") == "" {
+			t.Errorf("%v: X-RateLimit-Reset should have been set.", c)
+		}
+	}
+}
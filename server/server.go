@@ -2,25 +2,88 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
 )
 
-func New(env *Env, apiToken string) *gin.Engine {
+type Config struct {
+	JWT              JWTConfig
+	LegacyTokenAuth  bool
+	APIToken         string
+	Policy           *Policy
+	RequireIfMatch   bool
+	ItemCacheControl string
+	ListCacheControl string
+	// IdempotencyTTL is how long the response to a POST with an
+	// Idempotency-Key is replayed. Zero means a day.
+	IdempotencyTTL time.Duration
+	RateLimit      RateLimitConfig
+}
+
+func New(env *Env, config Config) *gin.Engine {
 	router := gin.Default()
 	router.HandleMethodNotAllowed = true
 
-	authorized := router.Group("/", tokenAuthMiddleware(apiToken))
+	policy := config.Policy
+	if policy == nil {
+		policy = DefaultPolicy()
+	}
+	limits := config.RateLimit
+	if limits.Store == nil {
+		limits.Store = NewMemoryRateLimitStore()
+	}
+	groupRateLimit := func(group string) gin.HandlerFunc {
+		return rateLimitMiddleware(limits.Store, limits.Groups[group], principalKey(group))
+	}
 
-	authorized.GET("/", func(c *gin.Context) {
+	authorized := router.Group("/",
+		rateLimitMiddleware(limits.Store, limits.IP, clientIPKey),
+		authMiddleware(config, env.apiKeys),
+		authorize(policy))
+	ifMatch := ifMatchMiddleware(config.RequireIfMatch)
+
+	invoices := authorized.Group("/", groupRateLimit(RouteGroupInvoices))
+	invoices.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusMovedPermanently, "/invoices")
 	})
 
-	authorized.GET("/invoices", prepareQueryOptions, env.invoicesIndex)
-	authorized.GET("/invoices/:id", env.invoicesShow)
-	authorized.POST("/invoices", validatePostFormMiddleware, env.invoicesPost)
-	authorized.PUT("/invoices/:id", env.invoicesPut)
-	authorized.DELETE("/invoices/:id", env.invoicesDelete)
+	invoices.GET("/invoices", cacheControlMiddleware(config.ListCacheControl), prepareQueryOptions, env.invoicesIndex)
+	invoices.GET("/invoices/aggregate", cacheControlMiddleware(config.ListCacheControl), prepareAggregateOptions, env.invoicesAggregate)
+	invoices.GET("/invoices/:id", cacheControlMiddleware(config.ItemCacheControl), env.invoicesShow)
+	invoices.POST("/invoices", idempotencyMiddleware(env.idempotency, config.IdempotencyTTL), validatePostFormMiddleware, env.invoicesPost)
+	invoices.PUT("/invoices/:id", ifMatch, validatePostFormMiddleware, env.invoicesPut)
+	invoices.PATCH("/invoices/:id", ifMatch, env.invoicesPatch)
+	invoices.DELETE("/invoices/:id", ifMatch, env.invoicesDelete)
+	if env.lineItems != nil {
+		invoices.GET("/invoices/:id/items", cacheControlMiddleware(config.ItemCacheControl), env.lineItemsIndex)
+		invoices.POST("/invoices/:id/items", ifMatch, env.lineItemsCreate)
+		invoices.PUT("/invoices/:id/items", ifMatch, env.lineItemsReplace)
+		invoices.GET("/invoices/:id/items/:item", cacheControlMiddleware(config.ItemCacheControl), env.lineItemsShow)
+		invoices.PUT("/invoices/:id/items/:item", ifMatch, env.lineItemsUpdate)
+		invoices.DELETE("/invoices/:id/items/:item", ifMatch, env.lineItemsDelete)
+	}
+	if env.statuses != nil {
+		invoices.POST("/invoices/:id/issue", ifMatch, env.invoicesTransition(models.EventIssue))
+		// a retried payment must not be paid twice, even though its If-Match
+		// no longer matches
+		invoices.POST("/invoices/:id/pay", idempotencyMiddleware(env.idempotency, config.IdempotencyTTL), ifMatch, env.invoicesTransition(models.EventPay))
+		invoices.POST("/invoices/:id/overdue", ifMatch, env.invoicesTransition(models.EventOverdue))
+		invoices.POST("/invoices/:id/void", ifMatch, env.invoicesTransition(models.EventVoid))
+		invoices.POST("/invoices/:id/refund", ifMatch, env.invoicesTransition(models.EventRefund))
+	}
+
+	admin := authorized.Group("/admin", groupRateLimit(RouteGroupAdmin))
+	if env.apiKeys != nil {
+		admin.GET("/apikeys", env.apiKeysIndex)
+		admin.POST("/apikeys", env.apiKeysCreate)
+		admin.POST("/apikeys/:id/rotate", env.apiKeysRotate)
+		admin.DELETE("/apikeys/:id", env.apiKeysRevoke)
+	}
+	if env.fxRates != nil {
+		admin.POST("/fxrates", env.fxRatesUpsert)
+	}
 
 	return router
 }
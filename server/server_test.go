@@ -3,9 +3,13 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,6 +21,8 @@ const (
 	apiToken = "sweetpotato"
 )
 
+var testConfig = Config{APIToken: apiToken, LegacyTokenAuth: true}
+
 type MockRepo struct {
 	GetInvoiceById_Called         bool
 	GetInvoiceById_ParameterValue int
@@ -24,10 +30,10 @@ type MockRepo struct {
 	GetInvoiceById_ReturnError    error
 }
 
-func (r *MockRepo) GetInvoices(opts *models.QueryOptions) (invoices []*models.Invoice, err error) {
+func (r *MockRepo) GetInvoices(tenant string, opts *models.QueryOptions) (invoices []*models.Invoice, err error) {
 	return nil, nil
 }
-func (r *MockRepo) GetInvoiceById(id int) (*models.Invoice, error) {
+func (r *MockRepo) GetInvoiceById(tenant string, id int) (*models.Invoice, error) {
 	r.GetInvoiceById_Called = true
 	r.GetInvoiceById_ParameterValue = id
 	return r.GetInvoiceById_ReturnValue, r.GetInvoiceById_ReturnError
@@ -35,21 +41,29 @@ func (r *MockRepo) GetInvoiceById(id int) (*models.Invoice, error) {
 func (r *MockRepo) InsertInvoice(i models.Invoice) (id int64, err error) {
 	return 0, nil
 }
-func (r *MockRepo) DeleteInvoice(id int) (nRows int64, err error) {
+func (r *MockRepo) ModifyInvoice(tenant string, id int, version int, modify func(*models.Invoice) (models.InvoiceFields, error)) error {
+	return models.InvoiceNotFound
+}
+func (r *MockRepo) DeleteInvoice(tenant string, id int, version int) (nRows int64, err error) {
 	return 0, nil
 }
-func (r *MockRepo) UpdateInvoice(id int, newDescription string) (nRows int64, err error) {
+func (r *MockRepo) UpdateInvoice(tenant string, id int, version int, fields models.InvoiceFields) (nRows int64, err error) {
 	return 0, nil
 }
-func (r *MockRepo) CountInvoices(opts *models.QueryOptions) (count int, err error) {
+func (r *MockRepo) CountInvoices(tenant string, opts *models.QueryOptions) (count int, err error) {
 	return 0, nil
 }
+func (r *MockRepo) AggregateInvoices(tenant string, opts *models.AggregateOptions) (groups []*models.Group, count int, err error) {
+	return nil, 0, nil
+}
 
 var invoiceStub = models.Invoice{
 	Id:             1,
 	Document:       "docStub",
 	Description:    "descriptionStub",
-	Amount:         42.42,
+	Amount:         4242,
+	Currency:       models.DefaultCurrency,
+	Status:         models.StatusDraft,
 	CreatedAt:      time.Now(),
 	ReferenceMonth: int(time.Now().Month()),
 	ReferenceYear:  time.Now().Year(),
@@ -65,7 +79,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestUnauthenticatedWithoutToken(t *testing.T) {
-	server := New(&Env{}, apiToken)
+	server := New(&Env{}, testConfig)
 	var routes = []struct {
 		method string
 		path   string
@@ -75,6 +89,7 @@ func TestUnauthenticatedWithoutToken(t *testing.T) {
 		{"GET", "/invoices/1"},
 		{"POST", "/invoices"},
 		{"PUT", "/invoices/1"},
+		{"PATCH", "/invoices/1"},
 		{"DELETE", "/invoices/1"},
 	}
 
@@ -92,7 +107,7 @@ func TestUnauthenticatedWithoutToken(t *testing.T) {
 }
 
 func TestUnauthenticatedWithWrongToken(t *testing.T) {
-	server := New(&Env{}, apiToken)
+	server := New(&Env{}, testConfig)
 	var routes = []struct {
 		method string
 		path   string
@@ -102,6 +117,7 @@ func TestUnauthenticatedWithWrongToken(t *testing.T) {
 		{"GET", "/invoices/1"},
 		{"POST", "/invoices"},
 		{"PUT", "/invoices/1"},
+		{"PATCH", "/invoices/1"},
 		{"DELETE", "/invoices/1"},
 	}
 
@@ -122,8 +138,8 @@ func TestUnauthenticatedWithWrongToken(t *testing.T) {
 }
 
 func TestAuthenticated(t *testing.T) {
-	repo := &MockRepo{}
-	server := New(NewEnv(repo), apiToken)
+	repo := &MockRepo{GetInvoiceById_ReturnValue: &invoiceStub}
+	server := New(NewEnv(repo), testConfig)
 	var routes = []struct {
 		method string
 		path   string
@@ -133,6 +149,7 @@ func TestAuthenticated(t *testing.T) {
 		{"GET", "/invoices/1"},
 		{"POST", "/invoices"},
 		{"PUT", "/invoices/1"},
+		{"PATCH", "/invoices/1"},
 		{"DELETE", "/invoices/1"},
 	}
 
@@ -161,7 +178,7 @@ func TestRedirect(t *testing.T) {
 	q.Add("apiToken", apiToken)
 	req.URL.RawQuery = q.Encode()
 	repo := &MockRepo{}
-	server := New(NewEnv(repo), apiToken)
+	server := New(NewEnv(repo), testConfig)
 	w := httptest.NewRecorder()
 	server.ServeHTTP(w, req)
 	assert := newAssert(t, "GET /", w)
@@ -173,7 +190,7 @@ func TestInvoicesShowNonIntegerId(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	server := New(&Env{}, apiToken)
+	server := New(&Env{}, testConfig)
 	w := httptest.NewRecorder()
 	server.ServeHTTP(w, req)
 	assert := newAssert(t, "GET /invoices/nan", w)
@@ -189,7 +206,7 @@ func TestInvoicesShowUnexistentId(t *testing.T) {
 	repo := &MockRepo{}
 	repo.GetInvoiceById_ReturnValue = nil
 	repo.GetInvoiceById_ReturnError = models.InvoiceNotFound
-	server := New(NewEnv(repo), apiToken)
+	server := New(NewEnv(repo), testConfig)
 	w := httptest.NewRecorder()
 	server.ServeHTTP(w, req)
 	assert := newAssert(t, "GET /invoices/1", w)
@@ -207,7 +224,7 @@ func TestInvoicesShowWithError(t *testing.T) {
 	repo := &MockRepo{}
 	repo.GetInvoiceById_ReturnValue = nil
 	repo.GetInvoiceById_ReturnError = errors.New("error")
-	server := New(NewEnv(repo), apiToken)
+	server := New(NewEnv(repo), testConfig)
 	w := httptest.NewRecorder()
 	server.ServeHTTP(w, req)
 	assert := newAssert(t, "GET /invoices/1", w)
@@ -224,7 +241,7 @@ func TestInvoicesShowSuccess(t *testing.T) {
 	repo := &MockRepo{}
 	repo.GetInvoiceById_ReturnValue = &invoiceStub
 	repo.GetInvoiceById_ReturnError = nil
-	server := New(NewEnv(repo), apiToken)
+	server := New(NewEnv(repo), testConfig)
 	w := httptest.NewRecorder()
 	server.ServeHTTP(w, req)
 	assert := newAssert(t, "GET /invoices/1", w)
@@ -233,6 +250,1020 @@ func TestInvoicesShowSuccess(t *testing.T) {
 	assert.StatusCodeEquals(http.StatusOK)
 }
 
+func TestInvoicesShowWithTaxes(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	repo.SetTaxEngine(models.TaxRules{
+		{Code: "ISS", Rate: 50000, EffectiveFrom: "2000-01-01", Scope: models.TaxPerInvoice, Inclusive: true, Rounding: models.RoundHalfUp},
+	})
+	repo.InsertInvoice(invoiceStub)
+	server := New(NewEnv(repo), testConfig)
+
+	var cases = []struct {
+		query    string
+		expected string
+	}{
+		{"", `[{"code":"ISS","rate":5,"inclusive":true,"base":42.42,"amount":2.02}]`},
+		// a projection leaves the taxes out
+		{"&fields=id", ""},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/invoices/1?apiToken="+apiToken+c.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, "GET /invoices/1"+c.query, w)
+		assert.StatusCodeEquals(http.StatusOK)
+
+		var response struct {
+			Item struct {
+				Taxes json.RawMessage
+			}
+		}
+		if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(response.Item.Taxes); actual != c.expected {
+			t.Errorf("GET /invoices/1%v: taxes should have been %v, but were %v instead.", c.query, c.expected, actual)
+		}
+	}
+}
+
+func TestInvoicesIndexWithMemoryRepo(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	for k, document := range []string{"a", "b", "a", "c", "a"} {
+		invoice := invoiceStub
+		invoice.Id, invoice.Document = k+1, document
+		repo.InsertInvoice(invoice)
+	}
+	req, err := http.NewRequest("GET", "/invoices?document=a&sort=-document&perPage=2&apiToken="+apiToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(NewEnv(repo), testConfig)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert := newAssert(t, "GET /invoices", w)
+	assert.StatusCodeEquals(http.StatusOK)
+	assert.HeaderEquals("X-Total-Count", "3")
+	var response struct {
+		Items []models.Invoice
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.IntEquals(len(response.Items), 2)
+	assert.IntEquals(response.Items[0].Id, 1)
+	assert.IntEquals(response.Items[1].Id, 3)
+}
+
+func TestInvoicesIndexFilters(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	for k, amount := range []models.Money{1000, 2000, 3000, 4000} {
+		invoice := invoiceStub
+		invoice.Id, invoice.Amount = k+1, amount
+		invoice.Description = []string{"Fee", "rent", "fee", "food"}[k]
+		repo.InsertInvoice(invoice)
+	}
+	repo.DeleteInvoice("", 4, 0)
+	server := New(NewEnv(repo), testConfig)
+
+	var cases = []struct {
+		query        string
+		expectedCode int
+		expectedIds  []int
+		expectedErr  string
+	}{
+		{"amount[gte]=20", http.StatusOK, []int{2, 3}, ""},
+		{"amount[gt]=10&amount[lt]=30", http.StatusOK, []int{2}, ""},
+		{"description[contains]=FE", http.StatusOK, []int{1, 3}, ""},
+		{"document[in]=docStub,other&amount[lte]=10", http.StatusOK, []int{1}, ""},
+		{"createdAt[lt]=2000-01-01", http.StatusOK, nil, ""},
+		{"amount[gt]=30&includeInactive=true", http.StatusOK, []int{4}, ""},
+		{"amount[gte]=ten", http.StatusBadRequest, nil, "parameter amount[gte] must be a number with up to two decimals"},
+		{"referenceYear[in]=2016,x", http.StatusBadRequest, nil, "parameter referenceYear[in] must be an integer"},
+		{"createdAt[gt]=yesterday", http.StatusBadRequest, nil, "parameter createdAt[gt] must be a date (2006-01-02 or RFC 3339)"},
+		{"description[gt]=a", http.StatusBadRequest, nil, "operator gt is not supported on description"},
+		{"document[in]=a,123456789012345", http.StatusBadRequest, nil, documentMaxLengthErrorMsg},
+		{"includeInactive=maybe", http.StatusBadRequest, nil, "parameter includeInactive must be true or false"},
+		{"amount[gte]=1&amount[gte]=2", http.StatusBadRequest, nil, "duplicate parameter amount[gte]"},
+		{"isActive=false", http.StatusBadRequest, nil, "invalid parameter isActive"},
+		{"filter=" + url.QueryEscape("amount gt 15 and (description contains 'fee' or amount eq 20)"), http.StatusOK, []int{2, 3}, ""},
+		{"filter=" + url.QueryEscape("amount lt 30") + "&amount[gt]=10", http.StatusOK, []int{2}, ""},
+		{"filter=" + url.QueryEscape("amount gt 15 and (amount lt 1"), http.StatusBadRequest, nil, "parameter filter is invalid: expected ), found the end of the expression at column 30"},
+		{"filter=" + url.QueryEscape("amount gt 'x'"), http.StatusBadRequest, nil, "parameter filter is invalid: amount must be compared with a number with up to two decimals, found 'x' at column 11"},
+		{"filter=", http.StatusBadRequest, nil, "parameter filter is invalid: empty expression at column 1"},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/invoices?"+c.query+"&apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.query, w)
+		assert.StatusCodeEquals(c.expectedCode)
+
+		var response struct {
+			Items  []models.Invoice
+			Errors []string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if c.expectedErr != "" {
+			if len(response.Errors) != 1 || response.Errors[0] != c.expectedErr {
+				t.Errorf("%v: errors should have been [%v], but were %v instead.", c.query, c.expectedErr, response.Errors)
+			}
+			continue
+		}
+		ids := []int{}
+		for _, i := range response.Items {
+			ids = append(ids, i.Id)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(append([]int{}, c.expectedIds...)) {
+			t.Errorf("%v: ids should have been %v, but were %v instead.", c.query, c.expectedIds, ids)
+		}
+	}
+}
+
+func TestInvoicesFields(t *testing.T) {
+	server := New(NewEnv(newMemoryRepoWithStub()), testConfig)
+
+	var cases = []struct {
+		path         string
+		expectedCode int
+		expectedKeys string
+	}{
+		{"/invoices?fields=id,amount,document", http.StatusOK, "amount,document,id"},
+		{"/invoices?fields=version&limit=1", http.StatusOK, "version"},
+		{"/invoices", http.StatusOK, "amount,amountPaid,createdAt,currency,deactiveAt,description,document,id,isActive,referenceMonth,referenceYear,status,updatedAt,version"},
+		{"/invoices/1?fields=description", http.StatusOK, "description"},
+		{"/invoices?fields=id,tenantId", http.StatusBadRequest, ""},
+		{"/invoices?fields=", http.StatusBadRequest, ""},
+		{"/invoices/1?fields=amount,", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		separator := "&"
+		if !strings.Contains(c.path, "?") {
+			separator = "?"
+		}
+		req, err := http.NewRequest("GET", c.path+separator+"apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.path, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.expectedCode != http.StatusOK {
+			continue
+		}
+
+		var response struct {
+			Item  map[string]interface{}
+			Items []map[string]interface{}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		item := response.Item
+		if item == nil && len(response.Items) > 0 {
+			item = response.Items[0]
+		}
+		keys := []string{}
+		for key := range item {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != c.expectedKeys {
+			t.Errorf("%v: keys should have been %v, but were %v instead.", c.path, c.expectedKeys, keys)
+		}
+	}
+}
+
+func TestInvoicesAggregate(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	for k, amount := range []models.Money{1000, 2000, 4000, 8000} {
+		invoice := invoiceStub
+		invoice.Id, invoice.Amount = k+1, amount
+		invoice.ReferenceYear, invoice.ReferenceMonth = 2016+k/2, 1+k%2
+		repo.InsertInvoice(invoice)
+	}
+	server := New(NewEnv(repo), testConfig)
+
+	var cases = []struct {
+		query         string
+		expectedCode  int
+		expectedBody  string
+		expectedCount string
+	}{
+		{
+			"groupBy=referenceYear&metrics=sum(amount),count,avg(amount)", http.StatusOK,
+			`{"items":[{"avg(amount)":15,"count":2,"referenceYear":2016,"sum(amount)":30.00},{"avg(amount)":60,"count":2,"referenceYear":2017,"sum(amount)":120.00}]}`, "2",
+		},
+		{
+			"groupBy=referenceYear,referenceMonth&metrics=sum(amount)&sort=-sum(amount)&perPage=1&page=2", http.StatusOK,
+			`{"items":[{"referenceMonth":1,"referenceYear":2017,"sum(amount)":40.00}]}`, "4",
+		},
+		{"amount[gte]=20&filter=referenceMonth+eq+2", http.StatusOK, `{"items":[{"count":2}]}`, "1"},
+		{"metrics=max(amount)&document=none", http.StatusOK, `{"items":[{"max(amount)":null}]}`, "1"},
+		{"groupBy=amount", http.StatusBadRequest, "", ""},
+		{"groupBy=document,document", http.StatusBadRequest, "", ""},
+		{"metrics=sum(document)", http.StatusBadRequest, "", ""},
+		{"metrics=count&sort=-sum(amount)", http.StatusBadRequest, "", ""},
+		{"groupBy=document&sort=referenceYear", http.StatusBadRequest, "", ""},
+		{"limit=10", http.StatusBadRequest, "", ""},
+		{"amount[gte]=ten", http.StatusBadRequest, "", ""},
+		{"groupBy=document&page=2", http.StatusBadRequest, "", ""},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/invoices/aggregate?"+c.query+"&apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.query, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.expectedCode != http.StatusOK {
+			continue
+		}
+		assert.HeaderEquals("X-Total-Count", c.expectedCount)
+		if body := w.Body.String(); body != c.expectedBody {
+			t.Errorf("%v: body should have been %v, but was %v instead.", c.query, c.expectedBody, body)
+		}
+	}
+}
+
+// linkURL returns the URL of the rel link in the Link header of w, or "".
+func linkURL(w *httptest.ResponseRecorder, rel string) string {
+	for _, link := range strings.Split(w.Header().Get("Link"), ", ") {
+		if strings.HasSuffix(link, `; rel="`+rel+`"`) {
+			return link[1:strings.Index(link, ">")]
+		}
+	}
+	return ""
+}
+
+func TestInvoicesIndexKeyset(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	for k, document := range []string{"b", "a", "c", "a", "b"} {
+		invoice := invoiceStub
+		invoice.Id, invoice.Document = k+1, document
+		repo.InsertInvoice(invoice)
+	}
+	server := New(NewEnv(repo), testConfig)
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+	ids := func(w *httptest.ResponseRecorder) (ids []int) {
+		var response struct{ Items []models.Invoice }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		for _, i := range response.Items {
+			ids = append(ids, i.Id)
+		}
+		return
+	}
+
+	var pages [][]int
+	path := "/invoices?sort=-document&limit=2&apiToken=" + apiToken
+	var last *httptest.ResponseRecorder
+	for path != "" && len(pages) < 5 {
+		last = get(path)
+		assert := newAssert(t, path, last)
+		assert.StatusCodeEquals(http.StatusOK)
+		assert.HeaderEquals("X-Total-Count", "")
+		pages = append(pages, ids(last))
+		path = linkURL(last, "next")
+	}
+	expected := [][]int{{3, 1}, {5, 2}, {4}}
+	if fmt.Sprint(pages) != fmt.Sprint(expected) {
+		t.Errorf("pages should have been %v, but were %v instead.", expected, pages)
+	}
+
+	w := get(linkURL(last, "prev"))
+	newAssert(t, "prev", w).StatusCodeEquals(http.StatusOK)
+	if got := ids(w); len(got) != 2 || got[0] != 5 || got[1] != 2 {
+		t.Errorf("previous page should have been [5 2], but was %v instead.", got)
+	}
+	if linkURL(w, "first") == "" || linkURL(w, "next") == "" || linkURL(w, "prev") == "" {
+		t.Errorf("the middle page should link to the first, next and previous pages, but Link was %q.", w.Header().Get("Link"))
+	}
+
+	prev, _ := url.Parse(linkURL(last, "prev"))
+	otherSort := "sort=document&cursor=" + url.QueryEscape(prev.Query().Get("cursor"))
+	for _, query := range []string{"limit=2&page=1", "cursor=abc", "limit=0", otherSort} {
+		newAssert(t, query, get("/invoices?"+query+"&apiToken="+apiToken)).StatusCodeEquals(http.StatusBadRequest)
+	}
+}
+
+func newMemoryRepoWithStub() *models.MemoryRepo {
+	return newTenantRepoWithStub("")
+}
+
+// newTenantRepoWithStub is newMemoryRepoWithStub with the stub in tenant.
+func newTenantRepoWithStub(tenant string) *models.MemoryRepo {
+	invoice := invoiceStub
+	invoice.TenantId = tenant
+	repo := models.NewMemoryRepo()
+	repo.InsertInvoice(invoice)
+	return repo
+}
+
+func TestInvoicesPutReplacesFields(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+
+	body := url.Values{"document": {"newDoc"}, "amount": {"10.5"}}
+	req, err := http.NewRequest("PUT", "/invoices/1?apiToken="+apiToken, strings.NewReader(body.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert := newAssert(t, "PUT /invoices/1", w)
+	assert.StatusCodeEquals(http.StatusNoContent)
+
+	invoice, _ := repo.GetInvoiceById("", 1)
+	expected := invoiceStub
+	expected.Document, expected.Description, expected.Amount, expected.Version = "newDoc", "", 1050, 2
+	expected.UpdatedAt = invoice.UpdatedAt
+	assert.IsTrue(invoice.Equals(&expected))
+
+	req, _ = http.NewRequest("PUT", "/invoices/2?apiToken="+apiToken, strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	newAssert(t, "PUT /invoices/2", w).StatusCodeEquals(http.StatusNotFound)
+}
+
+func TestInvoicesPutValidatesLikePost(t *testing.T) {
+	server := New(NewEnv(newMemoryRepoWithStub()), testConfig)
+	var bodies = []url.Values{
+		{"document": {"doc"}},
+		{"document": {"doc"}, "amount": {"ten"}},
+		{"amount": {"10"}},
+		{"document": {"123456789012345"}, "amount": {"10"}},
+	}
+
+	for _, body := range bodies {
+		req, err := http.NewRequest("PUT", "/invoices/1?apiToken="+apiToken, strings.NewReader(body.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, body, w).StatusCodeEquals(http.StatusBadRequest)
+	}
+}
+
+func TestInvoicesAmountPrecision(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	var cases = []struct {
+		method       string
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{"POST", "application/x-www-form-urlencoded", "document=doc&amount=10.505", http.StatusUnprocessableEntity},
+		{"PUT", "application/x-www-form-urlencoded", "document=doc&amount=100000000000000", http.StatusUnprocessableEntity},
+		{"PUT", "application/x-www-form-urlencoded", "document=doc&amount=1e3", http.StatusBadRequest},
+		{"PATCH", mergePatchContentType, `{"amount": 0.333}`, http.StatusUnprocessableEntity},
+		{"PATCH", mergePatchContentType, `{"amount": 1e400}`, http.StatusUnprocessableEntity},
+		{"PATCH", mergePatchContentType, `{"amount": 0.1, "version": 1.0}`, http.StatusNoContent},
+		{"PATCH", jsonPatchContentType, `[{"op": "test", "path": "/amount", "value": 0.10}, {"op": "replace", "path": "/amount", "value": 0.30}]`, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		path := "/invoices?apiToken=" + apiToken
+		if c.method != "POST" {
+			path = "/invoices/1?apiToken=" + apiToken
+		}
+		req, err := http.NewRequest(c.method, path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, c.body, w).StatusCodeEquals(c.expectedCode)
+	}
+
+	req, _ := http.NewRequest("GET", "/invoices/1?fields=amount&apiToken="+apiToken, nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if body := w.Body.String(); body != `{"item":{"amount":0.30}}` {
+		t.Errorf("the amount should have been 0.30, but the body was %v instead.", body)
+	}
+}
+
+func TestInvoicesCurrency(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	var cases = []struct {
+		method       string
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{"POST", "application/x-www-form-urlencoded", "document=doc&amount=10.50&currency=XYZ", http.StatusBadRequest},
+		{"POST", "application/x-www-form-urlencoded", "document=doc&amount=10.50&currency=", http.StatusBadRequest},
+		{"POST", "application/x-www-form-urlencoded", "document=doc&amount=10.50&currency=JPY", http.StatusUnprocessableEntity},
+		{"POST", "application/x-www-form-urlencoded", "document=doc&amount=1050&currency=JPY", http.StatusCreated},
+		{"PUT", "application/x-www-form-urlencoded", "document=doc&amount=10.5&currency=JPY", http.StatusUnprocessableEntity},
+		{"PUT", "application/x-www-form-urlencoded", "document=doc&amount=10.5&currency=USD", http.StatusNoContent},
+		{"PATCH", mergePatchContentType, `{"currency": "JPY"}`, http.StatusUnprocessableEntity},
+		{"PATCH", mergePatchContentType, `{"currency": null}`, http.StatusUnprocessableEntity},
+		{"PATCH", mergePatchContentType, `{"currency": "EUR"}`, http.StatusNoContent},
+		{"PATCH", jsonPatchContentType, `[{"op": "replace", "path": "/currency", "value": "JPY"}, {"op": "replace", "path": "/amount", "value": 10}]`, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		path := "/invoices?apiToken=" + apiToken
+		if c.method != "POST" {
+			path = "/invoices/1?apiToken=" + apiToken
+		}
+		req, err := http.NewRequest(c.method, path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, c.body, w).StatusCodeEquals(c.expectedCode)
+	}
+
+	invoice, _ := repo.GetInvoiceById("", 1)
+	if invoice.Currency != "JPY" || invoice.Amount != 1000 {
+		t.Errorf("the invoice should have been 10 JPY, but was %v %v instead.", invoice.Amount, invoice.Currency)
+	}
+
+	// amounts add up while every invoice is in JPY, but not once one is not
+	var aggregates = []struct {
+		query        string
+		expectedCode int
+	}{
+		{"metrics=sum(amount)", http.StatusOK},
+		{"metrics=sum(amount)&currency=BRL", http.StatusBadRequest},
+		{"metrics=sum(amount)", http.StatusUnprocessableEntity},
+		{"metrics=max(amount)&groupBy=document", http.StatusUnprocessableEntity},
+		{"metrics=count", http.StatusOK},
+		{"metrics=sum(amount)&groupBy=currency", http.StatusOK},
+		{"metrics=sum(amount)&filter=currency+eq+'BRL'", http.StatusOK},
+	}
+	for k, c := range aggregates {
+		if k == 2 {
+			invoice.Id, invoice.Currency = 0, "BRL"
+			repo.InsertInvoice(*invoice)
+		}
+		req, err := http.NewRequest("GET", "/invoices/aggregate?"+c.query+"&apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, c.query, w).StatusCodeEquals(c.expectedCode)
+	}
+}
+
+func TestInvoicesCurrencyConversion(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	jan := time.Date(2016, 1, 15, 12, 0, 0, 0, time.UTC)
+	for k, currency := range []string{"BRL", "USD", "EUR", "USD"} {
+		invoice := invoiceStub
+		invoice.Id, invoice.Amount, invoice.Currency, invoice.CreatedAt = k+1, 1000, currency, jan
+		if k == 3 {
+			invoice.CreatedAt = jan.AddDate(0, 1, 0)
+		}
+		repo.InsertInvoice(invoice)
+	}
+	server := New(NewEnv(repo), testConfig)
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/admin/fxrates?apiToken="+apiToken, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	var uploads = []struct {
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{"application/json", `[{"date": "2016-01-01", "from": "USD", "to": "BRL", "rate": 4}]`, http.StatusNoContent},
+		{csvContentType, "date,from,to,rate\n2016-02-01,USD,BRL,4.5\n2016-01-01,BRL,EUR,0.25\n", http.StatusNoContent},
+		{"application/json", `[{"date": "2016-01-01", "from": "USD", "to": "XYZ", "rate": 4}]`, http.StatusUnprocessableEntity},
+		{"application/json", `[{"date": "2016-01-01", "from": "USD", "to": "BRL", "rate": -4}]`, http.StatusBadRequest},
+		{"application/json", `[]`, http.StatusBadRequest},
+		{"application/json", `{}`, http.StatusBadRequest},
+		{csvContentType, "2016-01-01,USD,BRL,4\n", http.StatusUnprocessableEntity},
+		{"text/plain", "", http.StatusUnsupportedMediaType},
+	}
+	for _, c := range uploads {
+		newAssert(t, c.body, post(c.contentType, c.body)).StatusCodeEquals(c.expectedCode)
+	}
+
+	var cases = []struct {
+		query        string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			"currency=BRL&fields=id,amount,currency", http.StatusOK,
+			`{"items":[{"amount":10.00,"currency":"BRL","id":1},{"amount":40.00,"currency":"BRL","id":2},{"amount":40.00,"currency":"BRL","id":3},{"amount":45.00,"currency":"BRL","id":4}]}`,
+		},
+		{"currency=BRL&fields=id&perPage=1&page=3", http.StatusOK, `{"items":[{"id":3}]}`},
+		{"currency=BRL&fields=id&limit=1", http.StatusOK, `{"items":[{"id":1}]}`},
+		{"currency=EUR&fields=amount&filter=currency+ne+'USD'", http.StatusOK, `{"items":[{"amount":2.50},{"amount":10.00}]}`},
+		{"currency=USD", http.StatusUnprocessableEntity, `{"error":"there is no exchange rate from EUR to USD on or before 2016-01-15"}`},
+		{"currency=XYZ", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/invoices?"+c.query+"&apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.query, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if body := w.Body.String(); c.expectedBody != "" && body != c.expectedBody {
+			t.Errorf("%v: body should have been %v, but was %v instead.", c.query, c.expectedBody, body)
+		}
+	}
+
+	if invoice, _ := repo.GetInvoiceById("", 2); invoice.Amount != 1000 || invoice.Currency != "USD" {
+		t.Errorf("the stored invoice should have been left as it was, but was %v %v.", invoice.Amount, invoice.Currency)
+	}
+}
+
+func TestInvoicesLineItems(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	const form, json = "application/x-www-form-urlencoded", "application/json"
+	var cases = []struct {
+		method         string
+		path           string
+		contentType    string
+		body           string
+		ifMatch        string
+		expectedCode   int
+		expectedAmount models.Money
+		expectedBody   string
+	}{
+		{"GET", "/invoices/1/items", "", "", "", http.StatusOK, 4242,
+			`{"items":[{"id":1,"description":"descriptionStub","quantity":1,"unitPrice":42.42,"discount":0.00,"total":42.42}]}`},
+		{"POST", "/invoices/1/items", form, "description=hours&quantity=3&unitPrice=100&discount=10.50", "", http.StatusCreated, 33192, ""},
+		{"POST", "/invoices/1/items", form, "quantity=x&unitPrice=1", "", http.StatusBadRequest, 33192, ""},
+		{"POST", "/invoices/1/items", form, "quantity=2", "", http.StatusBadRequest, 33192, ""},
+		{"POST", "/invoices/1/items", form, "unitPrice=1.005", "", http.StatusUnprocessableEntity, 33192, ""},
+		{"POST", "/invoices/1/items", form, "unitPrice=1&discount=1.01", "", http.StatusUnprocessableEntity, 33192, ""},
+		{"POST", "/invoices/1/items", form, "unitPrice=1&quantity=0", "", http.StatusUnprocessableEntity, 33192, ""},
+		{"POST", "/invoices/2/items", form, "unitPrice=1", "", http.StatusNotFound, 33192, ""},
+		// the amount of several items is their total
+		{"PUT", "/invoices/1", form, "document=doc&amount=1", "", http.StatusConflict, 33192, ""},
+		{"PATCH", "/invoices/1", mergePatchContentType, `{"amount": 1}`, "", http.StatusConflict, 33192, ""},
+		{"PATCH", "/invoices/1", mergePatchContentType, `{"currency": "JPY"}`, "", http.StatusUnprocessableEntity, 33192, ""},
+		{"PATCH", "/invoices/1", mergePatchContentType, `{"description": "two items"}`, "", http.StatusNoContent, 33192, ""},
+		{"GET", "/invoices/1/items/2", "", "", "", http.StatusOK, 33192,
+			`{"item":{"id":2,"description":"hours","quantity":3,"unitPrice":100.00,"discount":10.50,"total":289.50}}`},
+		{"GET", "/invoices/1/items/3", "", "", "", http.StatusNotFound, 33192, ""},
+		{"PUT", "/invoices/1/items/2", form, "quantity=2&unitPrice=100", `"3"`, http.StatusNoContent, 24242, ""},
+		{"PUT", "/invoices/1/items/2", form, "quantity=2&unitPrice=100", `"3"`, http.StatusPreconditionFailed, 24242, ""},
+		{"PUT", "/invoices/1/items/3", form, "unitPrice=1", "", http.StatusNotFound, 24242, ""},
+		{"DELETE", "/invoices/1/items/x", "", "", "", http.StatusBadRequest, 24242, ""},
+		{"PUT", "/invoices/1/items", json, `[{"description": "a", "quantity": 2, "unitPrice": 5}, {"unitPrice": 1.5, "discount": 0.5}]`, "", http.StatusNoContent, 1100, ""},
+		{"GET", "/invoices/1/items", "", "", "", http.StatusOK, 1100,
+			`{"items":[{"id":1,"description":"a","quantity":2,"unitPrice":5.00,"discount":0.00,"total":10.00},{"id":2,"description":"","quantity":1,"unitPrice":1.50,"discount":0.50,"total":1.00}]}`},
+		{"PUT", "/invoices/1/items", form, "unitPrice=1", "", http.StatusUnsupportedMediaType, 1100, ""},
+		{"PUT", "/invoices/1/items", json, `{"unitPrice": 1}`, "", http.StatusBadRequest, 1100, ""},
+		{"PUT", "/invoices/1/items", json, `[{"quantity": 2}]`, "", http.StatusUnprocessableEntity, 1100, ""},
+		{"PUT", "/invoices/1/items", json, `[{"unitPrice": 1}, {"unitPrice": 1, "quantity": 0}]`, "", http.StatusUnprocessableEntity, 1100, ""},
+		{"DELETE", "/invoices/1/items/1", "", "", "", http.StatusNoContent, 100, ""},
+		{"DELETE", "/invoices/1/items/1", "", "", "", http.StatusNotFound, 100, ""},
+		// while there is a single item, the amount can be set as before
+		{"PUT", "/invoices/1", form, "document=doc&amount=5", "", http.StatusNoContent, 500, ""},
+		{"GET", "/invoices/1/items", "", "", "", http.StatusOK, 500,
+			`{"items":[{"id":2,"description":"","quantity":1,"unitPrice":5.00,"discount":0.00,"total":5.00}]}`},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.path+"?apiToken="+apiToken, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		if c.ifMatch != "" {
+			req.Header.Set("If-Match", c.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.method+" "+c.path+" "+c.body, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.expectedBody != "" && w.Body.String() != c.expectedBody {
+			t.Errorf("%v %v: body should have been %v, but was %v instead.", c.method, c.path, c.expectedBody, w.Body.String())
+		}
+		if c.method == "POST" && c.expectedCode == http.StatusCreated {
+			assert.HeaderEquals("Location", "/invoices/1/items/2")
+		}
+		if invoice, _ := repo.GetInvoiceById("", 1); invoice.Amount != c.expectedAmount {
+			t.Errorf("%v %v %v: amount should have been %v, but was %v instead.", c.method, c.path, c.body, c.expectedAmount, invoice.Amount)
+		}
+	}
+}
+
+func TestInvoicesStatus(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	var cases = []struct {
+		method         string
+		path           string
+		body           string
+		expectedCode   int
+		expectedStatus models.InvoiceStatus
+		expectedError  string
+	}{
+		{"POST", "/invoices/1/pay", "", http.StatusConflict, models.StatusDraft, "illegal transition: pay can't happen to an invoice that is draft"},
+		{"POST", "/invoices/1/issue", "", http.StatusOK, models.StatusIssued, ""},
+		{"POST", "/invoices/1/issue", "", http.StatusConflict, models.StatusIssued, "illegal transition: issue can't happen to an invoice that is issued"},
+		// issued invoices can no longer be changed
+		{"PUT", "/invoices/1", "document=doc&amount=1", http.StatusConflict, models.StatusIssued, "the invoice was issued and can no longer be changed"},
+		{"PATCH", "/invoices/1", `{"description": "x"}`, http.StatusConflict, models.StatusIssued, "the invoice was issued and can no longer be changed"},
+		{"POST", "/invoices/1/items", "unitPrice=1", http.StatusConflict, models.StatusIssued, "the invoice was issued and can no longer be changed"},
+		{"DELETE", "/invoices/1", "", http.StatusConflict, models.StatusIssued, "the invoice was issued and can no longer be changed"},
+		{"PATCH", "/invoices/1", `{"status": "paid"}`, http.StatusUnprocessableEntity, models.StatusIssued, ""},
+		{"POST", "/invoices/1/pay", "amount=x", http.StatusBadRequest, models.StatusIssued, "amount parameter must be a number"},
+		{"POST", "/invoices/1/pay", "amount=-1", http.StatusUnprocessableEntity, models.StatusIssued, "amount parameter must be positive"},
+		{"POST", "/invoices/1/pay", "amount=50", http.StatusUnprocessableEntity, models.StatusIssued, "invalid payment: the payment cannot exceed the balance of 42.42"},
+		{"POST", "/invoices/1/pay", "amount=40", http.StatusOK, models.StatusPartiallyPaid, ""},
+		{"POST", "/invoices/1/void", "", http.StatusConflict, models.StatusPartiallyPaid, "illegal transition: void can't happen to an invoice that is partially_paid"},
+		{"POST", "/invoices/1/overdue", "", http.StatusOK, models.StatusOverdue, ""},
+		{"POST", "/invoices/1/pay", "", http.StatusOK, models.StatusPaid, ""},
+		{"POST", "/invoices/1/refund", "", http.StatusOK, models.StatusRefunded, ""},
+		{"POST", "/invoices/2/issue", "", http.StatusNotFound, models.StatusRefunded, ""},
+		{"POST", "/invoices/x/issue", "", http.StatusBadRequest, models.StatusRefunded, "parameter id should be an integer"},
+		{"GET", "/invoices?status=open", "", http.StatusBadRequest, models.StatusRefunded, ""},
+		{"GET", "/invoices?sort=-status&status[in]=draft,refunded", "", http.StatusOK, models.StatusRefunded, ""},
+		{"GET", "/invoices?status=draft", "", http.StatusOK, models.StatusRefunded, ""},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := req.URL.Query()
+		q.Set("apiToken", apiToken)
+		req.URL.RawQuery = q.Encode()
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.method == "PATCH" {
+			req.Header.Set("Content-Type", mergePatchContentType)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c.method+" "+c.path+" "+c.body, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.expectedError != "" {
+			assert.BodyErrorMessageEquals(c.expectedError)
+		}
+		if c.method == "POST" && c.expectedCode == http.StatusOK {
+			assert.IsTrue(w.Header().Get("ETag") != "")
+			if !strings.Contains(w.Body.String(), `"status":"`+string(c.expectedStatus)+`"`) {
+				t.Errorf("%v %v: body should have had status %v, but was %v instead.", c.method, c.path, c.expectedStatus, w.Body.String())
+			}
+		}
+		if c.method == "GET" && c.expectedCode == http.StatusOK {
+			expected := strings.Contains(c.path, "refunded")
+			if actual := strings.Contains(w.Body.String(), `"id":1`); actual != expected {
+				t.Errorf("%v %v: invoice 1 should have been listed: %v, but was: %v instead.", c.method, c.path, expected, actual)
+			}
+		}
+		if invoice, _ := repo.GetInvoiceById("", 1); invoice.Status != c.expectedStatus {
+			t.Errorf("%v %v %v: status should have been %v, but was %v instead.", c.method, c.path, c.body, c.expectedStatus, invoice.Status)
+		}
+	}
+}
+
+func TestInvoicesPayRetry(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	repo.TransitionInvoice("", 1, 0, models.EventIssue, 0)
+	server := New(NewEnv(repo), testConfig)
+	invoice, _ := repo.GetInvoiceById("", 1)
+	etag := versionETag(invoice.Version)
+
+	for _, replayed := range []string{"", "true"} {
+		req, err := http.NewRequest("POST", "/invoices/1/pay?apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-Match", etag)
+		req.Header.Set("Idempotency-Key", "pay-1")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, "pay "+replayed, w)
+		assert.StatusCodeEquals(http.StatusOK)
+		assert.HeaderEquals("Idempotent-Replayed", replayed)
+	}
+}
+
+func TestInvoicesMergePatch(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	var cases = []struct {
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{"application/json", `{"amount": 1}`, http.StatusUnsupportedMediaType},
+		{mergePatchContentType, `{"amount": `, http.StatusBadRequest},
+		{mergePatchContentType, `{"id": 2}`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `{"createdAt": null}`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `{"unknown": 1}`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `{"document": ""}`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `{"document": null}`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `{"amount": "12"}`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `[]`, http.StatusUnprocessableEntity},
+		{mergePatchContentType, `{"amount": 12.5, "description": null}`, http.StatusNoContent},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("PATCH", "/invoices/1?apiToken="+apiToken, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, c.body, w).StatusCodeEquals(c.expectedCode)
+	}
+
+	invoice, _ := repo.GetInvoiceById("", 1)
+	expected := invoiceStub
+	expected.Description, expected.Amount, expected.Version = "", 1250, 2
+	expected.UpdatedAt = invoice.UpdatedAt
+	if !invoice.Equals(&expected) {
+		t.Errorf("invoice should have been %v, but was %v instead.", expected, invoice)
+	}
+}
+
+func TestInvoicesJSONPatch(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	var cases = []struct {
+		body         string
+		expectedCode int
+	}{
+		{`{"op": "replace"}`, http.StatusBadRequest},
+		{`[{"op": "increment", "path": "/amount"}]`, http.StatusBadRequest},
+		{`[{"op": "replace", "path": "/amount"}]`, http.StatusBadRequest},
+		{`[{"op": "replace", "path": "amount", "value": 1}]`, http.StatusBadRequest},
+		{`[{"op": "test", "path": "/document", "value": "otherDoc"}, {"op": "replace", "path": "/amount", "value": 1}]`, http.StatusConflict},
+		{`[{"op": "replace", "path": "/amount", "value": 1}, {"op": "test", "path": "/amount", "value": 2}]`, http.StatusConflict},
+		{`[{"op": "replace", "path": "/nope", "value": 1}]`, http.StatusUnprocessableEntity},
+		{`[{"op": "remove", "path": "/document"}]`, http.StatusUnprocessableEntity},
+		{`[{"op": "replace", "path": "/id", "value": 7}]`, http.StatusUnprocessableEntity},
+		{`[{"op": "add", "path": "/amount", "value": -1}, {"op": "replace", "path": "/document", "value": "123456789012345"}]`, http.StatusUnprocessableEntity},
+		{`[
+			{"op": "test", "path": "/document", "value": "docStub"},
+			{"op": "copy", "from": "/document", "path": "/description"},
+			{"op": "replace", "path": "/amount", "value": 99.9},
+			{"op": "add", "path": "/document", "value": "newDoc"},
+			{"op": "test", "path": "/deactiveAt/Valid", "value": false}
+		]`, http.StatusNoContent},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("PATCH", "/invoices/1?apiToken="+apiToken, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", jsonPatchContentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		newAssert(t, c.body, w).StatusCodeEquals(c.expectedCode)
+	}
+
+	invoice, _ := repo.GetInvoiceById("", 1)
+	expected := invoiceStub
+	expected.Document, expected.Description, expected.Amount, expected.Version = "newDoc", "docStub", 9990, 2
+	expected.UpdatedAt = invoice.UpdatedAt
+	if !invoice.Equals(&expected) {
+		t.Errorf("invoice should have been %v, but was %v instead.", expected, invoice)
+	}
+}
+
+func TestInvoicesIfMatch(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), testConfig)
+	patch := `{"description": "changed"}`
+	var cases = []struct {
+		method       string
+		ifMatch      string
+		expectedCode int
+	}{
+		{"GET", "", http.StatusOK},
+		{"PATCH", `"2"`, http.StatusPreconditionFailed},
+		{"PATCH", `W/"1"`, http.StatusPreconditionFailed},
+		{"PATCH", `"1", "2"`, http.StatusBadRequest},
+		{"PATCH", `"1"`, http.StatusNoContent},
+		{"PATCH", `"1"`, http.StatusPreconditionFailed},
+		{"PATCH", "*", http.StatusNoContent},
+		{"DELETE", `"2"`, http.StatusPreconditionFailed},
+		{"DELETE", `"3"`, http.StatusNoContent},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, "/invoices/1?apiToken="+apiToken, strings.NewReader(patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mergePatchContentType)
+		if c.ifMatch != "" {
+			req.Header.Set("If-Match", c.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.method == "GET" {
+			assert.HeaderEquals("ETag", `"1"`)
+		}
+	}
+}
+
+func TestInvoicesRequireIfMatch(t *testing.T) {
+	server := New(NewEnv(newMemoryRepoWithStub()), Config{APIToken: apiToken, LegacyTokenAuth: true, RequireIfMatch: true})
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		req, err := http.NewRequest(method, "/invoices/1?apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, method, w)
+		assert.StatusCodeEquals(http.StatusPreconditionRequired)
+		assert.BodyErrorMessageEquals("If-Match header required")
+	}
+}
+
+func TestInvoicesConditionalGet(t *testing.T) {
+	repo := newMemoryRepoWithStub()
+	server := New(NewEnv(repo), Config{APIToken: apiToken, LegacyTokenAuth: true, ItemCacheControl: "private, max-age=60"})
+	get := func(path string, header string, value string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path+"?apiToken="+apiToken, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/invoices/1", "", "")
+	assert := newAssert(t, "GET /invoices/1", w)
+	assert.StatusCodeEquals(http.StatusOK)
+	assert.HeaderEquals("Cache-Control", "private, max-age=60")
+	lastModified := w.Header().Get("Last-Modified")
+	modifiedAt, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		header       string
+		value        string
+		expectedCode int
+	}{
+		{"If-None-Match", `"1"`, http.StatusNotModified},
+		{"If-None-Match", `W/"1"`, http.StatusNotModified},
+		{"If-None-Match", `"0", "1"`, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"2"`, http.StatusOK},
+		{"If-Modified-Since", lastModified, http.StatusNotModified},
+		{"If-Modified-Since", modifiedAt.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+		{"If-Modified-Since", "not a date", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := get("/invoices/1", c.header, c.value)
+		assert := newAssert(t, c, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		if c.expectedCode == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%v: body should have been empty, but was %v instead.", c, w.Body.String())
+		}
+	}
+
+	w = get("/invoices", "", "")
+	etag := w.Header().Get("ETag")
+	newAssert(t, "GET /invoices", w).StatusCodeEquals(http.StatusOK)
+	newAssert(t, "GET /invoices revalidation", get("/invoices", "If-None-Match", etag)).StatusCodeEquals(http.StatusNotModified)
+
+	invoice := invoiceStub
+	invoice.Id = 2
+	repo.InsertInvoice(invoice)
+	w = get("/invoices", "If-None-Match", etag)
+	newAssert(t, "GET /invoices after insert", w).StatusCodeEquals(http.StatusOK)
+	if w.Header().Get("ETag") == etag {
+		t.Error("list ETag should have changed after an insert.")
+	}
+}
+
+func TestInvoicesPostIdempotencyKey(t *testing.T) {
+	repo := models.NewMemoryRepo()
+	server := New(NewEnv(repo), testConfig)
+	var cases = []struct {
+		key          string
+		document     string
+		expectedCode int
+		replayed     string
+	}{
+		{"a", "doc1", http.StatusCreated, ""},
+		{"a", "doc1", http.StatusCreated, "true"},
+		{"a", "doc2", http.StatusUnprocessableEntity, ""},
+		{"b", "doc2", http.StatusCreated, ""},
+		{"", "doc2", http.StatusCreated, ""},
+		{strings.Repeat("x", 256), "doc2", http.StatusBadRequest, ""},
+	}
+
+	var locations []string
+	for _, c := range cases {
+		form := url.Values{"document": {c.document}, "amount": {"1.5"}}
+		req, err := http.NewRequest("POST", "/invoices?apiToken="+apiToken, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.key != "" {
+			req.Header.Set("Idempotency-Key", c.key)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert := newAssert(t, c, w)
+		assert.StatusCodeEquals(c.expectedCode)
+		assert.HeaderEquals("Idempotent-Replayed", c.replayed)
+		locations = append(locations, w.Header().Get("Location"))
+	}
+
+	if locations[0] == "" || locations[1] != locations[0] {
+		t.Errorf("replayed Location should have been %v, but was %v instead.", locations[0], locations[1])
+	}
+	if count, _ := repo.CountInvoices("", &models.QueryOptions{}); count != 3 {
+		t.Errorf("3 invoices should have been created, but %v were.", count)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnPanic(t *testing.T) {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	calls := 0
+	router.POST("/", idempotencyMiddleware(models.NewMemoryRepo(), 0), func(c *gin.Context) {
+		if calls++; calls == 1 {
+			panic("boom")
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	for _, expectedCode := range []int{http.StatusInternalServerError, http.StatusCreated} {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.Header.Set("Idempotency-Key", "k")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		newAssert(t, expectedCode, w).StatusCodeEquals(expectedCode)
+	}
+}
+
+func TestApplyJSONPatchArrays(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"a": [1, 2, 3], "b": {"c~/d": 4}}`), &doc)
+	ops, err := parseJSONPatch([]byte(`[
+		{"op": "add", "path": "/a/1", "value": 9},
+		{"op": "remove", "path": "/a/0"},
+		{"op": "add", "path": "/a/-", "value": 5},
+		{"op": "move", "from": "/b/c~0~1d", "path": "/a/0"},
+		{"op": "test", "path": "/a", "value": [4, 9, 2, 3, 5]},
+		{"op": "test", "path": "/b", "value": {}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = applyJSONPatch(doc, ops); err != nil {
+		t.Error(err)
+	}
+}
+
 type assert struct {
 	t  *testing.T
 	id interface{}
@@ -265,6 +1296,12 @@ func (a *assert) StatusCodeEquals(expectedStatusCode int) {
 	}
 }
 
+func (a *assert) HeaderEquals(key string, expectedValue string) {
+	if a.w.Header().Get(key) != expectedValue {
+		a.t.Errorf("%v: header %v should have been \"%v\", but was \"%v\" instead.", a.id, key, expectedValue, a.w.Header().Get(key))
+	}
+}
+
 func (a *assert) BodyErrorMessageEquals(expectedErrorMessage string) {
 	if a.w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
 		a.t.Errorf("%v: wrong Content-Type header. Expected \"application/json; charset=utf-8\", but was \"%v\" instead.", a.id, a.w.Header().Get("Content-Type"))
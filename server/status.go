@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/igormartire/gorfiv/models"
+)
+
+func (env *Env) invoicesTransition(event models.InvoiceEvent) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := invoiceIdParam(c)
+		if !ok {
+			return
+		}
+
+		var payment models.Money
+		if value, ok := c.GetPostForm("amount"); ok && event == models.EventPay {
+			var err error
+			payment, err = models.ParseMoney(value)
+			if err == models.InvalidMoney {
+				respondWithError(c, http.StatusBadRequest, "amount parameter must be a number")
+				return
+			} else if err != nil {
+				respondWithError(c, http.StatusUnprocessableEntity, moneyErrorMsg("amount parameter", err))
+				return
+			} else if payment <= 0 {
+				respondWithError(c, http.StatusUnprocessableEntity, "amount parameter must be positive")
+				return
+			}
+		}
+
+		invoice, err := env.statuses.TransitionInvoice(tenant(c), id, ifMatchVersion(c), event, payment)
+		_, illegal := err.(*models.TransitionError)
+		_, invalid := err.(*models.PaymentError)
+		switch {
+		case err == nil:
+			c.Header("ETag", versionETag(invoice.Version))
+			c.JSON(http.StatusOK, gin.H{"item": invoice})
+		case illegal:
+			respondWithError(c, http.StatusConflict, err.Error())
+		case invalid:
+			respondWithError(c, http.StatusUnprocessableEntity, err.Error())
+		case err == models.InvoiceNotFound:
+			respondWithError(c, http.StatusNotFound, "there is no resource with the specified id")
+		case err == models.VersionConflict:
+			respondWithVersionConflict(c)
+		default:
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func statusList() string {
+	statuses := make([]string, len(models.InvoiceStatuses))
+	for k, status := range models.InvoiceStatuses {
+		statuses[k] = string(status)
+	}
+	return strings.Join(statuses, ", ")
+}
+
+func respondWithNotDraft(c *gin.Context, err error) bool {
+	if err != models.InvoiceNotDraft {
+		return false
+	}
+	respondWithError(c, http.StatusConflict, "the invoice was issued and can no longer be changed")
+	return true
+}